@@ -72,8 +72,12 @@ if [ "$#" -eq 0 ]; then
 	argv="$(render_argv "$@")"
 fi
 
+# Build from the main file's directory so go.mod/go.sum resolve its
+# dependencies; the binary still runs in the caller's working directory.
+main_dir="$(cd "$(dirname "${main_file}")" && pwd)"
+bin_file="${GOCACHE}/jgo-bin"
 set +e
-go run "${main_file}" "$@"
+go build -C "${main_dir}" -o "${bin_file}" . && "${bin_file}" "$@"
 status=$?
 set -e
 
@@ -1,3 +1,10 @@
 module jgo
 
 go 1.22
+
+require (
+	github.com/gofrs/flock v0.12.1
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.22.0 // indirect
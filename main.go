@@ -4,41 +4,149 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand/v2"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime/debug"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gofrs/flock"
+	"gopkg.in/yaml.v3"
 )
 
 const (
-	defaultListenAddr = ":8080"
-	defaultOpenAIBase = "https://api.openai.com/v1"
-	servedModelID     = "jgo"
-	defaultReasoning  = "xhigh"
-	defaultTransport  = "local"
-	transportLocal    = "local"
-	transportSSH      = "ssh"
-	maxRunHistorySize = 120
+	defaultListenAddr    = ":8080"
+	configWatchInterval  = 2 * time.Second
+	defaultOpenAIBase    = "https://api.openai.com/v1"
+	servedModelID        = "jgo"
+	approxCharsPerToken  = 4
+	maxStopSequences     = 4
+	maxRequestMetadata   = 16
+	defaultReasoning     = "xhigh"
+	defaultTransport     = "local"
+	transportLocal       = "local"
+	transportSSH         = "ssh"
+	maxRunHistorySize    = 120
+	maxTranscriptSize    = 1 << 20
+	maxRunSteps          = 500
+	maxAttachments       = 10
+	maxAttachmentBytes   = 20 << 20
+	maxChatTools         = 128
+	maxMCPMessageBytes   = 4 << 20
+	maxGitHubDeliveries  = 1000
+	fileLockWait         = 10 * time.Second
+	toolCallsOpenTag     = "<tool_calls>"
+	toolCallsCloseTag    = "</tool_calls>"
+	maxStepOutput        = 4000
+	webhookAttempts      = 5
+	webhookTimeout       = 10 * time.Second
+	defaultGitHubTrigger = "/jgo"
+	githubReplyMarker    = "<!-- jgo-run:"
+	cacheRootDir         = ".jgo-cache"
+	missedRunSkip        = "skip"
+	missedRunOnce        = "run_once"
+	defaultDrainTimeout  = 25 * time.Second
+	defaultOptimizerWait = 60 * time.Second
+	defaultOptimizerTry  = 2
+	defaultBreakerLimit  = 5
+	defaultBreakerPause  = 30 * time.Second
+	maxOptimizerBackoff  = 8 * time.Second
+	maxRetryAfter        = 30 * time.Second
+	interruptGrace       = 10 * time.Second
+	codexWaitDelay       = 5 * time.Second
+	defaultApprovalWait  = time.Hour
+	approvalSweepEvery   = 30 * time.Second
+	scopeRun             = "run"
+	scopeApprove         = "approve"
+	scopeAudit           = "audit"
+
+	codexLoginRequiredMessage = "codex가 로그인되어 있지 않습니다. 먼저 `codex login`을 실행한 뒤 다시 요청하세요."
 )
 
 var errCodexLoginRequired = errors.New("codex login is required")
+var errRunTimeout = errors.New("run timed out")
+var errRunInterrupted = errors.New("run interrupted by server shutdown")
+var errRunCancelled = errors.New("run cancelled")
+var errServerDraining = errors.New("server is shutting down")
+var errOptimizerUnavailable = errors.New("optimizer provider unavailable")
+var errDestructiveUnconfirmed = errors.New("destructive plan requires explicit confirmation")
+var errRequiredCLIMissing = errors.New("plan requires CLIs that are not available")
+var errAwaitingApproval = errors.New("run is awaiting approval")
+var errDailyQuota = errors.New("daily run quota reached")
+
+var reasoningEfforts = []string{"minimal", "low", "medium", "high", "xhigh"}
+var githubAssociations = []string{"OWNER", "MEMBER", "COLLABORATOR", "CONTRIBUTOR", "FIRST_TIME_CONTRIBUTOR", "FIRST_TIMER", "MANNEQUIN", "NONE"}
+
+// kubectlChangePattern matches kubectl subcommands that change cluster state;
+// it backs the built-in prod-kubectl policy when the planner gave no risk level.
+var kubectlChangePattern = regexp.MustCompile(`(?i)\bkubectl\s+(?:\S+\s+)*?(apply|create|delete|edit|patch|replace|rollout|scale|set|label|annotate|drain|cordon|uncordon|taint|expose|autoscale)\b`)
+var repoRefPattern = regexp.MustCompile(`[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+`)
+var toolNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+var dotenvKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+var templatePlaceholderPattern = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
 
 var runCounter atomic.Uint64
 var runHistoryMu sync.Mutex
 var runHistory []runHistoryRecord
+var runHistoryPath string
+
+// runHistoryShared is set for jgo mcp, which shares the history file with a
+// running server: it only appends and leaves compaction to the server.
+var runHistoryShared bool
+var auditMu sync.Mutex
+var pendingRunsMu sync.Mutex
+var pendingRuns = make(map[string]*pendingRun)
+var optimizerBreakersMu sync.Mutex
+var optimizerBreakers = make(map[string]*circuitBreaker)
+
+// optimizerHTTPClient bounds connection setup; the overall per-attempt
+// deadline comes from the provider timeout.
+var optimizerHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 2 * time.Minute,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+var runHistoryFileLines int
+var serverRuns = &runTracker{cancels: make(map[string]context.CancelCauseFunc)}
+var runStreamsMu sync.Mutex
+var runStreams = make(map[string]*runStream)
+var runStreamOrder []string
+var githubDeliveriesMu sync.Mutex
+var githubDeliveries = make(map[string]bool)
+var githubDeliveryOrder []string
 
 type Config struct {
 	CodexBin        string
@@ -49,21 +157,316 @@ type Config struct {
 	SSHPort         string
 	SSHKeyPath      string
 	ReasoningEffort string
+	CodexJSON       bool
 	OptimizePrompt  bool
+	RunTimeout      time.Duration
+	Webhooks        []WebhookConfig
+	GitHub          GitHubConfig
+	SchedulesFile   string
+	TemplatesFile   string
+	HistoryFile     string
+	AuditFile       string
+	AuditKey        string
+	DrainTimeout    time.Duration
+	AvailableCLIs   []string
+	Optimizer       OpenAIConfig
+	Providers       []OptimizerProvider
+	OptimizerPolicy OptimizerPolicy
+	APIKeys         []APIKeyConfig
+	Policy          PolicyConfig
+	RateLimits      RateLimitConfig
+	StrictParams    bool
+	Profiles        []ModelProfile
+	// CLIAllowlist, set by a model profile, limits the CLIs offered to codex.
+	// It is advisory: it shapes the workspace prompt and blocks plans whose
+	// required_clis fall outside it, but codex itself can still run anything.
+	CLIAllowlist []string
+	ConfigPath   string
+}
+
+// ModelProfile is a virtual model listed by /v1/models. A request naming it
+// runs with the profile's non-empty fields applied over the server config.
+type ModelProfile struct {
+	Name            string `json:"name"`
+	Description     string `json:"description,omitempty"`
+	ReasoningEffort string `json:"reasoning_effort,omitempty"`
+	Transport       string `json:"transport,omitempty"`
+	// Target is the SSH destination, [user@]host[:port], for ssh runs.
+	Target         string `json:"target,omitempty"`
+	OptimizePrompt *bool  `json:"optimize_prompt,omitempty"`
+	// DryRun returns the plan without running codex.
+	DryRun  bool   `json:"dry_run,omitempty"`
+	Timeout string `json:"timeout,omitempty"`
+	// CLIs, when set, are the only CLIs offered to codex.
+	CLIs []string `json:"clis,omitempty"`
+}
+
+// APIKeyConfig is a bearer key accepted by the server. Scopes are "run"
+// (start runs, change schedules/templates) and "approve" (approve or reject
+// held runs); "*" grants both.
+type APIKeyConfig struct {
+	Name   string   `json:"name"`
+	Key    string   `json:"key"`
+	Scopes []string `json:"scopes"`
+	// RateLimit (requests per minute) and DailyRuns override the limits.*
+	// defaults for this key; 0 means unlimited.
+	RateLimit *int `json:"rate_limit,omitempty"`
+	DailyRuns *int `json:"daily_runs,omitempty"`
+}
+
+// RateLimitConfig caps run-starting requests with token buckets refilled
+// per minute and a daily run quota. Zero disables a limit.
+type RateLimitConfig struct {
+	PerKey    int
+	PerIP     int
+	Burst     int
+	DailyRuns int
+}
+
+type PolicyConfig struct {
+	Rules           []PolicyRule
+	ProdNamespaces  []string
+	ApprovalTimeout time.Duration
+}
+
+// PolicyRule holds a run for approval when every condition it sets matches.
+// Text conditions are checked against the instruction and optimized prompt.
+// validatePolicyRule compiles Pattern into re when the rule is loaded.
+type PolicyRule struct {
+	Name       string   `json:"name"`
+	Keywords   []string `json:"keywords,omitempty"`
+	Pattern    string   `json:"pattern,omitempty"`
+	RiskLevels []string `json:"risk_levels,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	Repos      []string `json:"repos,omitempty"`
+	CLIs       []string `json:"clis,omitempty"`
+
+	re *regexp.Regexp
+}
+
+type GitHubConfig struct {
+	WebhookSecret      string
+	Trigger            string
+	Reply              bool
+	AllowedAssociation []string
+}
+
+type WebhookConfig struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+type fileConfig struct {
+	Server    fileServerConfig    `json:"server"`
+	Transport fileTransportConfig `json:"transport"`
+	SSH       fileSSHConfig       `json:"ssh"`
+	Optimizer fileOptimizerConfig `json:"optimizer"`
+	Policy    filePolicyConfig    `json:"policy"`
+	Limits    fileLimitsConfig    `json:"limits"`
+	Webhooks  []WebhookConfig     `json:"webhooks"`
+	Profiles  []ModelProfile      `json:"profiles"`
+	GitHub    fileGitHubConfig    `json:"github"`
+	Storage   fileStorageConfig   `json:"storage"`
+}
+
+type fileServerConfig struct {
+	Listen       string         `json:"listen"`
+	APIKeys      []APIKeyConfig `json:"api_keys"`
+	StrictParams bool           `json:"strict_params"`
+}
+
+type fileTransportConfig struct {
+	Mode            string `json:"mode"`
+	CodexBin        string `json:"codex_bin"`
+	ReasoningEffort string `json:"reasoning_effort"`
+	CodexJSON       *bool  `json:"codex_json"`
+}
+
+type fileSSHConfig struct {
+	User string `json:"user"`
+	Host string `json:"host"`
+	Port string `json:"port"`
+}
+
+type fileOptimizerConfig struct {
+	Enabled          bool                `json:"enabled"`
+	BaseURL          string              `json:"base_url"`
+	APIKey           string              `json:"api_key"`
+	Model            string              `json:"model"`
+	Timeout          string              `json:"timeout"`
+	Retries          *int                `json:"retries"`
+	BreakerThreshold *int                `json:"breaker_threshold"`
+	BreakerCooldown  string              `json:"breaker_cooldown"`
+	FallbackToRaw    bool                `json:"fallback_to_raw"`
+	Providers        []OptimizerProvider `json:"providers"`
+}
+
+type filePolicyConfig struct {
+	AvailableCLIs   []string     `json:"available_clis"`
+	Rules           []PolicyRule `json:"rules"`
+	ProdNamespaces  []string     `json:"prod_namespaces"`
+	ApprovalTimeout string       `json:"approval_timeout"`
+}
+
+type fileLimitsConfig struct {
+	RunTimeout   string `json:"run_timeout"`
+	DrainTimeout string `json:"drain_timeout"`
+	RatePerKey   int    `json:"rate_per_key"`
+	RatePerIP    int    `json:"rate_per_ip"`
+	Burst        int    `json:"burst"`
+	DailyRuns    int    `json:"daily_runs"`
+}
+
+type fileGitHubConfig struct {
+	WebhookSecret       string   `json:"webhook_secret"`
+	Trigger             string   `json:"trigger"`
+	Reply               bool     `json:"reply"`
+	AllowedAssociations []string `json:"allowed_associations"`
+}
+
+type fileStorageConfig struct {
+	SchedulesFile string `json:"schedules_file"`
+	TemplatesFile string `json:"templates_file"`
+	HistoryFile   string `json:"history_file"`
+	AuditFile     string `json:"audit_file"`
+	AuditKey      string `json:"audit_key"`
+}
+
+type yamlError struct {
+	line int
+	msg  string
+}
+
+type configDecoder struct {
+	errs  []yamlError
+	lines map[string]int
 }
 
 type OpenAIConfig struct {
+	Name    string
 	BaseURL string
 	APIKey  string
 	Model   string
+	Timeout time.Duration
+	Policy  OptimizerPolicy
+}
+
+// OptimizerPolicy controls how optimizer calls are retried and when a
+// failing provider is short-circuited.
+type OptimizerPolicy struct {
+	Timeout          time.Duration
+	Retries          int
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	FallbackToRaw    bool
+}
+
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// OptimizerProvider is one entry of the ordered optimizer provider list
+// (JGO_OPTIMIZER_PROVIDERS or optimizer.providers in jgo.yaml).
+type OptimizerProvider struct {
+	Name      string `json:"name"`
+	BaseURL   string `json:"base_url"`
+	APIKey    string `json:"api_key"`
+	APIKeyEnv string `json:"api_key_env"`
+	Model     string `json:"model"`
+	Timeout   string `json:"timeout"`
 }
 
 type RequestPlan struct {
-	OptimizedPrompt string `json:"optimized_prompt"`
+	OptimizedPrompt string   `json:"optimized_prompt"`
+	RiskLevel       string   `json:"risk_level"`
+	TargetSystems   []string `json:"target_systems,omitempty"`
+	RequiredCLIs    []string `json:"required_clis,omitempty"`
+	Summary         string   `json:"summary,omitempty"`
+
+	Usage openAIUsage `json:"-"`
 }
 
+const (
+	riskReadOnly    = "read-only"
+	riskMutating    = "mutating"
+	riskDestructive = "destructive"
+)
+
 type AutomationResult struct {
-	CodexResponse string
+	CodexResponse     string
+	CodexThread       string
+	Prompt            string
+	OptimizerProvider string
+	RiskLevel         string
+	Summary           string
+	Usage             runUsage
+}
+
+// runUsage is the token usage of one run: codex's turns plus the optimizer's
+// planning call. The embedded totals are what clients see as "usage".
+type runUsage struct {
+	openAIUsage
+	Codex     openAIUsage  `json:"codex"`
+	Optimizer *openAIUsage `json:"optimizer,omitempty"`
+}
+
+// codexEvent is one line of `codex exec --json` output. Current codex
+// releases emit thread/turn/item events; older ones wrapped every event in
+// "msg", which is decoded into Msg.
+type codexEvent struct {
+	Type     string           `json:"type"`
+	ThreadID string           `json:"thread_id"`
+	Item     *codexEventItem  `json:"item"`
+	Usage    *codexTokenUsage `json:"usage"`
+	Message  string           `json:"message"`
+	Error    *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+	Msg *codexLegacyEvent `json:"msg"`
+}
+
+type codexEventItem struct {
+	ID               string `json:"id"`
+	Type             string `json:"type"`
+	Status           string `json:"status"`
+	Text             string `json:"text"`
+	Command          string `json:"command"`
+	AggregatedOutput string `json:"aggregated_output"`
+	ExitCode         *int   `json:"exit_code"`
+	Message          string `json:"message"`
+	Server           string `json:"server"`
+	Tool             string `json:"tool"`
+	Query            string `json:"query"`
+	Changes          []struct {
+		Path string `json:"path"`
+		Kind string `json:"kind"`
+	} `json:"changes"`
+}
+
+type codexTokenUsage struct {
+	InputTokens       int `json:"input_tokens"`
+	CachedInputTokens int `json:"cached_input_tokens"`
+	OutputTokens      int `json:"output_tokens"`
+}
+
+type codexLegacyEvent struct {
+	Type             string                     `json:"type"`
+	Message          string                     `json:"message"`
+	Text             string                     `json:"text"`
+	LastAgentMessage string                     `json:"last_agent_message"`
+	CallID           string                     `json:"call_id"`
+	Command          []string                   `json:"command"`
+	ExitCode         *int                       `json:"exit_code"`
+	AggregatedOutput string                     `json:"aggregated_output"`
+	Changes          map[string]json.RawMessage `json:"changes"`
+	Info             *struct {
+		TotalTokenUsage codexTokenUsage `json:"total_token_usage"`
+	} `json:"info"`
+	codexTokenUsage
 }
 
 type plannerChatRequest struct {
@@ -82,18 +485,350 @@ type chatMessage struct {
 	Content string `json:"content"`
 }
 
+// chatRequestMessage is an incoming chat message whose content may be a
+// string or an array of text, image and file parts.
+type chatRequestMessage struct {
+	Role       string         `json:"role"`
+	Content    chatContent    `json:"content"`
+	Name       string         `json:"name,omitempty"`
+	ToolCalls  []chatToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string         `json:"tool_call_id,omitempty"`
+}
+
+// chatContent holds message content; Text joins the text parts.
+type chatContent struct {
+	Text  string
+	Parts []chatContentPart
+}
+
+type chatContentPart struct {
+	Type     string        `json:"type"`
+	Text     string        `json:"text,omitempty"`
+	ImageURL *chatImageURL `json:"image_url,omitempty"`
+	File     *chatFilePart `json:"file,omitempty"`
+}
+
+type chatImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type chatFilePart struct {
+	Filename string `json:"filename,omitempty"`
+	FileData string `json:"file_data,omitempty"`
+	FileID   string `json:"file_id,omitempty"`
+}
+
+func (c *chatContent) UnmarshalJSON(data []byte) error {
+	if string(bytes.TrimSpace(data)) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(data, &c.Text); err == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, &c.Parts); err != nil {
+		return fmt.Errorf("content must be a string or an array of content parts")
+	}
+	var texts []string
+	for _, part := range c.Parts {
+		if part.Type == "text" && strings.TrimSpace(part.Text) != "" {
+			texts = append(texts, strings.TrimSpace(part.Text))
+		}
+	}
+	c.Text = strings.Join(texts, "\n")
+	return nil
+}
+
+// runAttachment is an image or file sent with the instruction. Data is
+// saved for the codex run; URL-only images are passed to codex as-is.
+type runAttachment struct {
+	Name  string
+	Data  []byte
+	URL   string
+	Image bool
+}
+
+// chatTool is a function tool the caller runs on its side. Codex sees it in
+// the workspace prompt and asks for calls that are returned as tool_calls.
+type chatTool struct {
+	Type     string           `json:"type"`
+	Function chatToolFunction `json:"function"`
+}
+
+type chatToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// chatToolCall is a function call in an assistant message. Index is only
+// set in streamed deltas.
+type chatToolCall struct {
+	Index    *int             `json:"index,omitempty"`
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function chatFunctionCall `json:"function"`
+}
+
+type chatFunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// toolSession is the tool calling state of a chat run: the caller tools
+// offered to codex and, when the request answers earlier tool calls, the
+// codex thread that asked for them.
+type toolSession struct {
+	Tools    []chatTool `json:"tools,omitempty"`
+	Required bool       `json:"required,omitempty"`
+	Single   bool       `json:"single_call,omitempty"`
+	Results  bool       `json:"results,omitempty"`
+	// Thread is the codex thread the results resume; it is set whenever
+	// Results is.
+	Thread string `json:"resume_thread,omitempty"`
+}
+
 type plannerChatResponse struct {
 	Choices []struct {
 		Message struct {
 			Content string `json:"content"`
 		} `json:"message"`
 	} `json:"choices"`
+	Usage openAIUsage `json:"usage"`
+}
+
+// openAIRequestParams are the OpenAI request parameters shared by the
+// chat, completions and responses endpoints.
+type openAIRequestParams struct {
+	MaxTokens           *int            `json:"max_tokens,omitempty"`
+	MaxCompletionTokens *int            `json:"max_completion_tokens,omitempty"`
+	MaxOutputTokens     *int            `json:"max_output_tokens,omitempty"`
+	Stop                json.RawMessage `json:"stop,omitempty"`
+	User                string          `json:"user,omitempty"`
+	Metadata            json.RawMessage `json:"metadata,omitempty"`
+	N                   *int            `json:"n,omitempty"`
+	Tools               json.RawMessage `json:"tools,omitempty"`
+	ToolChoice          json.RawMessage `json:"tool_choice,omitempty"`
+
+	// Sampling parameters are accepted and ignored; codex samples on its own.
+	Temperature      *float64 `json:"temperature,omitempty"`
+	TopP             *float64 `json:"top_p,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
 }
 
 type openAIChatCompletionRequest struct {
-	Model    string        `json:"model"`
-	Messages []chatMessage `json:"messages"`
-	Stream   bool          `json:"stream,omitempty"`
+	openAIRequestParams
+	Model          string               `json:"model"`
+	Messages       []chatRequestMessage `json:"messages"`
+	Stream         bool                 `json:"stream,omitempty"`
+	StreamOptions  *streamOptions       `json:"stream_options,omitempty"`
+	Template       string               `json:"template,omitempty"`
+	TemplateParams map[string]any       `json:"template_params,omitempty"`
+	// Tools and ToolChoice shadow the embedded params: chat completions
+	// passes function tools through to codex.
+	Tools             []chatTool      `json:"tools,omitempty"`
+	ToolChoice        json.RawMessage `json:"tool_choice,omitempty"`
+	ParallelToolCalls *bool           `json:"parallel_tool_calls,omitempty"`
+
+	DryRun             bool `json:"dry_run,omitempty"`
+	RequireApproval    bool `json:"require_approval,omitempty"`
+	ConfirmDestructive bool `json:"confirm_destructive,omitempty"`
+}
+
+// openAIResponsesRequest is the subset of the Responses API jgo serves.
+// Input is a string or a list of input items; the last user message is the
+// instruction.
+type openAIResponsesRequest struct {
+	openAIRequestParams
+	Model  string          `json:"model"`
+	Input  json.RawMessage `json:"input"`
+	Stream bool            `json:"stream,omitempty"`
+
+	DryRun             bool `json:"dry_run,omitempty"`
+	RequireApproval    bool `json:"require_approval,omitempty"`
+	ConfirmDestructive bool `json:"confirm_destructive,omitempty"`
+}
+
+type responsesInputItem struct {
+	Type    string          `json:"type"`
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+type responsesContentPart struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	Annotations []any  `json:"annotations"`
+}
+
+type openAIResponse struct {
+	ID         string                `json:"id"`
+	Object     string                `json:"object"`
+	CreatedAt  int64                 `json:"created_at"`
+	Status     string                `json:"status"`
+	Model      string                `json:"model"`
+	Output     []responsesOutputItem `json:"output"`
+	OutputText string                `json:"output_text,omitempty"`
+	Usage      *responsesUsage       `json:"usage"`
+
+	IncompleteDetails *responsesIncompleteDetails `json:"incomplete_details,omitempty"`
+}
+
+type responsesIncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+type responsesOutputItem struct {
+	Type    string                 `json:"type"`
+	ID      string                 `json:"id"`
+	Status  string                 `json:"status"`
+	Role    string                 `json:"role"`
+	Content []responsesContentPart `json:"content"`
+}
+
+type responsesUsage struct {
+	InputTokens        int `json:"input_tokens"`
+	OutputTokens       int `json:"output_tokens"`
+	TotalTokens        int `json:"total_tokens"`
+	InputTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+	OutputTokensDetails struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"output_tokens_details"`
+}
+
+// openAICompletionRequest is the legacy Completions API request; prompt is a
+// string or an array of strings.
+type openAICompletionRequest struct {
+	openAIRequestParams
+	Model         string          `json:"model"`
+	Prompt        json.RawMessage `json:"prompt"`
+	Stream        bool            `json:"stream,omitempty"`
+	StreamOptions *streamOptions  `json:"stream_options,omitempty"`
+
+	DryRun             bool `json:"dry_run,omitempty"`
+	RequireApproval    bool `json:"require_approval,omitempty"`
+	ConfirmDestructive bool `json:"confirm_destructive,omitempty"`
+}
+
+type openAICompletionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []completionChoice `json:"choices"`
+	Usage   *openAIUsage       `json:"usage,omitempty"`
+}
+
+type completionChoice struct {
+	Text         string  `json:"text"`
+	Index        int     `json:"index"`
+	Logprobs     any     `json:"logprobs"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+// anthropicMessagesRequest is the subset of the Anthropic Messages API jgo
+// serves. System prompts and max_tokens are accepted and ignored.
+type anthropicMessagesRequest struct {
+	Model    string             `json:"model"`
+	Messages []anthropicMessage `json:"messages"`
+	Stream   bool               `json:"stream,omitempty"`
+
+	DryRun             bool `json:"dry_run,omitempty"`
+	RequireApproval    bool `json:"require_approval,omitempty"`
+	ConfirmDestructive bool `json:"confirm_destructive,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+type anthropicContentBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type anthropicMessageResponse struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         string                  `json:"role"`
+	Model        string                  `json:"model"`
+	Content      []anthropicContentBlock `json:"content"`
+	StopReason   *string                 `json:"stop_reason"`
+	StopSequence *string                 `json:"stop_sequence"`
+	Usage        anthropicUsage          `json:"usage"`
+}
+
+// anthropicUsage follows Anthropic accounting: input_tokens excludes
+// cached input, which is reported as cache_read_input_tokens.
+type anthropicUsage struct {
+	InputTokens          int `json:"input_tokens"`
+	OutputTokens         int `json:"output_tokens"`
+	CacheReadInputTokens int `json:"cache_read_input_tokens"`
+}
+
+type anthropicErrorResponse struct {
+	Type  string             `json:"type"`
+	Error anthropicErrorBody `json:"error"`
+}
+
+type anthropicErrorBody struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// jsonRPCRequest is one MCP message. Notifications have no ID.
+type jsonRPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type jsonRPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *jsonRPCError   `json:"error,omitempty"`
+}
+
+type jsonRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type mcpTool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	InputSchema map[string]any `json:"inputSchema"`
+}
+
+type mcpToolResult struct {
+	Content           []mcpContent `json:"content"`
+	StructuredContent any          `json:"structuredContent,omitempty"`
+	IsError           bool         `json:"isError,omitempty"`
+}
+
+type mcpContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type mcpRunArgs struct {
+	Instruction        string `json:"instruction"`
+	Model              string `json:"model,omitempty"`
+	DryRun             bool   `json:"dry_run,omitempty"`
+	ConfirmDestructive bool   `json:"confirm_destructive,omitempty"`
+	Wait               *bool  `json:"wait,omitempty"`
+}
+
+type streamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type openAIChatCompletionResponse struct {
@@ -102,13 +837,19 @@ type openAIChatCompletionResponse struct {
 	Created int64  `json:"created"`
 	Model   string `json:"model"`
 	Choices []struct {
-		Index        int         `json:"index"`
-		Message      chatMessage `json:"message"`
-		FinishReason string      `json:"finish_reason"`
+		Index        int                   `json:"index"`
+		Message      chatCompletionMessage `json:"message"`
+		FinishReason string                `json:"finish_reason"`
 	} `json:"choices"`
 	Usage openAIUsage `json:"usage"`
 }
 
+type chatCompletionMessage struct {
+	Role      string         `json:"role"`
+	Content   string         `json:"content"`
+	ToolCalls []chatToolCall `json:"tool_calls,omitempty"`
+}
+
 type openAIChatCompletionChunkResponse struct {
 	ID      string `json:"id"`
 	Object  string `json:"object"`
@@ -119,17 +860,24 @@ type openAIChatCompletionChunkResponse struct {
 		Delta        chatMessageDelta `json:"delta"`
 		FinishReason *string          `json:"finish_reason"`
 	} `json:"choices"`
+	Usage *openAIUsage `json:"usage,omitempty"`
 }
 
 type chatMessageDelta struct {
-	Role    string `json:"role,omitempty"`
-	Content string `json:"content,omitempty"`
+	Role      string         `json:"role,omitempty"`
+	Content   string         `json:"content,omitempty"`
+	ToolCalls []chatToolCall `json:"tool_calls,omitempty"`
 }
 
 type openAIUsage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
+	PromptTokens        int                  `json:"prompt_tokens"`
+	CompletionTokens    int                  `json:"completion_tokens"`
+	TotalTokens         int                  `json:"total_tokens"`
+	PromptTokensDetails *promptTokensDetails `json:"prompt_tokens_details,omitempty"`
+}
+
+type promptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
 }
 
 type openAIErrorResponse struct {
@@ -139,6 +887,8 @@ type openAIErrorResponse struct {
 type openAIErrorBody struct {
 	Message string `json:"message"`
 	Type    string `json:"type"`
+	Param   string `json:"param,omitempty"`
+	Code    string `json:"code,omitempty"`
 }
 
 type openAIModelsResponse struct {
@@ -147,23 +897,359 @@ type openAIModelsResponse struct {
 }
 
 type openAIModel struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	OwnedBy string `json:"owned_by"`
+	ID          string `json:"id"`
+	Object      string `json:"object"`
+	Created     int64  `json:"created"`
+	OwnedBy     string `json:"owned_by"`
+	Description string `json:"description,omitempty"`
 }
 
 type runIDContextKey struct{}
 
+type confirmDestructiveContextKey struct{}
+
+type attachmentsContextKey struct{}
+
+type toolSessionContextKey struct{}
+
+type approverContextKey struct{}
+
+type callerContextKey struct{}
+
+// callerIdentity is who made an API request: the matching API key name, or
+// "anonymous" when the server has no API keys configured.
+type callerIdentity struct {
+	Name   string
+	Scopes []string
+	Remote string
+	// User and Metadata are the OpenAI user and metadata request fields.
+	User     string
+	Metadata map[string]string
+	// Metered callers came in over HTTP and count against the daily quota.
+	Metered bool
+}
+
+// policyHold is returned when policy rules match a freshly prepared plan
+// that no approver has signed off on yet.
+type policyHold struct {
+	plan runPlan
+}
+
+func (h *policyHold) Error() string {
+	return fmt.Sprintf("%s: %s", errAwaitingApproval, strings.Join(h.plan.Policy, "; "))
+}
+
+func (h *policyHold) Unwrap() error {
+	return errAwaitingApproval
+}
+
 type runHistoryRecord struct {
-	RunID       string `json:"run_id"`
-	Timestamp   string `json:"timestamp"`
-	Model       string `json:"model"`
-	DurationMs  int64  `json:"duration_ms"`
-	Instruction string `json:"instruction"`
-	Status      string `json:"status"`
-	Response    string `json:"response,omitempty"`
-	Error       string `json:"error,omitempty"`
+	RunID       string            `json:"run_id"`
+	Timestamp   string            `json:"timestamp"`
+	Model       string            `json:"model"`
+	DurationMs  int64             `json:"duration_ms"`
+	Instruction string            `json:"instruction"`
+	Status      string            `json:"status"`
+	Response    string            `json:"response,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	Optimizer   string            `json:"optimizer_provider,omitempty"`
+	RiskLevel   string            `json:"risk_level,omitempty"`
+	Summary     string            `json:"summary,omitempty"`
+	Policy      []string          `json:"policy,omitempty"`
+	Approver    string            `json:"approver,omitempty"`
+	ExpiresAt   string            `json:"expires_at,omitempty"`
+	Usage       *runUsage         `json:"usage,omitempty"`
+	Caller      string            `json:"caller,omitempty"`
+	User        string            `json:"user,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	CodexThread string            `json:"codex_thread,omitempty"`
+}
+
+type webhookPayload struct {
+	Event string `json:"event"`
+	runHistoryRecord
+}
+
+type githubWebhookEvent struct {
+	Action     string           `json:"action"`
+	Comment    *githubComment   `json:"comment"`
+	Issue      *githubIssue     `json:"issue"`
+	Repository githubRepository `json:"repository"`
+	Sender     githubUser       `json:"sender"`
+}
+
+type githubComment struct {
+	Body              string     `json:"body"`
+	HTMLURL           string     `json:"html_url"`
+	AuthorAssociation string     `json:"author_association"`
+	User              githubUser `json:"user"`
+}
+
+type githubIssue struct {
+	Number            int             `json:"number"`
+	Title             string          `json:"title"`
+	Body              string          `json:"body"`
+	HTMLURL           string          `json:"html_url"`
+	AuthorAssociation string          `json:"author_association"`
+	User              githubUser      `json:"user"`
+	PullRequest       json.RawMessage `json:"pull_request"`
+}
+
+type githubRepository struct {
+	FullName string `json:"full_name"`
+}
+
+type githubUser struct {
+	Login string `json:"login"`
+	Type  string `json:"type"`
+}
+
+type githubRunRequest struct {
+	Repo        string
+	Kind        string
+	Number      int
+	URL         string
+	Author      string
+	Association string
+	Text        string
+	Command     string
+}
+
+type Schedule struct {
+	Name            string `json:"name"`
+	Cron            string `json:"cron"`
+	Instruction     string `json:"instruction"`
+	Timezone        string `json:"timezone,omitempty"`
+	Paused          bool   `json:"paused,omitempty"`
+	OptimizePrompt  *bool  `json:"optimize_prompt,omitempty"`
+	ReasoningEffort string `json:"reasoning_effort,omitempty"`
+	Timeout         string `json:"timeout,omitempty"`
+	MissedRunPolicy string `json:"missed_run_policy,omitempty"`
+	AllowOverlap    bool   `json:"allow_overlap,omitempty"`
+	LastRunAt       string `json:"last_run_at,omitempty"`
+	LastRunID       string `json:"last_run_id,omitempty"`
+	LastStatus      string `json:"last_status,omitempty"`
+	SkippedRuns     int    `json:"skipped_runs,omitempty"`
+}
+
+type scheduleView struct {
+	Schedule
+	NextRunAt string `json:"next_run_at,omitempty"`
+	Running   bool   `json:"running"`
+}
+
+type scheduleEntry struct {
+	def     Schedule
+	spec    *cronSpec
+	loc     *time.Location
+	next    time.Time
+	running bool
+}
+
+// liveConfig holds the Config used for new runs. Runs take a snapshot when
+// they start, so a reload never changes the settings of an in-flight run.
+type liveConfig struct {
+	current atomic.Pointer[Config]
+	reload  func() (Config, error)
+	mu      sync.Mutex
+	loaded  Config
+}
+
+// runTracker counts server runs in flight so shutdown can drain them and
+// cancel whatever is left once the drain timeout expires.
+type runTracker struct {
+	mu       sync.Mutex
+	draining bool
+	cancels  map[string]context.CancelCauseFunc
+	idle     chan struct{}
+}
+
+type scheduler struct {
+	mu      sync.Mutex
+	cfg     *liveConfig
+	path    string
+	entries map[string]*scheduleEntry
+}
+
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+type PromptTemplate struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Template    string          `json:"template"`
+	Params      []TemplateParam `json:"params,omitempty"`
+}
+
+type TemplateParam struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type,omitempty"`
+	Required    bool     `json:"required,omitempty"`
+	Default     string   `json:"default,omitempty"`
+	Enum        []string `json:"enum,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+type dotenvPair struct {
+	key   string
+	value string
+	line  int
+}
+
+type templateStore struct {
+	mu        sync.Mutex
+	path      string
+	templates map[string]PromptTemplate
+}
+
+type templateParamError struct {
+	Param   string
+	Message string
+}
+
+type templateRunRequest struct {
+	Params             map[string]any `json:"params"`
+	Stream             bool           `json:"stream,omitempty"`
+	DryRun             bool           `json:"dry_run,omitempty"`
+	RequireApproval    bool           `json:"require_approval,omitempty"`
+	ConfirmDestructive bool           `json:"confirm_destructive,omitempty"`
+}
+
+// runPlan is everything decided before codex starts: what a dry run returns
+// and what a pending run waits on for approval.
+type runPlan struct {
+	Instruction     string   `json:"instruction"`
+	OptimizedPrompt string   `json:"optimized_prompt"`
+	WorkspacePrompt string   `json:"workspace_prompt"`
+	AvailableCLIs   []string `json:"available_clis"`
+	// Attachments are listed in the workspace prompt; Images are passed to
+	// codex with --image. Both are written only when codex starts.
+	Attachments       []string `json:"attachments,omitempty"`
+	Images            []string `json:"images,omitempty"`
+	OptimizerProvider string   `json:"optimizer_provider,omitempty"`
+	// ToolSession is set for chat runs with caller tools or tool results.
+	ToolSession   *toolSession `json:"tool_session,omitempty"`
+	RiskLevel     string       `json:"risk_level,omitempty"`
+	TargetSystems []string     `json:"target_systems,omitempty"`
+	RequiredCLIs  []string     `json:"required_clis,omitempty"`
+	Summary       string       `json:"summary,omitempty"`
+	Policy        []string     `json:"policy,omitempty"`
+
+	OptimizerUsage *openAIUsage `json:"optimizer_usage,omitempty"`
+
+	attachments []runAttachment
+}
+
+type runOptions struct {
+	Stream             bool
+	IncludeUsage       bool
+	DryRun             bool
+	RequireApproval    bool
+	ConfirmDestructive bool
+	// Respond writes a successful run; nil means Chat Completions.
+	Respond runResponder
+	// Model is echoed in responses; empty means servedModelID.
+	Model string
+	// MaxTokens and Stop shape the returned output, not the run itself.
+	MaxTokens int
+	Stop      []string
+	// Fail writes a run error; nil means the OpenAI error shape.
+	Fail func(w http.ResponseWriter, status int, message string)
+}
+
+func (opts runOptions) model() string {
+	if opts.Model == "" {
+		return servedModelID
+	}
+	return opts.Model
+}
+
+func (opts runOptions) writeError(w http.ResponseWriter, status int, message string) {
+	if opts.Fail != nil {
+		opts.Fail(w, status, message)
+		return
+	}
+	writeOpenAIError(w, status, message)
+}
+
+// pendingRun is a prepared run waiting for a decision: "pending" when the
+// caller asked for review, "awaiting_approval" when policy held it.
+type pendingRun struct {
+	cfg       Config
+	model     string
+	plan      runPlan
+	caller    callerIdentity
+	status    string
+	createdAt time.Time
+	expiresAt time.Time
+}
+
+type runPlanResponse struct {
+	Object    string  `json:"object"`
+	RunID     string  `json:"run_id"`
+	Status    string  `json:"status"`
+	ExpiresAt string  `json:"expires_at,omitempty"`
+	Plan      runPlan `json:"plan"`
+}
+
+type approveRunRequest struct {
+	OptimizedPrompt    string `json:"optimized_prompt,omitempty"`
+	ConfirmDestructive bool   `json:"confirm_destructive,omitempty"`
+	Stream             bool   `json:"stream,omitempty"`
+}
+
+type rejectRunRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+type stringListFlag []string
+
+type runOutputChunk struct {
+	Stream string `json:"stream"`
+	Text   string `json:"text"`
+}
+
+type runStream struct {
+	mu        sync.Mutex
+	chunks    []runOutputChunk
+	steps     []runStep
+	size      int
+	truncated bool
+	done      bool
+	status    string
+	notify    chan struct{}
+}
+
+// runStep is one structured step of a codex run, built from its JSON
+// events. Types: command, file_change, reasoning, message, tool_call,
+// web_search, error.
+type runStep struct {
+	Index      int           `json:"index"`
+	ID         string        `json:"id,omitempty"`
+	Type       string        `json:"type"`
+	Status     string        `json:"status"`
+	Text       string        `json:"text,omitempty"`
+	Command    string        `json:"command,omitempty"`
+	Output     string        `json:"output,omitempty"`
+	ExitCode   *int          `json:"exit_code,omitempty"`
+	Files      []runStepFile `json:"files,omitempty"`
+	Final      bool          `json:"final,omitempty"`
+	StartedAt  string        `json:"started_at"`
+	DurationMs int64         `json:"duration_ms,omitempty"`
+
+	started time.Time
+}
+
+type runStepFile struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+}
+
+type runStreamWriter struct {
+	stream *runStream
+	name   string
 }
 
 func main() {
@@ -192,6 +1278,26 @@ func main() {
 			log.Printf("error: %v", err)
 			os.Exit(1)
 		}
+	case "config":
+		if err := configCommand(cfg, os.Args[2:]); err != nil {
+			log.Printf("error: %v", err)
+			os.Exit(1)
+		}
+	case "audit":
+		if err := auditCommand(cfg, os.Args[2:]); err != nil {
+			log.Printf("error: %v", err)
+			os.Exit(1)
+		}
+	case "runs":
+		if err := runsCommand(cfg, os.Args[2:]); err != nil {
+			log.Printf("error: %v", err)
+			os.Exit(1)
+		}
+	case "mcp":
+		if err := mcpCommand(cfg, os.Args[2:]); err != nil {
+			log.Printf("error: %v", err)
+			os.Exit(1)
+		}
 	default:
 		printStartupError(fmt.Sprintf("unknown subcommand: %s", os.Args[1]), os.Args[1:])
 		printUsage()
@@ -202,6 +1308,7 @@ func main() {
 func serveCommand(cfg Config, args []string) error {
 	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
 	fs.SetOutput(os.Stderr)
+	configPath := fs.String("config", cfg.ConfigPath, "path to jgo.yaml config file")
 	listen := fs.String("listen", cfg.ListenAddr, "listen address")
 	transport := fs.String("transport", cfg.ExecTransport, "execution transport: local or ssh")
 	optimizePrompt := fs.Bool("optimize-prompt", cfg.OptimizePrompt, "enable prompt optimization before codex execution")
@@ -210,23 +1317,48 @@ func serveCommand(cfg Config, args []string) error {
 		return fmt.Errorf("parse serve args: %w", err)
 	}
 
-	cfg.ListenAddr = strings.TrimSpace(*listen)
-	if cfg.ListenAddr == "" {
-		cfg.ListenAddr = defaultListenAddr
-	}
-	cfg.ExecTransport = strings.TrimSpace(*transport)
-	cfg.OptimizePrompt = *optimizePrompt
-	if err := validateExecutionConfig(&cfg); err != nil {
-		return err
+	base := cfg
+	build := func() (Config, error) {
+		cfg, err := applyCommonFlags(base, fs, *configPath, *transport, *optimizePrompt)
+		if err != nil {
+			return Config{}, err
+		}
+		if flagWasSet(fs, "listen") {
+			cfg.ListenAddr = strings.TrimSpace(*listen)
+		}
+		if cfg.ListenAddr == "" {
+			cfg.ListenAddr = defaultListenAddr
+		}
+		if err := validateExecutionConfig(&cfg); err != nil {
+			return Config{}, err
+		}
+		return cfg, nil
+	}
+	cfg, err := build()
+	if err != nil {
+		return err
 	}
 
-	return runServer(cfg)
+	live := &liveConfig{reload: func() (Config, error) {
+		// Re-read the file and environment, then re-apply the command-line flags.
+		base.ConfigPath = ""
+		return build()
+	}}
+	live.Store(cfg)
+	live.loaded = cfg
+	return runServer(live)
 }
 
 func printUsage() {
 	fmt.Fprintln(os.Stderr, "usage:")
-	fmt.Fprintln(os.Stderr, "  jgo serve [--transport local|ssh] [--optimize-prompt]")
-	fmt.Fprintln(os.Stderr, "  jgo exec [--env-file .env] [--transport local|ssh] [--optimize-prompt] \"<instruction>\"")
+	fmt.Fprintln(os.Stderr, "  jgo serve [--config jgo.yaml] [--transport local|ssh] [--optimize-prompt]")
+	fmt.Fprintln(os.Stderr, "  jgo exec [--config jgo.yaml] [--env-file .env] [--transport local|ssh] [--optimize-prompt] [--dry-run] [--confirm-destructive] \"<instruction>\"")
+	fmt.Fprintln(os.Stderr, "  jgo exec [--env-file .env] --template <name> [--set key=value ...]")
+	fmt.Fprintln(os.Stderr, "  jgo config print [--config jgo.yaml]")
+	fmt.Fprintln(os.Stderr, "  jgo audit verify [--config jgo.yaml] [--file audit.jsonl]")
+	fmt.Fprintln(os.Stderr, "  jgo runs list [--status awaiting_approval] [--server URL] [--api-key KEY]")
+	fmt.Fprintln(os.Stderr, "  jgo runs approve|reject <run_id> [--prompt \"edited prompt\"] [--confirm-destructive] [--reason text] [--server URL] [--api-key KEY]")
+	fmt.Fprintln(os.Stderr, "  jgo mcp [--config jgo.yaml] [--transport local|ssh] [--optimize-prompt]")
 	fmt.Fprintln(os.Stderr, "default: jgo serve")
 }
 
@@ -234,62 +1366,108 @@ func execCommand(cfg Config, args []string) error {
 	fs := flag.NewFlagSet("exec", flag.ContinueOnError)
 	fs.SetOutput(os.Stderr)
 
-	envFile := fs.String("env-file", ".env", "path to env file")
+	var envFiles stringListFlag
+	fs.Var(&envFiles, "env-file", "path to env file, repeatable and applied in order (default .env)")
+	envOverride := fs.Bool("env-override", false, "let env file values replace variables already set in the environment")
+	configPath := fs.String("config", "", "path to jgo.yaml config file (default: $JGO_CONFIG)")
 	transport := fs.String("transport", cfg.ExecTransport, "execution transport: local or ssh")
 	optimizePrompt := fs.Bool("optimize-prompt", cfg.OptimizePrompt, "enable prompt optimization before codex execution")
+	templateName := fs.String("template", "", "render a saved prompt template as the instruction")
+	dryRun := fs.Bool("dry-run", false, "print the optimized prompt and codex prompt without running codex")
+	confirmDestructive := fs.Bool("confirm-destructive", false, "allow plans classified as destructive to run")
+	var templateSets stringListFlag
+	fs.Var(&templateSets, "set", "template parameter as key=value (repeatable)")
 
 	if err := fs.Parse(args); err != nil {
 		return fmt.Errorf("parse exec args: %w", err)
 	}
-	if fs.NArg() == 0 {
+	useTemplate := strings.TrimSpace(*templateName) != ""
+	if useTemplate && fs.NArg() > 0 {
+		return fmt.Errorf("instruction argument cannot be combined with --template")
+	}
+	if !useTemplate && len(templateSets) > 0 {
+		return fmt.Errorf("--set requires --template")
+	}
+	if !useTemplate && fs.NArg() == 0 {
 		return fmt.Errorf("missing instruction argument")
 	}
-	transportFlagSet := false
-	optimizePromptFlagSet := false
-	fs.Visit(func(f *flag.Flag) {
-		switch f.Name {
-		case "transport":
-			transportFlagSet = true
-		case "optimize-prompt":
-			optimizePromptFlagSet = true
-		}
-	})
-
 	instruction := strings.TrimSpace(strings.Join(fs.Args(), " "))
-	if instruction == "" {
+	if !useTemplate && instruction == "" {
 		return fmt.Errorf("instruction cannot be empty")
 	}
 
-	if path := strings.TrimSpace(*envFile); path != "" {
-		if err := loadEnvFile(path); err != nil {
-			return fmt.Errorf("load env file (%s): %w", path, err)
+	if !flagWasSet(fs, "env-file") {
+		envFiles = stringListFlag{".env"}
+	}
+	var paths []string
+	for _, path := range envFiles {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
 		}
 	}
-	reloadedCfg, err := loadConfigFromEnv()
+	if err := loadEnvFiles(paths, *envOverride); err != nil {
+		return fmt.Errorf("load env file: %w", err)
+	}
+	path := strings.TrimSpace(*configPath)
+	if path == "" {
+		path = strings.TrimSpace(os.Getenv("JGO_CONFIG"))
+	}
+	reloadedCfg, err := loadConfig(path)
 	if err != nil {
 		return err
 	}
-	cfg = reloadedCfg
-	if transportFlagSet {
-		cfg.ExecTransport = strings.TrimSpace(*transport)
-	}
-	if optimizePromptFlagSet {
-		cfg.OptimizePrompt = *optimizePrompt
+	if cfg, err = applyCommonFlags(reloadedCfg, fs, path, *transport, *optimizePrompt); err != nil {
+		return err
 	}
 	if err := validateExecutionConfig(&cfg); err != nil {
 		return err
 	}
+	if useTemplate {
+		rendered, err := renderTemplateFromFlags(cfg, strings.TrimSpace(*templateName), templateSets)
+		if err != nil {
+			return err
+		}
+		instruction = rendered
+	}
 
 	runID := nextRunID()
 	ctx := context.WithValue(context.Background(), runIDContextKey{}, runID)
 	logRunf(
 		ctx,
 		"cli exec start: mode=full_automation env_file=%q optimize_prompt=%t",
-		strings.TrimSpace(*envFile),
+		strings.Join(paths, ","),
 		cfg.OptimizePrompt,
 	)
 
+	if *dryRun {
+		plan, err := prepareRun(ctx, cfg, instruction)
+		if err != nil {
+			return err
+		}
+		return printRunPlan(os.Stdout, plan)
+	}
+
+	if *confirmDestructive {
+		ctx = withDestructiveConfirmed(ctx)
+	}
+	ctx = context.WithValue(ctx, callerContextKey{}, callerIdentity{Name: "cli:" + localUserName()})
+	appendAudit(ctx, cfg, newAuditEntry(ctx, cfg, "run.started", instruction))
 	result, err := runAutomation(ctx, cfg, instruction)
+	audit := newAuditEntry(ctx, cfg, "run.finished", instruction)
+	audit.Prompt, audit.Outcome = result.Prompt, "completed"
+	var hold *policyHold
+	switch {
+	case errors.As(err, &hold):
+		audit.Event, audit.Prompt, audit.Outcome, audit.Policy = "run.held", hold.plan.WorkspacePrompt, "awaiting_approval", hold.plan.Policy
+	case err != nil:
+		audit.Outcome, audit.Detail = "failed", err.Error()
+	}
+	appendAudit(ctx, cfg, audit)
+	if hold != nil {
+		// Held runs are approved only through a server, by a key with the
+		// approve scope; a local CLI user cannot sign off on their own run.
+		return fmt.Errorf("%w; submit it to a jgo server, where an approver can run jgo runs approve", err)
+	}
 	if err != nil {
 		return err
 	}
@@ -303,377 +1481,5846 @@ func execCommand(cfg Config, args []string) error {
 	return nil
 }
 
-func printStartupError(reason string, args []string) {
-	argv := append([]string{os.Args[0]}, args...)
-	fmt.Fprintln(os.Stderr, "error:", reason)
-	fmt.Fprintf(os.Stderr, "detail: argv=%q\n", argv)
-}
-
-func loadConfigFromEnv() (Config, error) {
-	optimizePrompt, err := parseBoolEnvDefault("JGO_OPTIMIZE_PROMPT", false)
-	if err != nil {
-		return Config{}, err
+func localUserName() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
 	}
-
-	cfg := Config{
-		CodexBin:        strings.TrimSpace(os.Getenv("CODEX_BIN")),
-		ListenAddr:      strings.TrimSpace(os.Getenv("JGO_LISTEN_ADDR")),
-		ExecTransport:   strings.TrimSpace(os.Getenv("JGO_EXEC_TRANSPORT")),
-		SSHUser:         strings.TrimSpace(os.Getenv("JGO_SSH_USER")),
-		SSHHost:         strings.TrimSpace(os.Getenv("JGO_SSH_HOST")),
-		SSHPort:         strings.TrimSpace(os.Getenv("JGO_SSH_PORT")),
-		ReasoningEffort: strings.TrimSpace(os.Getenv("CODEX_REASONING_EFFORT")),
-		OptimizePrompt:  optimizePrompt,
+	if name := strings.TrimSpace(os.Getenv("USER")); name != "" {
+		return name
 	}
+	return "unknown"
+}
 
-	if cfg.CodexBin == "" {
-		cfg.CodexBin = "codex"
+// mcpCommand serves the MCP tools over stdio for IDEs and desktop agents
+// that launch jgo as a subprocess. Logs go to stderr.
+func mcpCommand(cfg Config, args []string) error {
+	fs := flag.NewFlagSet("mcp", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	configPath := fs.String("config", cfg.ConfigPath, "path to jgo.yaml config file")
+	transport := fs.String("transport", cfg.ExecTransport, "execution transport: local or ssh")
+	optimizePrompt := fs.Bool("optimize-prompt", cfg.OptimizePrompt, "enable prompt optimization before codex execution")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("parse mcp args: %w", err)
 	}
-	if cfg.ListenAddr == "" {
-		cfg.ListenAddr = defaultListenAddr
+	cfg, err := applyCommonFlags(cfg, fs, *configPath, *transport, *optimizePrompt)
+	if err != nil {
+		return err
 	}
-	if cfg.ExecTransport == "" {
-		cfg.ExecTransport = defaultTransport
+	if err := validateExecutionConfig(&cfg); err != nil {
+		return err
 	}
-	if cfg.SSHUser == "" {
-		cfg.SSHUser = "jgo"
+	// A jgo serve may own the same history file; only append to it.
+	if err := loadRunHistory(cfg.HistoryFile, true); err != nil {
+		return err
 	}
-	if cfg.SSHHost == "" {
-		cfg.SSHHost = "localhost"
+	live := &liveConfig{}
+	live.Store(cfg)
+	live.loaded = cfg
+	ctx := context.WithValue(context.Background(), callerContextKey{}, callerIdentity{Name: "mcp:" + localUserName()})
+	log.Printf("jgo mcp server on stdio: transport=%s", formatExecutionTarget(cfg))
+	return (&mcpServer{live: live, stdio: true}).serveStdio(ctx, os.Stdin, os.Stdout)
+}
+
+// runsCommand lists, approves and rejects runs on a running jgo server.
+func runsCommand(cfg Config, args []string) error {
+	if len(args) == 0 {
+		printUsage()
+		return fmt.Errorf("usage: jgo runs list|approve|reject")
 	}
-	if cfg.SSHPort == "" {
-		cfg.SSHPort = "22"
+	action := args[0]
+	fs := flag.NewFlagSet("runs "+action, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	server := fs.String("server", defaultServerURL(cfg), "jgo server base URL (default: $JGO_SERVER_URL)")
+	apiKey := fs.String("api-key", os.Getenv("JGO_API_KEY"), "API key with the approve scope (default: $JGO_API_KEY)")
+	status := fs.String("status", "", "list only runs with this status")
+	limit := fs.Int("limit", 20, "number of runs to list")
+	prompt := fs.String("prompt", "", "replace the optimized prompt before approving")
+	confirmDestructive := fs.Bool("confirm-destructive", false, "also confirm a destructive or unclassified plan when approving")
+	reason := fs.String("reason", "", "reason recorded when rejecting")
+	rest := args[1:]
+	var runID string
+	if len(rest) > 0 && !strings.HasPrefix(rest[0], "-") {
+		runID, rest = rest[0], rest[1:]
 	}
-	if cfg.ReasoningEffort == "" {
-		cfg.ReasoningEffort = defaultReasoning
+	if err := fs.Parse(rest); err != nil {
+		return fmt.Errorf("parse runs args: %w", err)
 	}
-
-	return cfg, nil
-}
-
-func validateExecutionConfig(cfg *Config) error {
-	transport, err := normalizeTransport(cfg.ExecTransport)
-	if err != nil {
-		return err
+	if runID == "" {
+		runID = fs.Arg(0)
 	}
-	cfg.ExecTransport = transport
-	if transport != transportSSH {
+	base := strings.TrimRight(*server, "/")
+
+	switch action {
+	case "list":
+		query := url.Values{"limit": {strconv.Itoa(*limit)}}
+		if *status != "" {
+			query.Set("status", *status)
+		}
+		var body struct {
+			Items []runHistoryRecord `json:"items"`
+		}
+		if err := callServer(http.MethodGet, base+"/api/runs?"+query.Encode(), *apiKey, nil, &body); err != nil {
+			return err
+		}
+		for _, item := range body.Items {
+			line := fmt.Sprintf("%s  %-17s  %s  %s", item.RunID, item.Status, item.Timestamp, truncateForLog(item.Instruction, 80))
+			if len(item.Policy) > 0 {
+				line += "\n    policy: " + strings.Join(item.Policy, "; ")
+			}
+			if item.Status == "awaiting_approval" || item.Status == "pending" {
+				line += "\n    expires: " + item.ExpiresAt
+			}
+			fmt.Println(line)
+		}
+		return nil
+	case "approve", "reject":
+		if runID == "" {
+			return fmt.Errorf("usage: jgo runs %s <run_id>", action)
+		}
+		endpoint := fmt.Sprintf("%s/api/runs/%s/%s", base, url.PathEscape(runID), action)
+		if action == "reject" {
+			var entry runHistoryRecord
+			if err := callServer(http.MethodPost, endpoint, *apiKey, rejectRunRequest{Reason: *reason}, &entry); err != nil {
+				return err
+			}
+			fmt.Printf("%s rejected by %s\n", entry.RunID, entry.Approver)
+			return nil
+		}
+		var resp openAIChatCompletionResponse
+		if err := callServer(http.MethodPost, endpoint, *apiKey, approveRunRequest{OptimizedPrompt: *prompt, ConfirmDestructive: *confirmDestructive}, &resp); err != nil {
+			return err
+		}
+		if len(resp.Choices) > 0 {
+			_, err := io.WriteString(os.Stdout, resp.Choices[0].Message.Content)
+			return err
+		}
 		return nil
+	default:
+		printUsage()
+		return fmt.Errorf("unknown runs action %q (expected: list, approve or reject)", action)
 	}
-	return validateSSHConfig(cfg)
 }
 
-func normalizeTransport(raw string) (string, error) {
-	transport := strings.ToLower(strings.TrimSpace(raw))
-	switch transport {
-	case "", transportLocal:
-		return transportLocal, nil
-	case transportSSH:
-		return transportSSH, nil
-	default:
-		return "", fmt.Errorf("invalid JGO_EXEC_TRANSPORT %q (expected: local or ssh)", raw)
+func defaultServerURL(cfg Config) string {
+	if v := strings.TrimSpace(os.Getenv("JGO_SERVER_URL")); v != "" {
+		return v
+	}
+	if strings.HasPrefix(cfg.ListenAddr, ":") {
+		return "http://localhost" + cfg.ListenAddr
 	}
+	return "http://" + cfg.ListenAddr
 }
 
-func validateSSHConfig(cfg *Config) error {
-	var missing []string
-	if strings.TrimSpace(cfg.SSHUser) == "" {
-		missing = append(missing, "JGO_SSH_USER")
+func callServer(method, endpoint, apiKey string, reqBody, respBody any) error {
+	var body io.Reader
+	if reqBody != nil {
+		payload, err := json.Marshal(reqBody)
+		if err != nil {
+			return fmt.Errorf("encode request: %w", err)
+		}
+		body = bytes.NewReader(payload)
 	}
-	if strings.TrimSpace(cfg.SSHHost) == "" {
-		missing = append(missing, "JGO_SSH_HOST")
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
 	}
-	if strings.TrimSpace(cfg.SSHPort) == "" {
-		missing = append(missing, "JGO_SSH_PORT")
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
 	}
-	if len(missing) > 0 {
-		return fmt.Errorf("missing required SSH settings: %s", strings.Join(missing, ", "))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("call jgo server: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("read jgo server response: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("jgo server returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if err := json.Unmarshal(data, respBody); err != nil {
+		return fmt.Errorf("decode jgo server response: %w", err)
 	}
 	return nil
 }
 
-func parseBoolEnvDefault(key string, defaultVal bool) (bool, error) {
-	raw := strings.TrimSpace(os.Getenv(key))
-	if raw == "" {
-		return defaultVal, nil
+func printRunPlan(out io.Writer, plan runPlan) error {
+	provider := plan.OptimizerProvider
+	if provider == "" {
+		provider = "none"
 	}
-	v, err := strconv.ParseBool(raw)
+	_, err := fmt.Fprintf(
+		out,
+		"=== plan ===\nrisk_level: %s\ntarget_systems: %s\nrequired_clis: %s\nsummary: %s\npolicy: %s\n\n=== optimized prompt (optimizer=%s) ===\n%s\n\n=== codex prompt ===\n%s\n",
+		valueOrUnknown(plan.RiskLevel),
+		strings.Join(plan.TargetSystems, ", "),
+		strings.Join(plan.RequiredCLIs, ", "),
+		plan.Summary,
+		valueOrDefault(strings.Join(plan.Policy, "; "), "no approval required"),
+		provider,
+		plan.OptimizedPrompt,
+		strings.TrimRight(plan.WorkspacePrompt, " \t\n"),
+	)
 	if err != nil {
-		return false, fmt.Errorf("invalid boolean for %s: %q", key, raw)
+		return fmt.Errorf("print plan: %w", err)
 	}
-	return v, nil
+	return nil
 }
 
-func runServer(cfg Config) error {
-	mux := http.NewServeMux()
-
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			writeMethodNotAllowed(w, http.MethodGet)
-			return
-		}
-		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
-	})
-
-	chatHandler := handleChatCompletions(cfg)
-	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			writeMethodNotAllowed(w, http.MethodPost)
-			return
-		}
-		chatHandler(w, r)
-	})
-
-	modelsHandler := handleModels()
-	mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			writeMethodNotAllowed(w, http.MethodGet)
-			return
+// applyCommonFlags layers explicitly passed flags over cfg so that the
+// precedence stays flags > env > config file > defaults.
+func applyCommonFlags(cfg Config, fs *flag.FlagSet, configPath, transport string, optimizePrompt bool) (Config, error) {
+	if path := strings.TrimSpace(configPath); path != cfg.ConfigPath {
+		reloaded, err := loadConfig(path)
+		if err != nil {
+			return Config{}, err
 		}
-		modelsHandler(w, r)
-	})
+		cfg = reloaded
+	}
+	if flagWasSet(fs, "transport") {
+		cfg.ExecTransport = strings.TrimSpace(transport)
+	}
+	if flagWasSet(fs, "optimize-prompt") {
+		cfg.OptimizePrompt = optimizePrompt
+	}
+	return cfg, nil
+}
 
-	runHistoryHandler := handleRunHistory()
-	mux.HandleFunc("/api/runs", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			writeMethodNotAllowed(w, http.MethodGet)
-			return
+func flagWasSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
-		runHistoryHandler(w, r)
 	})
+	return set
+}
 
-	monitorDir := resolveMonitorDir()
-	if monitorDir == "" {
-		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			if r.URL.Path != "/" {
-				writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
-				return
-			}
-			message := "jgo API server is running. static monitor assets were not found."
-			if _, err := w.Write([]byte(message)); err != nil {
-				log.Printf("root response failed: %v", err)
-			}
-		})
-	} else {
-		mux.Handle("/", http.FileServer(http.Dir(monitorDir)))
+func configCommand(cfg Config, args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		printUsage()
+		return fmt.Errorf("usage: jgo config print [--config jgo.yaml]")
 	}
-
-	server := &http.Server{
-		Addr:              cfg.ListenAddr,
-		Handler:           mux,
-		ReadHeaderTimeout: 5 * time.Second,
+	fs := flag.NewFlagSet("config print", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	configPath := fs.String("config", cfg.ConfigPath, "path to jgo.yaml config file")
+	if err := fs.Parse(args[1:]); err != nil {
+		return fmt.Errorf("parse config args: %w", err)
+	}
+	cfg, err := applyCommonFlags(cfg, fs, *configPath, cfg.ExecTransport, cfg.OptimizePrompt)
+	if err != nil {
+		return err
 	}
 
-	log.Printf("jgo server listening on %s", cfg.ListenAddr)
-	return server.ListenAndServe()
-}
+	env := environToMap(os.Environ())
+	applyProviderFallbacks(env)
+	cfg.Optimizer = resolveOpenAIConfig(env, cfg.Optimizer)
 
-func handleRunHistory() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		limit := parseRunHistoryLimit(r.URL.Query().Get("limit"))
-		items := snapshotRunHistory(limit)
-		writeJSON(w, http.StatusOK, map[string]any{
-			"total": len(items),
-			"items": items,
-		})
+	var b strings.Builder
+	if cfg.ConfigPath != "" {
+		fmt.Fprintf(&b, "# effective config (file: %s; precedence: flags > env > file > defaults)\n", cfg.ConfigPath)
+	} else {
+		b.WriteString("# effective config (no config file; precedence: flags > env > defaults)\n")
 	}
+	writeConfigYAML(&b, reflect.ValueOf(redactConfig(configToFile(cfg))), 0)
+	_, err = io.WriteString(os.Stdout, b.String())
+	return err
 }
 
-func parseRunHistoryLimit(raw string) int {
-	if raw == "" {
-		return 20
+func configToFile(cfg Config) fileConfig {
+	fc := fileConfig{
+		Server:    fileServerConfig{Listen: cfg.ListenAddr, APIKeys: cfg.APIKeys, StrictParams: cfg.StrictParams},
+		Transport: fileTransportConfig{Mode: cfg.ExecTransport, CodexBin: cfg.CodexBin, ReasoningEffort: cfg.ReasoningEffort, CodexJSON: &cfg.CodexJSON},
+		SSH:       fileSSHConfig{User: cfg.SSHUser, Host: cfg.SSHHost, Port: cfg.SSHPort},
+		Optimizer: fileOptimizerConfig{
+			Enabled:   cfg.OptimizePrompt,
+			BaseURL:   cfg.Optimizer.BaseURL,
+			APIKey:    cfg.Optimizer.APIKey,
+			Model:     cfg.Optimizer.Model,
+			Providers: cfg.Providers,
+
+			Retries:          &cfg.OptimizerPolicy.Retries,
+			BreakerThreshold: &cfg.OptimizerPolicy.BreakerThreshold,
+			FallbackToRaw:    cfg.OptimizerPolicy.FallbackToRaw,
+		},
+		Policy: filePolicyConfig{
+			AvailableCLIs:  cfg.AvailableCLIs,
+			Rules:          cfg.Policy.Rules,
+			ProdNamespaces: cfg.Policy.ProdNamespaces,
+		},
+		Limits: fileLimitsConfig{
+			RatePerKey: cfg.RateLimits.PerKey,
+			RatePerIP:  cfg.RateLimits.PerIP,
+			Burst:      cfg.RateLimits.Burst,
+			DailyRuns:  cfg.RateLimits.DailyRuns,
+		},
+		Webhooks: cfg.Webhooks,
+		Profiles: cfg.Profiles,
+		GitHub: fileGitHubConfig{
+			WebhookSecret:       cfg.GitHub.WebhookSecret,
+			Trigger:             cfg.GitHub.Trigger,
+			Reply:               cfg.GitHub.Reply,
+			AllowedAssociations: cfg.GitHub.AllowedAssociation,
+		},
+		Storage: fileStorageConfig{
+			SchedulesFile: cfg.SchedulesFile,
+			TemplatesFile: cfg.TemplatesFile,
+			HistoryFile:   cfg.HistoryFile,
+			AuditFile:     cfg.AuditFile,
+			AuditKey:      cfg.AuditKey,
+		},
 	}
-	n, err := strconv.Atoi(strings.TrimSpace(raw))
-	if err != nil || n <= 0 {
-		return 20
+	if cfg.RunTimeout > 0 {
+		fc.Limits.RunTimeout = cfg.RunTimeout.String()
 	}
-	if n > maxRunHistorySize {
-		return maxRunHistorySize
+	if cfg.DrainTimeout > 0 {
+		fc.Limits.DrainTimeout = cfg.DrainTimeout.String()
 	}
-	return n
+	if cfg.Policy.ApprovalTimeout > 0 {
+		fc.Policy.ApprovalTimeout = cfg.Policy.ApprovalTimeout.String()
+	}
+	if cfg.OptimizerPolicy.Timeout > 0 {
+		fc.Optimizer.Timeout = cfg.OptimizerPolicy.Timeout.String()
+	}
+	if cfg.OptimizerPolicy.BreakerCooldown > 0 {
+		fc.Optimizer.BreakerCooldown = cfg.OptimizerPolicy.BreakerCooldown.String()
+	}
+	return fc
 }
 
-func appendRunHistory(runID, model, instruction, status, response, errorText string, elapsed time.Duration) {
-	entry := runHistoryRecord{
-		RunID:       runID,
-		Timestamp:   time.Now().UTC().Format(time.RFC3339),
-		Model:       model,
-		DurationMs:  elapsed.Milliseconds(),
-		Instruction: truncateForLog(instruction, 240),
-		Status:      status,
-		Response:    truncateForLog(response, 1500),
-		Error:       truncateForLog(errorText, 600),
+func redactConfig(fc fileConfig) fileConfig {
+	redact := func(v string) string {
+		if v == "" {
+			return ""
+		}
+		return "<redacted>"
 	}
-	if entry.Status == "completed" && entry.Response == "" {
-		entry.Response = "<empty response>"
+	fc.Optimizer.APIKey = redact(fc.Optimizer.APIKey)
+	providers := make([]OptimizerProvider, len(fc.Optimizer.Providers))
+	for i, provider := range fc.Optimizer.Providers {
+		provider.BaseURL = sanitizeURL(provider.BaseURL)
+		provider.APIKey = redact(provider.APIKey)
+		providers[i] = provider
+	}
+	fc.Optimizer.Providers = providers
+	fc.GitHub.WebhookSecret = redact(fc.GitHub.WebhookSecret)
+	fc.Storage.AuditKey = redact(fc.Storage.AuditKey)
+	hooks := make([]WebhookConfig, len(fc.Webhooks))
+	for i, hook := range fc.Webhooks {
+		hook.URL = sanitizeURL(hook.URL)
+		hook.Secret = redact(hook.Secret)
+		hooks[i] = hook
 	}
+	fc.Webhooks = hooks
+	keys := make([]APIKeyConfig, len(fc.Server.APIKeys))
+	for i, key := range fc.Server.APIKeys {
+		key.Key = redact(key.Key)
+		keys[i] = key
+	}
+	fc.Server.APIKeys = keys
+	return fc
+}
 
-	runHistoryMu.Lock()
-	runHistory = append(runHistory, entry)
-	if len(runHistory) > maxRunHistorySize {
-		runHistory = runHistory[len(runHistory)-maxRunHistorySize:]
+func writeConfigYAML(b *strings.Builder, v reflect.Value, indent int) {
+	pad := strings.Repeat("  ", indent)
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.Struct:
+			fmt.Fprintf(b, "%s%s:\n", pad, name)
+			writeConfigYAML(b, field, indent+1)
+		case reflect.Slice:
+			if field.Len() == 0 {
+				fmt.Fprintf(b, "%s%s: []\n", pad, name)
+				continue
+			}
+			fmt.Fprintf(b, "%s%s:\n", pad, name)
+			for j := 0; j < field.Len(); j++ {
+				item := field.Index(j)
+				if item.Kind() != reflect.Struct {
+					fmt.Fprintf(b, "%s  - %s\n", pad, formatYAMLScalar(item))
+					continue
+				}
+				var nested strings.Builder
+				writeConfigYAML(&nested, item, indent+2)
+				fmt.Fprintf(b, "%s  - %s", pad, strings.TrimLeft(nested.String(), " "))
+			}
+		default:
+			fmt.Fprintf(b, "%s%s: %s\n", pad, name, formatYAMLScalar(field))
+		}
 	}
-	runHistoryMu.Unlock()
 }
 
-func snapshotRunHistory(limit int) []runHistoryRecord {
-	if limit <= 0 {
-		limit = 20
+func formatYAMLScalar(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return "null"
+		}
+		return formatYAMLScalar(v.Elem())
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int:
+		return strconv.FormatInt(v.Int(), 10)
 	}
+	return strconv.Quote(v.String())
+}
 
-	runHistoryMu.Lock()
-	defer runHistoryMu.Unlock()
-	total := len(runHistory)
-	if limit > total {
-		limit = total
+func renderTemplateFromFlags(cfg Config, name string, sets []string) (string, error) {
+	templates, err := loadTemplateStore(cfg.TemplatesFile)
+	if err != nil {
+		return "", err
 	}
-	start := total - limit
-	out := make([]runHistoryRecord, 0, limit)
-	for i := total - 1; i >= start; i-- {
-		out = append(out, runHistory[i])
+	tmpl, ok := templates.get(name)
+	if !ok {
+		return "", fmt.Errorf("unknown template %q (templates file: %s)", name, cfg.TemplatesFile)
 	}
-	return out
+	values := make(map[string]string, len(sets))
+	for _, set := range sets {
+		key, value, ok := strings.Cut(set, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return "", fmt.Errorf("invalid --set %q (expected key=value)", set)
+		}
+		values[key] = value
+	}
+	rendered, err := renderTemplate(tmpl, values)
+	if err != nil {
+		return "", fmt.Errorf("template %s: %w", name, err)
+	}
+	return rendered, nil
 }
 
-func resolveMonitorDir() string {
+func printStartupError(reason string, args []string) {
+	argv := append([]string{os.Args[0]}, args...)
+	fmt.Fprintln(os.Stderr, "error:", reason)
+	fmt.Fprintf(os.Stderr, "detail: argv=%q\n", argv)
+}
+
+func loadConfigFromEnv() (Config, error) {
+	return loadConfig(strings.TrimSpace(os.Getenv("JGO_CONFIG")))
+}
+
+func loadConfig(path string) (Config, error) {
+	cfg := Config{CodexJSON: true, OptimizerPolicy: OptimizerPolicy{Retries: -1, BreakerThreshold: -1}}
+	if path != "" {
+		fileCfg, err := loadConfigFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		cfg = fileCfg
+		cfg.ConfigPath = path
+	}
+
+	var err error
+	if cfg.OptimizePrompt, err = parseBoolEnvDefault("JGO_OPTIMIZE_PROMPT", cfg.OptimizePrompt); err != nil {
+		return Config{}, err
+	}
+	if cfg.CodexJSON, err = parseBoolEnvDefault("JGO_CODEX_JSON", cfg.CodexJSON); err != nil {
+		return Config{}, err
+	}
+	if cfg.RunTimeout, err = parseDurationEnvDefault("JGO_RUN_TIMEOUT", cfg.RunTimeout); err != nil {
+		return Config{}, err
+	}
+	if cfg.DrainTimeout, err = parseDurationEnvDefault("JGO_DRAIN_TIMEOUT", cfg.DrainTimeout); err != nil {
+		return Config{}, err
+	}
+	if cfg.OptimizerPolicy.Timeout, err = parseDurationEnvDefault("JGO_OPTIMIZER_TIMEOUT", cfg.OptimizerPolicy.Timeout); err != nil {
+		return Config{}, err
+	}
+	if cfg.OptimizerPolicy.Retries, err = parseIntEnvDefault("JGO_OPTIMIZER_RETRIES", cfg.OptimizerPolicy.Retries); err != nil {
+		return Config{}, err
+	}
+	if cfg.OptimizerPolicy.BreakerThreshold, err = parseIntEnvDefault("JGO_OPTIMIZER_BREAKER_THRESHOLD", cfg.OptimizerPolicy.BreakerThreshold); err != nil {
+		return Config{}, err
+	}
+	if cfg.OptimizerPolicy.BreakerCooldown, err = parseDurationEnvDefault("JGO_OPTIMIZER_BREAKER_COOLDOWN", cfg.OptimizerPolicy.BreakerCooldown); err != nil {
+		return Config{}, err
+	}
+	if cfg.OptimizerPolicy.FallbackToRaw, err = parseBoolEnvDefault("JGO_OPTIMIZER_FALLBACK_RAW", cfg.OptimizerPolicy.FallbackToRaw); err != nil {
+		return Config{}, err
+	}
+	if strings.TrimSpace(os.Getenv("JGO_OPTIMIZER_PROVIDERS")) != "" {
+		if cfg.Providers, err = parseOptimizerProvidersEnv("JGO_OPTIMIZER_PROVIDERS"); err != nil {
+			return Config{}, err
+		}
+	}
+	if strings.TrimSpace(os.Getenv("JGO_WEBHOOKS")) != "" {
+		if cfg.Webhooks, err = parseWebhooksEnv("JGO_WEBHOOKS"); err != nil {
+			return Config{}, err
+		}
+	}
+	if strings.TrimSpace(os.Getenv("JGO_MODEL_PROFILES")) != "" {
+		if cfg.Profiles, err = parseModelProfilesEnv("JGO_MODEL_PROFILES"); err != nil {
+			return Config{}, err
+		}
+	}
+	if strings.TrimSpace(os.Getenv("JGO_API_KEYS")) != "" {
+		if cfg.APIKeys, err = parseAPIKeysEnv("JGO_API_KEYS"); err != nil {
+			return Config{}, err
+		}
+	}
+	if strings.TrimSpace(os.Getenv("JGO_POLICY_RULES")) != "" {
+		if cfg.Policy.Rules, err = parsePolicyRulesEnv("JGO_POLICY_RULES"); err != nil {
+			return Config{}, err
+		}
+	}
+	if cfg.Policy.ApprovalTimeout, err = parseDurationEnvDefault("JGO_APPROVAL_TIMEOUT", cfg.Policy.ApprovalTimeout); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimits.PerKey, err = parseIntEnvDefault("JGO_RATE_LIMIT_PER_KEY", cfg.RateLimits.PerKey); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimits.PerIP, err = parseIntEnvDefault("JGO_RATE_LIMIT_PER_IP", cfg.RateLimits.PerIP); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimits.Burst, err = parseIntEnvDefault("JGO_RATE_LIMIT_BURST", cfg.RateLimits.Burst); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimits.DailyRuns, err = parseIntEnvDefault("JGO_DAILY_RUN_QUOTA", cfg.RateLimits.DailyRuns); err != nil {
+		return Config{}, err
+	}
+	if cfg.StrictParams, err = parseBoolEnvDefault("JGO_STRICT_PARAMS", cfg.StrictParams); err != nil {
+		return Config{}, err
+	}
+	if cfg.GitHub.Reply, err = parseBoolEnvDefault("JGO_GITHUB_REPLY", cfg.GitHub.Reply); err != nil {
+		return Config{}, err
+	}
+
+	overrideFromEnv(&cfg.CodexBin, "CODEX_BIN")
+	overrideFromEnv(&cfg.ListenAddr, "JGO_LISTEN_ADDR")
+	overrideFromEnv(&cfg.ExecTransport, "JGO_EXEC_TRANSPORT")
+	overrideFromEnv(&cfg.SSHUser, "JGO_SSH_USER")
+	overrideFromEnv(&cfg.SSHHost, "JGO_SSH_HOST")
+	overrideFromEnv(&cfg.SSHPort, "JGO_SSH_PORT")
+	overrideFromEnv(&cfg.ReasoningEffort, "CODEX_REASONING_EFFORT")
+	overrideFromEnv(&cfg.SchedulesFile, "JGO_SCHEDULES_FILE")
+	overrideFromEnv(&cfg.TemplatesFile, "JGO_TEMPLATES_FILE")
+	overrideFromEnv(&cfg.HistoryFile, "JGO_HISTORY_FILE")
+	overrideFromEnv(&cfg.AuditFile, "JGO_AUDIT_FILE")
+	overrideFromEnv(&cfg.AuditKey, "JGO_AUDIT_KEY")
+	overrideFromEnv(&cfg.GitHub.WebhookSecret, "JGO_GITHUB_WEBHOOK_SECRET")
+	overrideFromEnv(&cfg.GitHub.Trigger, "JGO_GITHUB_TRIGGER")
+	if v := splitCSV(os.Getenv("JGO_GITHUB_ALLOWED_ASSOCIATIONS")); len(v) > 0 {
+		cfg.GitHub.AllowedAssociation = v
+	}
+	if v := splitCSV(os.Getenv("JGO_AVAILABLE_CLIS")); len(v) > 0 {
+		cfg.AvailableCLIs = v
+	}
+	if v := splitCSV(os.Getenv("JGO_POLICY_PROD_NAMESPACES")); len(v) > 0 {
+		cfg.Policy.ProdNamespaces = v
+	}
+
+	if cfg.CodexBin == "" {
+		cfg.CodexBin = "codex"
+	}
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = defaultListenAddr
+	}
+	if cfg.ExecTransport == "" {
+		cfg.ExecTransport = defaultTransport
+	}
+	if cfg.SSHUser == "" {
+		cfg.SSHUser = "jgo"
+	}
+	if cfg.SSHHost == "" {
+		cfg.SSHHost = "localhost"
+	}
+	if cfg.SSHPort == "" {
+		cfg.SSHPort = "22"
+	}
+	if cfg.ReasoningEffort == "" {
+		cfg.ReasoningEffort = defaultReasoning
+	}
+	if cfg.SchedulesFile == "" {
+		cfg.SchedulesFile = filepath.Join(cacheRootDir, "schedules.json")
+	}
+	if cfg.TemplatesFile == "" {
+		cfg.TemplatesFile = filepath.Join(cacheRootDir, "templates.json")
+	}
+	if cfg.HistoryFile == "" {
+		cfg.HistoryFile = filepath.Join(cacheRootDir, "history.jsonl")
+	}
+	if cfg.AuditFile == "" {
+		cfg.AuditFile = filepath.Join(cacheRootDir, "audit.jsonl")
+	}
+	if cfg.DrainTimeout == 0 {
+		cfg.DrainTimeout = defaultDrainTimeout
+	}
+	if cfg.OptimizerPolicy.Timeout == 0 {
+		cfg.OptimizerPolicy.Timeout = defaultOptimizerWait
+	}
+	if cfg.OptimizerPolicy.Retries < 0 {
+		cfg.OptimizerPolicy.Retries = defaultOptimizerTry
+	}
+	if cfg.OptimizerPolicy.BreakerThreshold < 0 {
+		cfg.OptimizerPolicy.BreakerThreshold = defaultBreakerLimit
+	}
+	if cfg.OptimizerPolicy.BreakerCooldown == 0 {
+		cfg.OptimizerPolicy.BreakerCooldown = defaultBreakerPause
+	}
+	if len(cfg.Policy.ProdNamespaces) == 0 {
+		cfg.Policy.ProdNamespaces = []string{"prod", "production"}
+	}
+	if cfg.Policy.ApprovalTimeout == 0 {
+		cfg.Policy.ApprovalTimeout = defaultApprovalWait
+	}
+	if cfg.GitHub.Trigger == "" {
+		cfg.GitHub.Trigger = defaultGitHubTrigger
+	}
+	if len(cfg.GitHub.AllowedAssociation) == 0 {
+		cfg.GitHub.AllowedAssociation = []string{"OWNER", "MEMBER", "COLLABORATOR"}
+	}
+
+	return cfg, nil
+}
+
+func loadConfigFile(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("read config file: %w", err)
+	}
+	root, err := parseYAML(data)
+	if err != nil {
+		var yerr *yamlError
+		if errors.As(err, &yerr) {
+			return Config{}, fmt.Errorf("invalid config file:\n%s:%d: %s", path, yerr.line, yerr.msg)
+		}
+		return Config{}, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	var fc fileConfig
+	dec := &configDecoder{lines: make(map[string]int)}
+	dec.decode(root, reflect.ValueOf(&fc).Elem(), "")
+
+	cfg := Config{
+		CodexBin:        strings.TrimSpace(fc.Transport.CodexBin),
+		ListenAddr:      strings.TrimSpace(fc.Server.Listen),
+		ExecTransport:   strings.TrimSpace(fc.Transport.Mode),
+		SSHUser:         strings.TrimSpace(fc.SSH.User),
+		SSHHost:         strings.TrimSpace(fc.SSH.Host),
+		SSHPort:         strings.TrimSpace(fc.SSH.Port),
+		ReasoningEffort: strings.TrimSpace(fc.Transport.ReasoningEffort),
+		CodexJSON:       fc.Transport.CodexJSON == nil || *fc.Transport.CodexJSON,
+		OptimizePrompt:  fc.Optimizer.Enabled,
+		Webhooks:        fc.Webhooks,
+		Profiles:        fc.Profiles,
+		SchedulesFile:   strings.TrimSpace(fc.Storage.SchedulesFile),
+		TemplatesFile:   strings.TrimSpace(fc.Storage.TemplatesFile),
+		HistoryFile:     strings.TrimSpace(fc.Storage.HistoryFile),
+		AuditFile:       strings.TrimSpace(fc.Storage.AuditFile),
+		AuditKey:        strings.TrimSpace(fc.Storage.AuditKey),
+		AvailableCLIs:   fc.Policy.AvailableCLIs,
+		APIKeys:         fc.Server.APIKeys,
+		StrictParams:    fc.Server.StrictParams,
+		Policy: PolicyConfig{
+			Rules:          fc.Policy.Rules,
+			ProdNamespaces: fc.Policy.ProdNamespaces,
+		},
+		Optimizer: OpenAIConfig{
+			BaseURL: strings.TrimSpace(fc.Optimizer.BaseURL),
+			APIKey:  strings.TrimSpace(fc.Optimizer.APIKey),
+			Model:   strings.TrimSpace(fc.Optimizer.Model),
+		},
+		Providers: fc.Optimizer.Providers,
+		OptimizerPolicy: OptimizerPolicy{
+			Retries:          -1,
+			BreakerThreshold: -1,
+			FallbackToRaw:    fc.Optimizer.FallbackToRaw,
+		},
+		GitHub: GitHubConfig{
+			WebhookSecret:      strings.TrimSpace(fc.GitHub.WebhookSecret),
+			Trigger:            strings.TrimSpace(fc.GitHub.Trigger),
+			Reply:              fc.GitHub.Reply,
+			AllowedAssociation: fc.GitHub.AllowedAssociations,
+		},
+	}
+	if cfg.ExecTransport != "" {
+		if _, err := normalizeTransport(cfg.ExecTransport); err != nil {
+			dec.errorf("transport.mode", "invalid transport %q (expected: local or ssh)", cfg.ExecTransport)
+		}
+	}
+	if cfg.ReasoningEffort != "" {
+		if err := validateReasoningEffort(cfg.ReasoningEffort); err != nil {
+			dec.errorf("transport.reasoning_effort", "%v", err)
+		}
+	}
+	if cfg.SSHPort != "" {
+		if port, err := strconv.Atoi(cfg.SSHPort); err != nil || port < 1 || port > 65535 {
+			dec.errorf("ssh.port", "invalid port %q", cfg.SSHPort)
+		}
+	}
+	for i, association := range cfg.GitHub.AllowedAssociation {
+		if !slices.ContainsFunc(githubAssociations, func(v string) bool { return strings.EqualFold(v, association) }) {
+			fieldPath := fmt.Sprintf("github.allowed_associations[%d]", i)
+			dec.errorf(fieldPath, "invalid author association %q (expected one of: %s)", association, strings.Join(githubAssociations, ", "))
+		}
+	}
+	if raw := strings.TrimSpace(fc.Limits.RunTimeout); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 {
+			dec.errorf("limits.run_timeout", "invalid duration %q", raw)
+		}
+		cfg.RunTimeout = d
+	}
+	if fc.Optimizer.Retries != nil {
+		if *fc.Optimizer.Retries < 0 {
+			dec.errorf("optimizer.retries", "retries must be >= 0")
+		}
+		cfg.OptimizerPolicy.Retries = *fc.Optimizer.Retries
+	}
+	if fc.Optimizer.BreakerThreshold != nil {
+		if *fc.Optimizer.BreakerThreshold < 0 {
+			dec.errorf("optimizer.breaker_threshold", "breaker_threshold must be >= 0 (0 disables the breaker)")
+		}
+		cfg.OptimizerPolicy.BreakerThreshold = *fc.Optimizer.BreakerThreshold
+	}
+	for _, field := range []struct {
+		path string
+		raw  string
+		dst  *time.Duration
+	}{
+		{"optimizer.timeout", fc.Optimizer.Timeout, &cfg.OptimizerPolicy.Timeout},
+		{"optimizer.breaker_cooldown", fc.Optimizer.BreakerCooldown, &cfg.OptimizerPolicy.BreakerCooldown},
+	} {
+		if raw := strings.TrimSpace(field.raw); raw != "" {
+			d, err := time.ParseDuration(raw)
+			if err != nil || d <= 0 {
+				dec.errorf(field.path, "invalid duration %q", raw)
+			}
+			*field.dst = d
+		}
+	}
+	if raw := strings.TrimSpace(fc.Policy.ApprovalTimeout); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			dec.errorf("policy.approval_timeout", "invalid duration %q", raw)
+		}
+		cfg.Policy.ApprovalTimeout = d
+	}
+	for i := range cfg.APIKeys {
+		if field, err := validateAPIKey(&cfg.APIKeys[i], i); err != nil {
+			fieldPath := fmt.Sprintf("server.api_keys[%d].%s", i, field)
+			dec.errorf(fieldPath, "%s: %v", fieldPath, err)
+		}
+	}
+	for i := range cfg.Policy.Rules {
+		if field, err := validatePolicyRule(&cfg.Policy.Rules[i], i); err != nil {
+			fieldPath := fmt.Sprintf("policy.rules[%d].%s", i, field)
+			dec.errorf(fieldPath, "%s: %v", fieldPath, err)
+		}
+	}
+	if raw := strings.TrimSpace(fc.Limits.DrainTimeout); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 {
+			dec.errorf("limits.drain_timeout", "invalid duration %q", raw)
+		}
+		cfg.DrainTimeout = d
+	}
+	for _, field := range []struct {
+		path string
+		val  int
+		dst  *int
+	}{
+		{"limits.rate_per_key", fc.Limits.RatePerKey, &cfg.RateLimits.PerKey},
+		{"limits.rate_per_ip", fc.Limits.RatePerIP, &cfg.RateLimits.PerIP},
+		{"limits.burst", fc.Limits.Burst, &cfg.RateLimits.Burst},
+		{"limits.daily_runs", fc.Limits.DailyRuns, &cfg.RateLimits.DailyRuns},
+	} {
+		if field.val < 0 {
+			dec.errorf(field.path, "%s must be >= 0 (0 disables the limit)", field.path)
+		}
+		*field.dst = field.val
+	}
+	for i := range cfg.Providers {
+		if field, err := validateOptimizerProvider(&cfg.Providers[i], i); err != nil {
+			fieldPath := fmt.Sprintf("optimizer.providers[%d].%s", i, field)
+			dec.errorf(fieldPath, "%s: %v", fieldPath, err)
+		}
+	}
+	for i := range cfg.Webhooks {
+		if field, err := validateWebhook(&cfg.Webhooks[i]); err != nil {
+			fieldPath := fmt.Sprintf("webhooks[%d].%s", i, field)
+			dec.errorf(fieldPath, "%s: %v", fieldPath, err)
+		}
+	}
+	for i := range cfg.Profiles {
+		if field, err := validateModelProfile(&cfg.Profiles[i], cfg.Profiles[:i]); err != nil {
+			fieldPath := fmt.Sprintf("profiles[%d].%s", i, field)
+			dec.errorf(fieldPath, "%s: %v", fieldPath, err)
+		}
+	}
+
+	if len(dec.errs) > 0 {
+		sort.SliceStable(dec.errs, func(i, j int) bool { return dec.errs[i].line < dec.errs[j].line })
+		lines := make([]string, 0, len(dec.errs))
+		for _, e := range dec.errs {
+			lines = append(lines, fmt.Sprintf("%s:%d: %s", path, e.line, e.msg))
+		}
+		return Config{}, fmt.Errorf("invalid config file:\n%s", strings.Join(lines, "\n"))
+	}
+	return cfg, nil
+}
+
+func (d *configDecoder) errorf(path, format string, args ...any) {
+	line := d.lines[path]
+	for line == 0 && path != "" {
+		if i := strings.LastIndexAny(path, ".["); i >= 0 {
+			path = path[:i]
+		} else {
+			path = ""
+		}
+		line = d.lines[path]
+	}
+	d.errs = append(d.errs, yamlError{line: line, msg: fmt.Sprintf(format, args...)})
+}
+
+func (d *configDecoder) decode(n *yaml.Node, v reflect.Value, path string) {
+	for n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	d.lines[path] = n.Line
+	if n.Kind == yaml.ScalarNode && n.ShortTag() == "!!null" {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			d.errorf(path, "expected a mapping")
+			return
+		}
+		fields := make(map[string]int, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+			fields[name] = i
+		}
+		seen := make(map[string]bool, len(n.Content)/2)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i].Value
+			child := joinConfigPath(path, key)
+			d.lines[child] = n.Content[i].Line
+			if seen[key] {
+				d.errorf(child, "duplicate key %q", key)
+				continue
+			}
+			seen[key] = true
+			idx, ok := fields[key]
+			if !ok {
+				d.errorf(child, "unknown key %q", key)
+				continue
+			}
+			d.decode(n.Content[i+1], v.Field(idx), child)
+		}
+	case reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			d.errorf(path, "expected a list")
+			return
+		}
+		out := reflect.MakeSlice(v.Type(), len(n.Content), len(n.Content))
+		for i, item := range n.Content {
+			d.decode(item, out.Index(i), fmt.Sprintf("%s[%d]", path, i))
+		}
+		v.Set(out)
+	case reflect.String:
+		if n.Kind != yaml.ScalarNode {
+			d.errorf(path, "expected a string")
+			return
+		}
+		v.SetString(n.Value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(n.Value)
+		if n.Kind != yaml.ScalarNode || err != nil {
+			d.errorf(path, "expected a boolean, got %q", n.Value)
+			return
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		i, err := strconv.Atoi(n.Value)
+		if n.Kind != yaml.ScalarNode || err != nil {
+			d.errorf(path, "expected an integer, got %q", n.Value)
+			return
+		}
+		v.SetInt(int64(i))
+	case reflect.Pointer:
+		elem := reflect.New(v.Type().Elem())
+		d.decode(n, elem.Elem(), path)
+		v.Set(elem)
+	default:
+		d.errorf(path, "unsupported config type %s", v.Kind())
+	}
+}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// yamlErrorLine matches the line number yaml.v3 puts in syntax errors.
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// parseYAML parses a config document with gopkg.in/yaml.v3 and returns its
+// root node, or a null node for an empty file. Syntax errors carry the line.
+func parseYAML(data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		msg := strings.TrimPrefix(err.Error(), "yaml: ")
+		line := 1
+		if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+			line, _ = strconv.Atoi(m[1])
+			msg = m[2]
+		}
+		return nil, &yamlError{line: line, msg: msg}
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Line: 1}, nil
+	}
+	return doc.Content[0], nil
+}
+
+func (e *yamlError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.msg)
+}
+
+func validateReasoningEffort(raw string) error {
+	if !slices.Contains(reasoningEfforts, raw) {
+		return fmt.Errorf("invalid reasoning effort %q (expected one of: %s)", raw, strings.Join(reasoningEfforts, ", "))
+	}
+	return nil
+}
+
+func overrideFromEnv(dst *string, key string) {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		*dst = v
+	}
+}
+
+func validateExecutionConfig(cfg *Config) error {
+	transport, err := normalizeTransport(cfg.ExecTransport)
+	if err != nil {
+		return err
+	}
+	cfg.ExecTransport = transport
+	if transport != transportSSH {
+		return nil
+	}
+	return validateSSHConfig(cfg)
+}
+
+func normalizeTransport(raw string) (string, error) {
+	transport := strings.ToLower(strings.TrimSpace(raw))
+	switch transport {
+	case "", transportLocal:
+		return transportLocal, nil
+	case transportSSH:
+		return transportSSH, nil
+	default:
+		return "", fmt.Errorf("invalid JGO_EXEC_TRANSPORT %q (expected: local or ssh)", raw)
+	}
+}
+
+func validateSSHConfig(cfg *Config) error {
+	var missing []string
+	if strings.TrimSpace(cfg.SSHUser) == "" {
+		missing = append(missing, "JGO_SSH_USER")
+	}
+	if strings.TrimSpace(cfg.SSHHost) == "" {
+		missing = append(missing, "JGO_SSH_HOST")
+	}
+	if strings.TrimSpace(cfg.SSHPort) == "" {
+		missing = append(missing, "JGO_SSH_PORT")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required SSH settings: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func parseBoolEnvDefault(key string, defaultVal bool) (bool, error) {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return defaultVal, nil
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("invalid boolean for %s: %q", key, raw)
+	}
+	return v, nil
+}
+
+func splitCSV(raw string) []string {
+	var out []string
+	for _, item := range strings.Split(raw, ",") {
+		if v := strings.TrimSpace(item); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func parseIntEnvDefault(key string, defaultVal int) (int, error) {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return defaultVal, nil
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid %s: %q (expected a non-negative integer)", key, raw)
+	}
+	return v, nil
+}
+
+func parseDurationEnvDefault(key string, defaultVal time.Duration) (time.Duration, error) {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return defaultVal, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration for %s: %q", key, raw)
+	}
+	return d, nil
+}
+
+func parseWebhooksEnv(key string) ([]WebhookConfig, error) {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return nil, nil
+	}
+	var hooks []WebhookConfig
+	if err := json.Unmarshal([]byte(raw), &hooks); err != nil {
+		return nil, fmt.Errorf("invalid JSON for %s: %w", key, err)
+	}
+	for i := range hooks {
+		if field, err := validateWebhook(&hooks[i]); err != nil {
+			return nil, fmt.Errorf("invalid %s[%d].%s: %w", key, i, field, err)
+		}
+	}
+	return hooks, nil
+}
+
+func parseAPIKeysEnv(key string) ([]APIKeyConfig, error) {
+	var keys []APIKeyConfig
+	if err := json.Unmarshal([]byte(os.Getenv(key)), &keys); err != nil {
+		return nil, fmt.Errorf("invalid JSON for %s: %w", key, err)
+	}
+	for i := range keys {
+		if field, err := validateAPIKey(&keys[i], i); err != nil {
+			return nil, fmt.Errorf("invalid %s[%d].%s: %w", key, i, field, err)
+		}
+	}
+	return keys, nil
+}
+
+func validateAPIKey(k *APIKeyConfig, index int) (string, error) {
+	k.Key = strings.TrimSpace(k.Key)
+	if k.Key == "" {
+		return "key", fmt.Errorf("key is required")
+	}
+	k.Name = strings.TrimSpace(k.Name)
+	if k.Name == "" {
+		k.Name = fmt.Sprintf("key-%d", index+1)
+	}
+	if len(k.Scopes) == 0 {
+		k.Scopes = []string{scopeRun}
+	}
+	for j, scope := range k.Scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		switch scope {
+		case "*", scopeRun, scopeApprove, scopeAudit:
+		default:
+			return "scopes", fmt.Errorf("unknown scope %q (expected: run, approve, audit or *)", scope)
+		}
+		k.Scopes[j] = scope
+	}
+	if k.RateLimit != nil && *k.RateLimit < 0 {
+		return "rate_limit", fmt.Errorf("rate_limit must be >= 0 (0 means unlimited)")
+	}
+	if k.DailyRuns != nil && *k.DailyRuns < 0 {
+		return "daily_runs", fmt.Errorf("daily_runs must be >= 0 (0 means unlimited)")
+	}
+	return "", nil
+}
+
+func parsePolicyRulesEnv(key string) ([]PolicyRule, error) {
+	var rules []PolicyRule
+	if err := json.Unmarshal([]byte(os.Getenv(key)), &rules); err != nil {
+		return nil, fmt.Errorf("invalid JSON for %s: %w", key, err)
+	}
+	for i := range rules {
+		if field, err := validatePolicyRule(&rules[i], i); err != nil {
+			return nil, fmt.Errorf("invalid %s[%d].%s: %w", key, i, field, err)
+		}
+	}
+	return rules, nil
+}
+
+func validatePolicyRule(rule *PolicyRule, index int) (string, error) {
+	rule.Name = strings.TrimSpace(rule.Name)
+	if rule.Name == "" {
+		rule.Name = fmt.Sprintf("rule-%d", index+1)
+	}
+	rule.re = nil
+	if rule.Pattern = strings.TrimSpace(rule.Pattern); rule.Pattern != "" {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return "pattern", fmt.Errorf("invalid regexp: %v", err)
+		}
+		rule.re = re
+	}
+	for j, level := range rule.RiskLevels {
+		level = strings.ToLower(strings.TrimSpace(level))
+		switch level {
+		case riskReadOnly, riskMutating, riskDestructive, "unknown":
+		default:
+			return "risk_levels", fmt.Errorf("unknown risk level %q (expected: read-only, mutating, destructive or unknown)", level)
+		}
+		rule.RiskLevels[j] = level
+	}
+	for _, pattern := range rule.Repos {
+		if _, err := filepath.Match(strings.ToLower(pattern), ""); err != nil {
+			return "repos", fmt.Errorf("invalid repo pattern %q", pattern)
+		}
+	}
+	rule.Keywords = normalizeNameList(rule.Keywords)
+	rule.Namespaces = normalizeNameList(rule.Namespaces)
+	rule.Repos = normalizeNameList(rule.Repos)
+	rule.CLIs = normalizeNameList(rule.CLIs)
+	if len(rule.Keywords)+len(rule.RiskLevels)+len(rule.Namespaces)+len(rule.Repos)+len(rule.CLIs) == 0 && rule.Pattern == "" {
+		return "name", fmt.Errorf("rule %q has no conditions", rule.Name)
+	}
+	return "", nil
+}
+
+func parseOptimizerProvidersEnv(key string) ([]OptimizerProvider, error) {
+	var providers []OptimizerProvider
+	if err := json.Unmarshal([]byte(os.Getenv(key)), &providers); err != nil {
+		return nil, fmt.Errorf("invalid JSON for %s: %w", key, err)
+	}
+	for i := range providers {
+		if field, err := validateOptimizerProvider(&providers[i], i); err != nil {
+			return nil, fmt.Errorf("invalid %s[%d].%s: %w", key, i, field, err)
+		}
+	}
+	return providers, nil
+}
+
+func validateOptimizerProvider(p *OptimizerProvider, index int) (string, error) {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		p.Name = fmt.Sprintf("provider-%d", index+1)
+	}
+	p.BaseURL = strings.TrimSpace(p.BaseURL)
+	if p.BaseURL != "" {
+		u, err := url.Parse(p.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "base_url", fmt.Errorf("%q is not an http(s) URL", p.BaseURL)
+		}
+	}
+	p.Model = strings.TrimSpace(p.Model)
+	if p.Model == "" {
+		return "model", fmt.Errorf("model is required")
+	}
+	p.APIKeyEnv = strings.TrimSpace(p.APIKeyEnv)
+	if strings.TrimSpace(p.APIKey) == "" && p.APIKeyEnv == "" {
+		return "api_key", fmt.Errorf("api_key or api_key_env is required")
+	}
+	if raw := strings.TrimSpace(p.Timeout); raw != "" {
+		if d, err := time.ParseDuration(raw); err != nil || d <= 0 {
+			return "timeout", fmt.Errorf("invalid duration %q", raw)
+		}
+	}
+	return "", nil
+}
+
+func parseModelProfilesEnv(key string) ([]ModelProfile, error) {
+	profiles := []ModelProfile{}
+	if err := json.Unmarshal([]byte(os.Getenv(key)), &profiles); err != nil {
+		return nil, fmt.Errorf("invalid JSON for %s: %w", key, err)
+	}
+	for i := range profiles {
+		if field, err := validateModelProfile(&profiles[i], profiles[:i]); err != nil {
+			return nil, fmt.Errorf("invalid %s[%d].%s: %w", key, i, field, err)
+		}
+	}
+	return profiles, nil
+}
+
+func validateModelProfile(p *ModelProfile, earlier []ModelProfile) (string, error) {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" || strings.ContainsAny(p.Name, "/ \t") {
+		return "name", fmt.Errorf("invalid profile name %q", p.Name)
+	}
+	if p.Name == servedModelID {
+		return "name", fmt.Errorf("%q is the base model and cannot be a profile", p.Name)
+	}
+	for _, other := range earlier {
+		if other.Name == p.Name {
+			return "name", fmt.Errorf("duplicate profile %q", p.Name)
+		}
+	}
+	if p.ReasoningEffort = strings.TrimSpace(p.ReasoningEffort); p.ReasoningEffort != "" {
+		if err := validateReasoningEffort(p.ReasoningEffort); err != nil {
+			return "reasoning_effort", err
+		}
+	}
+	if p.Transport = strings.TrimSpace(p.Transport); p.Transport != "" {
+		transport, err := normalizeTransport(p.Transport)
+		if err != nil {
+			return "transport", fmt.Errorf("invalid transport %q (expected: local or ssh)", p.Transport)
+		}
+		p.Transport = transport
+	}
+	if p.Target = strings.TrimSpace(p.Target); p.Target != "" {
+		if p.Transport == transportLocal {
+			return "target", fmt.Errorf("target needs the ssh transport")
+		}
+		if _, host, _ := splitSSHTarget(p.Target); host == "" {
+			return "target", fmt.Errorf("invalid target %q (expected [user@]host[:port])", p.Target)
+		}
+	}
+	if p.Timeout = strings.TrimSpace(p.Timeout); p.Timeout != "" {
+		if d, err := time.ParseDuration(p.Timeout); err != nil || d < 0 {
+			return "timeout", fmt.Errorf("invalid duration %q", p.Timeout)
+		}
+	}
+	clis := p.CLIs[:0]
+	for _, name := range p.CLIs {
+		if name = strings.TrimSpace(name); name != "" {
+			clis = append(clis, name)
+		}
+	}
+	p.CLIs = clis
+	return "", nil
+}
+
+// splitSSHTarget parses [user@]host[:port].
+func splitSSHTarget(target string) (user, host, port string) {
+	if u, rest, ok := strings.Cut(target, "@"); ok {
+		user, target = u, rest
+	}
+	host = target
+	if h, p, err := net.SplitHostPort(target); err == nil {
+		host, port = h, p
+	}
+	return user, host, port
+}
+
+// apply returns cfg with the profile's settings layered on top.
+func (p ModelProfile) apply(cfg Config) Config {
+	if p.ReasoningEffort != "" {
+		cfg.ReasoningEffort = p.ReasoningEffort
+	}
+	if p.Transport != "" {
+		cfg.ExecTransport = p.Transport
+	}
+	if p.Target != "" {
+		user, host, port := splitSSHTarget(p.Target)
+		cfg.SSHHost = host
+		if user != "" {
+			cfg.SSHUser = user
+		}
+		if port != "" {
+			cfg.SSHPort = port
+		}
+	}
+	if p.OptimizePrompt != nil {
+		cfg.OptimizePrompt = *p.OptimizePrompt
+	}
+	if p.Timeout != "" {
+		cfg.RunTimeout, _ = time.ParseDuration(p.Timeout)
+	}
+	if len(p.CLIs) > 0 {
+		cfg.AvailableCLIs = p.CLIs
+		cfg.CLIAllowlist = p.CLIs
+	}
+	return cfg
+}
+
+func lookupModelProfile(cfg Config, name string) (ModelProfile, bool) {
+	for _, p := range cfg.Profiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return ModelProfile{}, false
+}
+
+func validateWebhook(hook *WebhookConfig) (string, error) {
+	hook.URL = strings.TrimSpace(hook.URL)
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "url", fmt.Errorf("%q is not an http(s) URL", hook.URL)
+	}
+	for j, event := range hook.Events {
+		event = strings.ToLower(strings.TrimSpace(event))
+		switch event {
+		case "*", "completed", "failed", "blocked", "timeout", "interrupted", "cancelled", "awaiting_approval", "rejected", "expired":
+		default:
+			return "events", fmt.Errorf("unknown event %q (expected: completed, failed, blocked, timeout, interrupted, cancelled, awaiting_approval, rejected, expired or *)", event)
+		}
+		hook.Events[j] = event
+	}
+	return "", nil
+}
+
+func runServer(live *liveConfig) error {
+	cfg := live.Load()
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		draining, active := serverRuns.state()
+		if draining {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "draining", "active_runs": active})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"status": "ready", "active_runs": active})
+	})
+
+	if err := loadRunHistory(cfg.HistoryFile, false); err != nil {
+		return err
+	}
+
+	templates, err := loadTemplateStore(cfg.TemplatesFile)
+	if err != nil {
+		return err
+	}
+
+	chatHandler := handleChatCompletions(live, templates)
+	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		chatHandler(w, r)
+	})
+
+	responsesHandler := handleResponses(live)
+	mux.HandleFunc("/v1/responses", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		responsesHandler(w, r)
+	})
+
+	completionsHandler := handleCompletions(live)
+	mux.HandleFunc("/v1/completions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		completionsHandler(w, r)
+	})
+
+	messagesHandler := handleMessages(live)
+	mux.HandleFunc("/v1/messages", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		messagesHandler(w, r)
+	})
+
+	modelsHandler := handleModels(live)
+	mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		modelsHandler(w, r)
+	})
+
+	runHistoryHandler := handleRunHistory()
+	mux.HandleFunc("/api/runs", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		runHistoryHandler(w, r)
+	})
+
+	mux.HandleFunc("/api/runs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		handleRunGet(w, r)
+	})
+	mux.HandleFunc("/api/runs/{id}/approve", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		handleRunApprove(w, r)
+	})
+	mux.HandleFunc("/api/runs/{id}/reject", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		handleRunReject(w, r)
+	})
+
+	auditHandler := handleAuditQuery(live)
+	mux.HandleFunc("/api/audit", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		auditHandler(w, r)
+	})
+
+	usageHandler := handleUsage(live)
+	mux.HandleFunc("/api/usage", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		usageHandler(w, r)
+	})
+
+	runStreamHandler := handleRunStream()
+	mux.HandleFunc("/api/runs/{id}/steps", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		handleRunSteps(w, r)
+	})
+
+	mux.HandleFunc("/api/runs/{id}/stream", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		runStreamHandler(w, r)
+	})
+
+	mux.HandleFunc("/api/templates", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"items": templates.list()})
+	})
+	mux.HandleFunc("/api/templates/{name}", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			templates.handleGet(w, r)
+		case http.MethodPut:
+			templates.handlePut(w, r)
+		case http.MethodDelete:
+			templates.handleDelete(w, r)
+		default:
+			writeMethodNotAllowed(w, "GET, PUT, DELETE")
+		}
+	})
+	templateRunHandler := handleTemplateRun(live, templates)
+	mux.HandleFunc("/api/templates/{name}/run", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		templateRunHandler(w, r)
+	})
+
+	sched, err := loadScheduler(live)
+	if err != nil {
+		return err
+	}
+	go sched.run(context.Background())
+	mux.HandleFunc("/api/schedules", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, map[string]any{"items": sched.list()})
+		case http.MethodPost:
+			sched.handleCreate(w, r)
+		default:
+			writeMethodNotAllowed(w, "GET, POST")
+		}
+	})
+	mux.HandleFunc("/api/schedules/{name}", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			sched.handleGet(w, r)
+		case http.MethodPut:
+			sched.handleUpdate(w, r)
+		case http.MethodDelete:
+			sched.handleDelete(w, r)
+		default:
+			writeMethodNotAllowed(w, "GET, PUT, DELETE")
+		}
+	})
+
+	mcpHandler := handleMCP(&mcpServer{live: live})
+	mux.HandleFunc("/mcp", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		mcpHandler(w, r)
+	})
+
+	githubHandler := handleGitHubWebhook(live)
+	mux.HandleFunc("/webhooks/github", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		githubHandler(w, r)
+	})
+
+	monitorDir := resolveMonitorDir()
+	if monitorDir == "" {
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+				return
+			}
+			message := "jgo API server is running. static monitor assets were not found."
+			if _, err := w.Write([]byte(message)); err != nil {
+				log.Printf("root response failed: %v", err)
+			}
+		})
+	} else {
+		mux.Handle("/", http.FileServer(http.Dir(monitorDir)))
+	}
+
+	server := &http.Server{
+		Addr:              cfg.ListenAddr,
+		Handler:           requireAPIKey(live, rateLimit(live, mux)),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go watchConfig(context.Background(), live)
+	go func() {
+		for range time.Tick(approvalSweepEvery) {
+			expirePendingRuns(time.Now())
+		}
+	}()
+	if len(cfg.APIKeys) == 0 {
+		log.Printf("warning: no API keys configured (JGO_API_KEYS); API and run approvals are open to anyone who can reach %s", cfg.ListenAddr)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Printf("jgo server listening on %s", cfg.ListenAddr)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(stop)
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-stop:
+		log.Printf("received %s: draining runs", sig)
+	}
+	return shutdownServer(server, live.Load().DrainTimeout)
+}
+
+// requireAPIKey authenticates /v1, /api and /mcp requests when API keys are
+// configured and stores the caller in the request context. Approving or
+// rejecting runs needs the "approve" scope, reading the audit log "audit";
+// other writes need "run".
+func requireAPIKey(live *liveConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller := callerIdentity{Name: "anonymous", Remote: r.RemoteAddr, Metered: true}
+		keys := live.Load().APIKeys
+		if len(keys) > 0 && (strings.HasPrefix(r.URL.Path, "/v1/") || strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/mcp") {
+			key, ok := lookupAPIKey(keys, requestAPIKey(r))
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="jgo"`)
+				writeAuthError(w, r, http.StatusUnauthorized, "missing or invalid API key")
+				return
+			}
+			caller.Name, caller.Scopes = key.Name, key.Scopes
+			if scope := requiredScope(r); scope != "" && !slices.Contains(key.Scopes, scope) && !slices.Contains(key.Scopes, "*") {
+				log.Printf("request denied: key=%s path=%s missing scope %q", key.Name, r.URL.Path, scope)
+				writeAuthError(w, r, http.StatusForbidden, fmt.Sprintf("API key %q lacks the %q scope", key.Name, scope))
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerContextKey{}, caller)))
+	})
+}
+
+// requestAPIKey reads the bearer token, then the x-api-key header used by
+// Anthropic clients. Keys are never taken from the URL, where they would
+// end up in access logs and browser history.
+func requestAPIKey(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+func lookupAPIKey(keys []APIKeyConfig, token string) (APIKeyConfig, bool) {
+	if token == "" {
+		return APIKeyConfig{}, false
+	}
+	for _, key := range keys {
+		if hmac.Equal([]byte(key.Key), []byte(token)) {
+			return key, true
+		}
+	}
+	return APIKeyConfig{}, false
+}
+
+func requiredScope(r *http.Request) string {
+	if r.URL.Path == "/api/audit" {
+		return scopeAudit
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/runs/") && (strings.HasSuffix(r.URL.Path, "/approve") || strings.HasSuffix(r.URL.Path, "/reject")) {
+		return scopeApprove
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return ""
+	}
+	return scopeRun
+}
+
+func writeAuthError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if r.URL.Path == "/v1/messages" {
+		writeAnthropicError(w, status, message)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/v1/") {
+		writeOpenAIError(w, status, message)
+		return
+	}
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// rateLimiter holds the per-key and per-IP token buckets and the daily run
+// counters. State is in memory only, so a restart resets usage.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	runs    map[string]int
+	day     string
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimitWindow is one limit applied to a request: a token bucket
+// (perMinute > 0) or, for daily quotas, a run counter.
+type rateLimitWindow struct {
+	id        string
+	perMinute int
+	burst     int
+	daily     int
+}
+
+type rateLimitUsage struct {
+	Name          string `json:"name,omitempty"`
+	IP            string `json:"ip,omitempty"`
+	RateLimit     int    `json:"rate_limit"`
+	Remaining     *int   `json:"remaining_requests,omitempty"`
+	DailyRuns     int    `json:"daily_runs"`
+	RunsToday     int    `json:"runs_today"`
+	RemainingRuns *int   `json:"remaining_runs,omitempty"`
+}
+
+var limiter = &rateLimiter{buckets: make(map[string]*tokenBucket), runs: make(map[string]int)}
+
+// rateLimit enforces the token buckets of cfg.RateLimits on run-starting
+// requests (POST /v1/* and template runs). It must run inside requireAPIKey
+// so the caller is known. The daily run quota is charged by runRecordedPlan,
+// so requests that never start a run do not use it up.
+func rateLimit(live *liveConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isRunRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cfg := live.Load()
+		caller := callerFromContext(r.Context())
+		ipWindow, keyWindow := rateLimitWindows(cfg, caller)
+		now := time.Now()
+		denied, retry, headers := limiter.take(now, ipWindow, keyWindow)
+		for k, v := range headers {
+			w.Header().Set(k, v)
+		}
+		if denied == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(max(1, retry.Round(time.Second)/time.Second))))
+		log.Printf("request rate limited: caller=%s remote=%s path=%s limit=%s", caller.Name, caller.Remote, r.URL.Path, denied.id)
+		message := fmt.Sprintf("rate limit reached for %s: %d requests per minute; retry in %s", denied.id, denied.perMinute, retry.Round(time.Second))
+		if r.URL.Path == "/v1/messages" {
+			writeAnthropicError(w, http.StatusTooManyRequests, message)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/v1/") {
+			writeJSON(w, http.StatusTooManyRequests, openAIErrorResponse{
+				Error: openAIErrorBody{Message: message, Type: "requests", Code: "rate_limit_exceeded"},
+			})
+			return
+		}
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": message})
+	})
+}
+
+func isRunRequest(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return false
+	}
+	return strings.HasPrefix(r.URL.Path, "/v1/") || (strings.HasPrefix(r.URL.Path, "/api/templates/") && strings.HasSuffix(r.URL.Path, "/run"))
+}
+
+// rateLimitWindows resolves the limits for a caller. Key overrides replace
+// the defaults; anonymous callers are metered by remote IP only, and their
+// daily quota is counted per IP as well.
+func rateLimitWindows(cfg Config, caller callerIdentity) (ip, key rateLimitWindow) {
+	ip = rateLimitWindow{id: "ip:" + remoteHost(caller.Remote), perMinute: cfg.RateLimits.PerIP, burst: cfg.RateLimits.Burst}
+	key = rateLimitWindow{id: ip.id, daily: cfg.RateLimits.DailyRuns}
+	for _, k := range cfg.APIKeys {
+		if k.Name != caller.Name {
+			continue
+		}
+		key = rateLimitWindow{id: "key:" + k.Name, perMinute: cfg.RateLimits.PerKey, burst: cfg.RateLimits.Burst, daily: cfg.RateLimits.DailyRuns}
+		if k.RateLimit != nil {
+			key.perMinute = *k.RateLimit
+		}
+		if k.DailyRuns != nil {
+			key.daily = *k.DailyRuns
+		}
+		break
+	}
+	return ip, key
+}
+
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// take checks every bucket before consuming from any, so a request denied
+// by one limit does not use up another. It returns the denying window, how
+// long until it frees up, and the x-ratelimit-* headers for the response;
+// the run headers report the daily quota without charging it.
+func (l *rateLimiter) take(now time.Time, ip, key rateLimitWindow) (*rateLimitWindow, time.Duration, map[string]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rollDay(now)
+	headers := make(map[string]string)
+
+	buckets := []rateLimitWindow{ip}
+	if key.id != ip.id {
+		buckets = append(buckets, key)
+	}
+	var tightest *tokenBucket
+	var tightestWindow rateLimitWindow
+	for _, window := range buckets {
+		if window.perMinute <= 0 {
+			continue
+		}
+		b := l.refill(now, window)
+		if b.tokens < 1 {
+			retry := time.Duration((1 - b.tokens) / ratePerSecond(window) * float64(time.Second))
+			setRequestHeaders(headers, window, b)
+			return &rateLimitWindow{id: window.id, perMinute: window.perMinute}, retry, headers
+		}
+		if tightest == nil || b.tokens < tightest.tokens {
+			tightest, tightestWindow = b, window
+		}
+	}
+	if key.daily > 0 {
+		headers["x-ratelimit-limit-runs"] = strconv.Itoa(key.daily)
+		headers["x-ratelimit-reset-runs"] = untilNextDay(now).Round(time.Second).String()
+		headers["x-ratelimit-remaining-runs"] = strconv.Itoa(max(0, key.daily-l.runs[key.id]))
+	}
+
+	for _, window := range buckets {
+		if window.perMinute > 0 {
+			l.buckets[window.id].tokens--
+		}
+	}
+	if tightest != nil {
+		setRequestHeaders(headers, tightestWindow, tightest)
+	}
+	return nil, 0, headers
+}
+
+// chargeRun counts one run against the daily quota of window, failing
+// with errDailyQuota once it is used up.
+func (l *rateLimiter) chargeRun(now time.Time, window rateLimitWindow) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rollDay(now)
+	if window.daily > 0 && l.runs[window.id] >= window.daily {
+		return fmt.Errorf("%w for %s: %d runs per day; resets in %s", errDailyQuota, window.id, window.daily, untilNextDay(now).Round(time.Minute))
+	}
+	l.runs[window.id]++
+	return nil
+}
+
+func (l *rateLimiter) refill(now time.Time, window rateLimitWindow) *tokenBucket {
+	b, ok := l.buckets[window.id]
+	if !ok {
+		b = &tokenBucket{tokens: float64(bucketSize(window)), updated: now}
+		l.buckets[window.id] = b
+	}
+	b.tokens = min(float64(bucketSize(window)), b.tokens+now.Sub(b.updated).Seconds()*ratePerSecond(window))
+	b.updated = now
+	return b
+}
+
+// rollDay clears the run counters at UTC midnight and drops buckets that
+// have refilled, so idle IPs do not accumulate forever.
+func (l *rateLimiter) rollDay(now time.Time) {
+	day := now.UTC().Format(time.DateOnly)
+	if day == l.day {
+		return
+	}
+	l.day = day
+	clear(l.runs)
+	for id, b := range l.buckets {
+		if now.Sub(b.updated) > time.Hour {
+			delete(l.buckets, id)
+		}
+	}
+}
+
+// usage reports the current state of a window without consuming from it.
+func (l *rateLimiter) usage(now time.Time, window rateLimitWindow) rateLimitUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rollDay(now)
+	u := rateLimitUsage{RateLimit: window.perMinute, DailyRuns: window.daily, RunsToday: l.runs[window.id]}
+	if window.perMinute > 0 {
+		remaining := int(l.refill(now, window).tokens)
+		u.Remaining = &remaining
+	}
+	if window.daily > 0 {
+		remaining := max(0, window.daily-u.RunsToday)
+		u.RemainingRuns = &remaining
+	}
+	return u
+}
+
+func (l *rateLimiter) seenIPs() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seen := make(map[string]bool)
+	for id := range l.buckets {
+		seen[id] = true
+	}
+	for id := range l.runs {
+		seen[id] = true
+	}
+	var ips []string
+	for id := range seen {
+		if ip, ok := strings.CutPrefix(id, "ip:"); ok {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+func setRequestHeaders(headers map[string]string, window rateLimitWindow, b *tokenBucket) {
+	headers["x-ratelimit-limit-requests"] = strconv.Itoa(window.perMinute)
+	headers["x-ratelimit-remaining-requests"] = strconv.Itoa(max(0, int(b.tokens)))
+	missing := float64(bucketSize(window)) - max(0, b.tokens)
+	headers["x-ratelimit-reset-requests"] = time.Duration(missing / ratePerSecond(window) * float64(time.Second)).Round(time.Second).String()
+}
+
+func bucketSize(window rateLimitWindow) int {
+	if window.burst > 0 {
+		return window.burst
+	}
+	return window.perMinute
+}
+
+func ratePerSecond(window rateLimitWindow) float64 {
+	return float64(window.perMinute) / 60
+}
+
+func untilNextDay(now time.Time) time.Duration {
+	utc := now.UTC()
+	return time.Date(utc.Year(), utc.Month(), utc.Day()+1, 0, 0, 0, 0, time.UTC).Sub(utc)
+}
+
+// shutdownServer stops new runs, waits up to drainTimeout for in-flight runs,
+// cancels the rest (recorded as interrupted), then closes the listener.
+func shutdownServer(server *http.Server, drainTimeout time.Duration) error {
+	idle := serverRuns.drain()
+	_, active := serverRuns.state()
+	log.Printf("shutdown: not ready; waiting up to %s for %d active run(s)", drainTimeout, active)
+
+	select {
+	case <-idle:
+		log.Printf("shutdown: all runs finished")
+	case <-time.After(drainTimeout):
+		cancelled := serverRuns.cancelAll()
+		log.Printf("shutdown: drain timeout reached; cancelled %d run(s)", cancelled)
+		select {
+		case <-idle:
+		case <-time.After(interruptGrace):
+			log.Printf("shutdown: cancelled runs did not exit within %s", interruptGrace)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("shutdown server: %w", err)
+	}
+	log.Printf("shutdown: complete")
+	return nil
+}
+
+func (l *liveConfig) Load() Config {
+	return *l.current.Load()
+}
+
+func (l *liveConfig) Store(cfg Config) {
+	l.current.Store(&cfg)
+}
+
+// watchConfig reloads the configuration on SIGHUP and whenever the config
+// file's modification time or size changes.
+func watchConfig(ctx context.Context, live *liveConfig) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+	lastStamp := configFileStamp(live.Load().ConfigPath)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			live.reloadNow("SIGHUP")
+			lastStamp = configFileStamp(live.Load().ConfigPath)
+		case <-ticker.C:
+			stamp := configFileStamp(live.Load().ConfigPath)
+			if stamp == lastStamp {
+				continue
+			}
+			lastStamp = stamp
+			live.reloadNow("config file changed")
+		}
+	}
+}
+
+func configFileStamp(path string) string {
+	if path == "" {
+		return ""
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "missing"
+	}
+	return fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size())
+}
+
+func (l *liveConfig) reloadNow(reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	next, err := l.reload()
+	if err != nil {
+		log.Printf("config reload (%s) failed, keeping current config: %v", reason, err)
+		return
+	}
+	changes := diffConfig(l.loaded, next)
+	if len(changes) == 0 {
+		log.Printf("config reload (%s): no changes", reason)
+		return
+	}
+	l.loaded = next
+	// The listener and the schedule/template/history/audit stores are bound at startup.
+	prev := l.Load()
+	next.ListenAddr = prev.ListenAddr
+	next.SchedulesFile = prev.SchedulesFile
+	next.TemplatesFile = prev.TemplatesFile
+	next.HistoryFile = prev.HistoryFile
+	next.AuditFile = prev.AuditFile
+	next.AuditKey = prev.AuditKey
+	l.Store(next)
+	log.Printf("config reload (%s): %d change(s); in-flight runs keep their previous config", reason, len(changes))
+	for _, change := range changes {
+		log.Printf("config reload: %s", change)
+	}
+}
+
+func diffConfig(prev, next Config) []string {
+	restartOnly := map[string]bool{"server.listen": true, "storage.schedules_file": true, "storage.templates_file": true, "storage.history_file": true, "storage.audit_file": true, "storage.audit_key": true}
+	prevRaw, nextRaw := flattenConfig(configToFile(prev)), flattenConfig(configToFile(next))
+	prevShown, nextShown := flattenConfig(redactConfig(configToFile(prev))), flattenConfig(redactConfig(configToFile(next)))
+
+	keys := make([]string, 0, len(nextRaw))
+	seen := make(map[string]bool)
+	for _, m := range []map[string]string{prevRaw, nextRaw} {
+		for key := range m {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	var changes []string
+	for _, key := range keys {
+		if prevRaw[key] == nextRaw[key] {
+			continue
+		}
+		line := fmt.Sprintf("%s: %s -> %s", key, prevShown[key], nextShown[key])
+		if prevShown[key] == nextShown[key] {
+			line = fmt.Sprintf("%s: <redacted> changed", key)
+		}
+		if restartOnly[key] {
+			line += " (ignored until restart)"
+		}
+		changes = append(changes, line)
+	}
+	return changes
+}
+
+func flattenConfig(fc fileConfig) map[string]string {
+	out := make(map[string]string)
+	var walk func(v reflect.Value, path string)
+	walk = func(v reflect.Value, path string) {
+		switch v.Kind() {
+		case reflect.Struct:
+			for i := 0; i < v.NumField(); i++ {
+				name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+				walk(v.Field(i), joinConfigPath(path, name))
+			}
+		case reflect.Slice:
+			if v.Type().Elem().Kind() == reflect.Struct {
+				for i := 0; i < v.Len(); i++ {
+					walk(v.Index(i), fmt.Sprintf("%s[%d]", path, i))
+				}
+				return
+			}
+			items := make([]string, v.Len())
+			for i := range items {
+				items[i] = formatYAMLScalar(v.Index(i))
+			}
+			out[path] = "[" + strings.Join(items, ", ") + "]"
+		default:
+			out[path] = formatYAMLScalar(v)
+		}
+	}
+	walk(reflect.ValueOf(fc), "")
+	return out
+}
+
+func (t *runTracker) begin(ctx context.Context, runID string) (context.Context, func(), bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return ctx, nil, false
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	t.cancels[runID] = cancel
+	return ctx, func() {
+		cancel(nil)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.cancels, runID)
+		if t.draining && len(t.cancels) == 0 && t.idle != nil {
+			close(t.idle)
+			t.idle = nil
+		}
+	}, true
+}
+
+func (t *runTracker) state() (bool, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining, len(t.cancels)
+}
+
+// drain rejects new runs and returns a channel closed once none are active.
+func (t *runTracker) drain() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.draining = true
+	idle := make(chan struct{})
+	if len(t.cancels) == 0 {
+		close(idle)
+	} else {
+		t.idle = idle
+	}
+	return idle
+}
+
+// cancel stops one run in flight; false means it is not running.
+func (t *runTracker) cancel(runID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cancel, ok := t.cancels[runID]
+	if ok {
+		cancel(errRunCancelled)
+	}
+	return ok
+}
+
+func (t *runTracker) cancelAll() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, cancel := range t.cancels {
+		cancel(errRunInterrupted)
+	}
+	return len(t.cancels)
+}
+
+func handleRunHistory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		expirePendingRuns(time.Now())
+		limit := parseRunHistoryLimit(r.URL.Query().Get("limit"))
+		items := snapshotRunHistory(maxRunHistorySize)
+		if status := strings.TrimSpace(r.URL.Query().Get("status")); status != "" {
+			items = slices.DeleteFunc(items, func(item runHistoryRecord) bool { return item.Status != status })
+		}
+		items = items[:min(limit, len(items))]
+		writeJSON(w, http.StatusOK, map[string]any{
+			"total": len(items),
+			"items": items,
+		})
+	}
+}
+
+func parseRunHistoryLimit(raw string) int {
+	if raw == "" {
+		return 20
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil || n <= 0 {
+		return 20
+	}
+	if n > maxRunHistorySize {
+		return maxRunHistorySize
+	}
+	return n
+}
+
+func appendRunHistory(entry runHistoryRecord, elapsed time.Duration) runHistoryRecord {
+	entry.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	entry.DurationMs = elapsed.Milliseconds()
+	entry.Instruction = truncateForLog(entry.Instruction, 240)
+	entry.Response = truncateForLog(entry.Response, 1500)
+	entry.Error = truncateForLog(entry.Error, 600)
+	if entry.Status == "completed" && entry.Response == "" {
+		entry.Response = "<empty response>"
+	}
+
+	runHistoryMu.Lock()
+	storeRunHistoryLocked(entry)
+	runHistoryMu.Unlock()
+
+	switch entry.Status {
+	case "running", "pending", "awaiting_approval":
+	default:
+		finishRunStream(entry.RunID, entry.Status)
+		saveRunSteps(entry.RunID)
+		saveRunTranscript(entry.RunID)
+	}
+	return entry
+}
+
+// runStepsPath is the sidecar file holding the steps of runID, next to the
+// history file; empty when history is not persisted.
+func runStepsPath(runID string) string {
+	runHistoryMu.Lock()
+	path := runHistoryPath
+	runHistoryMu.Unlock()
+	if path == "" || runID == "" || filepath.Base(runID) != runID || strings.HasPrefix(runID, ".") {
+		return ""
+	}
+	return filepath.Join(runStepsDir(path), runID+".json")
+}
+
+func runStepsDir(historyPath string) string {
+	return strings.TrimSuffix(historyPath, filepath.Ext(historyPath)) + "-steps"
+}
+
+// saveRunSteps persists the steps of a finished run so /api/runs/{id}/steps
+// answers for every run in history, not only those still held in memory.
+func saveRunSteps(runID string) {
+	stream := lookupRunStream(runID)
+	path := runStepsPath(runID)
+	if stream == nil || path == "" {
+		return
+	}
+	steps, _, _ := stream.stepList()
+	if len(steps) == 0 {
+		return
+	}
+	data, err := json.Marshal(steps)
+	if err != nil {
+		log.Printf("[run_id=%s] run steps encode failed: %v", runID, err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Printf("[run_id=%s] run steps write failed: %v", runID, err)
+		return
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		log.Printf("[run_id=%s] run steps write failed: %v", runID, err)
+	}
+}
+
+// runTranscriptPath is the sidecar file holding the output of runID, next
+// to its steps file.
+func runTranscriptPath(runID string) string {
+	path := runStepsPath(runID)
+	if path == "" {
+		return ""
+	}
+	return strings.TrimSuffix(path, ".json") + ".transcript.json"
+}
+
+// saveRunTranscript persists the output of a finished run so
+// /api/runs/{id}/stream can replay it after eviction or a restart.
+func saveRunTranscript(runID string) {
+	stream := lookupRunStream(runID)
+	path := runTranscriptPath(runID)
+	if stream == nil || path == "" {
+		return
+	}
+	chunks, _, _, _ := stream.since(0)
+	if chunks == nil {
+		chunks = []runOutputChunk{}
+	}
+	data, err := json.Marshal(chunks)
+	if err != nil {
+		log.Printf("[run_id=%s] run transcript encode failed: %v", runID, err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Printf("[run_id=%s] run transcript write failed: %v", runID, err)
+		return
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		log.Printf("[run_id=%s] run transcript write failed: %v", runID, err)
+	}
+}
+
+// loadRunTranscript returns the saved output of runID; ok is false when
+// none was saved or it was pruned with history.
+func loadRunTranscript(runID string) ([]runOutputChunk, bool, error) {
+	path := runTranscriptPath(runID)
+	if path == "" {
+		return nil, false, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("read run transcript: %w", err)
+	}
+	var chunks []runOutputChunk
+	if err := json.Unmarshal(data, &chunks); err != nil {
+		return nil, false, fmt.Errorf("decode run transcript: %w", err)
+	}
+	return chunks, true, nil
+}
+
+func loadRunSteps(runID string) ([]runStep, error) {
+	path := runStepsPath(runID)
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read run steps: %w", err)
+	}
+	var steps []runStep
+	if err := json.Unmarshal(data, &steps); err != nil {
+		return nil, fmt.Errorf("decode run steps: %w", err)
+	}
+	return steps, nil
+}
+
+// storeRunHistoryLocked replaces the record with the same run id (a run is
+// first stored as "running") and appends it to the history file.
+func storeRunHistoryLocked(entry runHistoryRecord) {
+	replaced := false
+	for i := len(runHistory) - 1; i >= 0; i-- {
+		if runHistory[i].RunID == entry.RunID {
+			runHistory[i] = entry
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		runHistory = append(runHistory, entry)
+		if len(runHistory) > maxRunHistorySize {
+			runHistory = runHistory[len(runHistory)-maxRunHistorySize:]
+		}
+	}
+	if runHistoryPath == "" {
+		return
+	}
+
+	if err := appendRunHistoryFile(runHistoryPath, entry); err != nil {
+		log.Printf("run history write failed: %v", err)
+		return
+	}
+	runHistoryFileLines++
+	if !runHistoryShared && runHistoryFileLines >= 4*maxRunHistorySize {
+		if err := compactRunHistoryLocked(); err != nil {
+			log.Printf("run history compaction failed: %v", err)
+		}
+	}
+}
+
+// appendRunHistoryFile appends entry to path under the file lock; jgo mcp
+// may share the file with a running server.
+func appendRunHistoryFile(path string, entry runHistoryRecord) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	unlock, err := lockFile(path)
+	if err != nil {
+		return fmt.Errorf("lock: %w", err)
+	}
+	defer unlock()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// auditEntry is one line of the append-only audit log. Hash is the SHA-256
+// of the entry encoded with an empty Hash (an HMAC-SHA256 under JGO_AUDIT_KEY
+// when HashAlg says so), and PrevHash is the previous entry's Hash, so
+// editing, dropping or reordering lines breaks the chain. Without a key the
+// chain only detects edits by someone who cannot rewrite the whole file.
+type auditEntry struct {
+	Seq               int64             `json:"seq"`
+	Time              string            `json:"time"`
+	Event             string            `json:"event"`
+	RunID             string            `json:"run_id"`
+	Caller            string            `json:"caller"`
+	Remote            string            `json:"remote,omitempty"`
+	User              string            `json:"user,omitempty"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+	InstructionSHA256 string            `json:"instruction_sha256,omitempty"`
+	Instruction       string            `json:"instruction,omitempty"`
+	Prompt            string            `json:"prompt,omitempty"`
+	Target            string            `json:"target,omitempty"`
+	Policy            []string          `json:"policy,omitempty"`
+	Approver          string            `json:"approver,omitempty"`
+	Outcome           string            `json:"outcome,omitempty"`
+	Detail            string            `json:"detail,omitempty"`
+	HashAlg           string            `json:"hash_alg,omitempty"`
+	PrevHash          string            `json:"prev_hash"`
+	Hash              string            `json:"hash"`
+}
+
+var auditGenesisHash = strings.Repeat("0", 64)
+
+const auditHMAC = "hmac-sha256"
+
+func newAuditEntry(ctx context.Context, cfg Config, event, instruction string) auditEntry {
+	caller := callerFromContext(ctx)
+	sum := sha256.Sum256([]byte(instruction))
+	return auditEntry{
+		Event:             event,
+		RunID:             runIDFromContext(ctx),
+		Caller:            caller.Name,
+		Remote:            caller.Remote,
+		User:              caller.User,
+		Metadata:          caller.Metadata,
+		InstructionSHA256: hex.EncodeToString(sum[:]),
+		Instruction:       instruction,
+		Target:            formatExecutionTarget(cfg),
+		Approver:          approverFromContext(ctx),
+	}
+}
+
+// appendAudit chains entry onto the audit log of cfg. Failures are logged
+// rather than failing the run.
+func appendAudit(ctx context.Context, cfg Config, entry auditEntry) {
+	if cfg.AuditFile == "" {
+		return
+	}
+	if err := writeAuditEntry(cfg.AuditFile, cfg.AuditKey, entry); err != nil {
+		logRunf(ctx, "audit write failed: %v", err)
+	}
+}
+
+func writeAuditEntry(path, key string, entry auditEntry) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("create audit dir: %w", err)
+	}
+	// A CLI exec may share the file with a running server.
+	unlock, err := lockFile(path)
+	if err != nil {
+		return fmt.Errorf("lock audit log: %w", err)
+	}
+	defer unlock()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return fmt.Errorf("open audit log: %w", err)
+	}
+	defer f.Close()
+
+	last, err := readLastAuditEntry(f)
+	if err != nil {
+		return err
+	}
+	entry.Seq = last.Seq + 1
+	entry.PrevHash = last.Hash
+	entry.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	if key != "" {
+		entry.HashAlg = auditHMAC
+	}
+	if entry.Hash, err = hashAuditEntry(entry, key); err != nil {
+		return err
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("encode audit entry: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		return fmt.Errorf("seek audit log: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write audit log: %w", err)
+	}
+	return nil
+}
+
+// lockFile serializes writers of path across processes with an OS advisory
+// lock (flock, or LockFileEx on Windows) on path+".lock". The lock dies with
+// the process holding it, so a crashed writer never blocks the next one and
+// the lock file can stay in place.
+func lockFile(path string) (func(), error) {
+	lock := flock.New(path + ".lock")
+	ctx, cancel := context.WithTimeout(context.Background(), fileLockWait)
+	defer cancel()
+	locked, err := lock.TryLockContext(ctx, 10*time.Millisecond)
+	switch {
+	case locked:
+		return func() { lock.Unlock() }, nil
+	case ctx.Err() != nil:
+		return nil, fmt.Errorf("timed out waiting for %s", lock.Path())
+	default:
+		return nil, fmt.Errorf("lock %s: %w", lock.Path(), err)
+	}
+}
+
+func hashAuditEntry(entry auditEntry, key string) (string, error) {
+	entry.Hash = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", fmt.Errorf("encode audit entry: %w", err)
+	}
+	if entry.HashAlg == auditHMAC {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write(data)
+		return hex.EncodeToString(mac.Sum(nil)), nil
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// readLastAuditEntry reads the final line of f backwards in chunks so
+// appends stay cheap as the log grows.
+func readLastAuditEntry(f *os.File) (auditEntry, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return auditEntry{}, fmt.Errorf("stat audit log: %w", err)
+	}
+	var tail []byte
+	for pos := info.Size(); pos > 0; {
+		n := min(int64(64<<10), pos)
+		pos -= n
+		chunk := make([]byte, n)
+		if _, err := f.ReadAt(chunk, pos); err != nil {
+			return auditEntry{}, fmt.Errorf("read audit log: %w", err)
+		}
+		tail = append(chunk, tail...)
+		trimmed := bytes.TrimRight(tail, "\n")
+		i := bytes.LastIndexByte(trimmed, '\n')
+		if i < 0 && pos > 0 {
+			continue
+		}
+		if len(trimmed) == 0 {
+			break
+		}
+		var last auditEntry
+		if err := json.Unmarshal(trimmed[i+1:], &last); err != nil {
+			return auditEntry{}, fmt.Errorf("audit log tail is corrupt (run jgo audit verify): %w", err)
+		}
+		return last, nil
+	}
+	return auditEntry{Hash: auditGenesisHash}, nil
+}
+
+// readAuditLog decodes every entry in path, oldest first.
+func readAuditLog(path string) ([]auditEntry, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read audit log: %w", err)
+	}
+	var entries []auditEntry
+	for i, line := range bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var entry auditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid audit entry: %w", path, i+1, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// verifyAuditLog checks sequence numbers, hashes and chaining, returning the
+// number of entries and the head hash. With a key every entry must carry an
+// HMAC, so a log rewritten without the key does not verify.
+func verifyAuditLog(path, key string) (int, string, error) {
+	entries, err := readAuditLog(path)
+	if err != nil {
+		return 0, "", err
+	}
+	prev := auditEntry{Hash: auditGenesisHash}
+	for i, entry := range entries {
+		line := i + 1
+		if entry.Seq != prev.Seq+1 {
+			return i, prev.Hash, fmt.Errorf("%s:%d: seq %d follows seq %d (entry missing or reordered)", path, line, entry.Seq, prev.Seq)
+		}
+		if entry.PrevHash != prev.Hash {
+			return i, prev.Hash, fmt.Errorf("%s:%d: prev_hash does not match the hash of seq %d (chain broken)", path, line, prev.Seq)
+		}
+		switch {
+		case entry.HashAlg == auditHMAC && key == "":
+			return i, prev.Hash, fmt.Errorf("%s:%d: seq %d is keyed; set JGO_AUDIT_KEY to verify it", path, line, entry.Seq)
+		case entry.HashAlg == "" && key != "":
+			return i, prev.Hash, fmt.Errorf("%s:%d: seq %d is not keyed (written without JGO_AUDIT_KEY)", path, line, entry.Seq)
+		case entry.HashAlg != "" && entry.HashAlg != auditHMAC:
+			return i, prev.Hash, fmt.Errorf("%s:%d: unknown hash_alg %q", path, line, entry.HashAlg)
+		}
+		want, err := hashAuditEntry(entry, key)
+		if err != nil {
+			return i, prev.Hash, err
+		}
+		if entry.Hash != want {
+			return i, prev.Hash, fmt.Errorf("%s:%d: hash mismatch for seq %d (entry modified)", path, line, entry.Seq)
+		}
+		prev = entry
+	}
+	return len(entries), prev.Hash, nil
+}
+
+func auditCommand(cfg Config, args []string) error {
+	if len(args) == 0 || args[0] != "verify" {
+		printUsage()
+		return fmt.Errorf("usage: jgo audit verify [--file audit.jsonl]")
+	}
+	fs := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	configPath := fs.String("config", cfg.ConfigPath, "path to jgo.yaml config file")
+	file := fs.String("file", "", "audit log path (default: $JGO_AUDIT_FILE or storage.audit_file)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return fmt.Errorf("parse audit args: %w", err)
+	}
+	cfg, err := applyCommonFlags(cfg, fs, *configPath, cfg.ExecTransport, cfg.OptimizePrompt)
+	if err != nil {
+		return err
+	}
+	path := cfg.AuditFile
+	if *file != "" {
+		path = *file
+	}
+	count, head, err := verifyAuditLog(path, cfg.AuditKey)
+	if err != nil {
+		return fmt.Errorf("audit log verification failed after %d valid entries: %w", count, err)
+	}
+	fmt.Printf("ok: %d entries verified in %s (head %s)\n", count, path, head)
+	return nil
+}
+
+func handleAuditQuery(live *liveConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		limit := 100
+		if raw := strings.TrimSpace(query.Get("limit")); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid limit %q", raw)})
+				return
+			}
+			limit = min(n, 1000)
+		}
+		var since time.Time
+		if raw := strings.TrimSpace(query.Get("since")); raw != "" {
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid since %q (expected RFC3339)", raw)})
+				return
+			}
+			since = t
+		}
+
+		entries, err := readAuditLog(live.Load().AuditFile)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		items := make([]auditEntry, 0, limit)
+		for i := len(entries) - 1; i >= 0 && len(items) < limit; i-- {
+			entry := entries[i]
+			if v := query.Get("run_id"); v != "" && entry.RunID != v {
+				continue
+			}
+			if v := query.Get("caller"); v != "" && entry.Caller != v && entry.Approver != v {
+				continue
+			}
+			if v := query.Get("event"); v != "" && entry.Event != v {
+				continue
+			}
+			if !since.IsZero() {
+				if t, err := time.Parse(time.RFC3339Nano, entry.Time); err == nil && t.Before(since) {
+					continue
+				}
+			}
+			items = append(items, entry)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"total": len(items), "items": items})
+	}
+}
+
+// handleUsage reports rate limit and daily quota usage. Keys without the
+// "*" scope only see their own key and remote IP.
+func handleUsage(live *liveConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := live.Load()
+		caller := callerFromContext(r.Context())
+		all := len(cfg.APIKeys) == 0 || slices.Contains(caller.Scopes, "*")
+		now := time.Now()
+
+		keys := make([]rateLimitUsage, 0, len(cfg.APIKeys))
+		for _, k := range cfg.APIKeys {
+			if !all && k.Name != caller.Name {
+				continue
+			}
+			_, window := rateLimitWindows(cfg, callerIdentity{Name: k.Name})
+			u := limiter.usage(now, window)
+			u.Name = k.Name
+			keys = append(keys, u)
+		}
+		ipList := []string{remoteHost(caller.Remote)}
+		if all {
+			ipList = limiter.seenIPs()
+		}
+		ips := make([]rateLimitUsage, 0, len(ipList))
+		for _, ip := range ipList {
+			window, quota := rateLimitWindows(cfg, callerIdentity{Name: "anonymous", Remote: ip})
+			u := limiter.usage(now, window)
+			if len(cfg.APIKeys) == 0 {
+				q := limiter.usage(now, quota)
+				u.DailyRuns, u.RunsToday, u.RemainingRuns = q.DailyRuns, q.RunsToday, q.RemainingRuns
+			}
+			u.IP = ip
+			ips = append(ips, u)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"day":      now.UTC().Format(time.DateOnly),
+			"reset_in": untilNextDay(now).Round(time.Second).String(),
+			"keys":     keys,
+			"ips":      ips,
+		})
+	}
+}
+
+// compactRunHistoryLocked rewrites the history file from its own contents,
+// under the file lock, so records appended by another process (jgo mcp)
+// are merged rather than overwritten. Memory is refreshed from the result.
+func compactRunHistoryLocked() error {
+	unlock, err := lockFile(runHistoryPath)
+	if err != nil {
+		return fmt.Errorf("lock run history: %w", err)
+	}
+	defer unlock()
+	records, err := readRunHistoryFile(runHistoryPath)
+	if err != nil {
+		return err
+	}
+	return writeRunHistoryLocked(records)
+}
+
+// readRunHistoryFile returns the newest maxRunHistorySize runs in path. A
+// run appears where it was first recorded, with its latest record.
+func readRunHistoryFile(path string) ([]runHistoryRecord, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read run history: %w", err)
+	}
+	var records []runHistoryRecord
+	index := make(map[string]int)
+	for i, line := range bytes.Split(raw, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var entry runHistoryRecord
+		if err := json.Unmarshal(line, &entry); err != nil {
+			log.Printf("run history %s:%d skipped: %v", path, i+1, err)
+			continue
+		}
+		if at, ok := index[entry.RunID]; ok {
+			records[at] = entry
+			continue
+		}
+		index[entry.RunID] = len(records)
+		records = append(records, entry)
+	}
+	if len(records) > maxRunHistorySize {
+		records = records[len(records)-maxRunHistorySize:]
+	}
+	return records, nil
+}
+
+// writeRunHistoryLocked replaces the history file and memory with records.
+// The caller holds runHistoryMu and the file lock.
+func writeRunHistoryLocked(records []runHistoryRecord) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, entry := range records {
+		if err := enc.Encode(entry); err != nil {
+			return fmt.Errorf("encode run history: %w", err)
+		}
+	}
+	if err := writeFileAtomic(runHistoryPath, buf.Bytes()); err != nil {
+		return err
+	}
+	runHistory = records
+	runHistoryFileLines = len(records)
+	pruneRunStepsLocked()
+	return nil
+}
+
+// pruneRunStepsLocked removes step and transcript files of runs that fell
+// out of history.
+func pruneRunStepsLocked() {
+	dir := runStepsDir(runHistoryPath)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	keep := make(map[string]bool, 2*len(runHistory))
+	for _, entry := range runHistory {
+		keep[entry.RunID+".json"] = true
+		keep[entry.RunID+".transcript.json"] = true
+	}
+	for _, file := range files {
+		if !keep[file.Name()] {
+			os.Remove(filepath.Join(dir, file.Name()))
+		}
+	}
+}
+
+// loadRunHistory restores history from path. Runs still marked "running"
+// belong to a process that died without draining and become "interrupted".
+// A shared loader (jgo mcp next to a server) only reads: the server owns
+// those runs, so nothing is marked, compacted or pruned.
+func loadRunHistory(path string, shared bool) error {
+	runHistoryMu.Lock()
+	defer runHistoryMu.Unlock()
+
+	runHistory = nil
+	runHistoryPath = ""
+	runHistoryShared = shared
+	runHistoryFileLines = 0
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("create run history dir: %w", err)
+	}
+	if shared {
+		records, err := readRunHistoryFile(path)
+		if err != nil {
+			return err
+		}
+		runHistory, runHistoryPath = records, path
+		log.Printf("run history loaded: %d record(s) from %s (shared, append-only)", len(records), path)
+		return nil
+	}
+
+	unlock, err := lockFile(path)
+	if err != nil {
+		return fmt.Errorf("lock run history: %w", err)
+	}
+	defer unlock()
+	records, err := readRunHistoryFile(path)
+	if err != nil {
+		return err
+	}
+	interrupted := 0
+	for i := range records {
+		switch records[i].Status {
+		case "running":
+			records[i].Error = "server stopped before the run finished"
+		case "pending", "awaiting_approval":
+			records[i].Error = "server stopped before the run was approved"
+		default:
+			continue
+		}
+		records[i].Status = "interrupted"
+		interrupted++
+	}
+
+	runHistoryPath = path
+	if err := writeRunHistoryLocked(records); err != nil {
+		return fmt.Errorf("write run history: %w", err)
+	}
+	log.Printf("run history loaded: %d record(s) from %s (%d marked interrupted)", len(records), path, interrupted)
+	return nil
+}
+
+func lookupRunHistory(runID string) (runHistoryRecord, bool) {
+	runHistoryMu.Lock()
+	defer runHistoryMu.Unlock()
+	for i := len(runHistory) - 1; i >= 0; i-- {
+		if runHistory[i].RunID == runID {
+			return runHistory[i], true
+		}
+	}
+	return runHistoryRecord{}, false
+}
+
+func snapshotRunHistory(limit int) []runHistoryRecord {
+	if limit <= 0 {
+		limit = 20
+	}
+
+	runHistoryMu.Lock()
+	defer runHistoryMu.Unlock()
+	total := len(runHistory)
+	if limit > total {
+		limit = total
+	}
+	start := total - limit
+	out := make([]runHistoryRecord, 0, limit)
+	for i := total - 1; i >= start; i-- {
+		out = append(out, runHistory[i])
+	}
+	return out
+}
+
+func handleRunStream() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		runID := strings.TrimSpace(r.PathValue("id"))
+		stream := lookupRunStream(runID)
+		if stream == nil {
+			replayRunTranscript(w, runID)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{
+				"error": "streaming is not supported by this server",
+			})
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.Header().Set("X-JGO-Run-ID", runID)
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		offset := 0
+		for {
+			chunks, notify, done, status := stream.since(offset)
+			offset += len(chunks)
+			for _, chunk := range chunks {
+				if err := writeSSEEvent(w, flusher, "output", chunk); err != nil {
+					log.Printf("[run_id=%s] run stream write failed: %v", runID, err)
+					return
+				}
+			}
+			if done {
+				if err := writeSSEEvent(w, flusher, "done", map[string]string{"run_id": runID, "status": status}); err != nil {
+					log.Printf("[run_id=%s] run stream write failed: %v", runID, err)
+				}
+				return
+			}
+			select {
+			case <-notify:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// replayRunTranscript answers /api/runs/{id}/stream for a run whose
+// in-memory stream is gone (evicted or a restart) from its saved
+// transcript: 410 once that is gone too, 404 for unknown runs.
+func replayRunTranscript(w http.ResponseWriter, runID string) {
+	record, ok := lookupRunHistory(runID)
+	if !ok || record.Status == "running" || record.Status == "pending" || record.Status == "awaiting_approval" {
+		writeJSON(w, http.StatusNotFound, map[string]string{
+			"error": fmt.Sprintf("run output not found: %s", runID),
+		})
+		return
+	}
+	chunks, ok, err := loadRunTranscript(runID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if !ok {
+		writeJSON(w, http.StatusGone, map[string]string{
+			"error": fmt.Sprintf("run output is no longer available: %s", runID),
+		})
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "streaming is not supported by this server",
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-JGO-Run-ID", runID)
+	w.WriteHeader(http.StatusOK)
+	for _, chunk := range chunks {
+		if err := writeSSEEvent(w, flusher, "output", chunk); err != nil {
+			log.Printf("[run_id=%s] run stream write failed: %v", runID, err)
+			return
+		}
+	}
+	if err := writeSSEEvent(w, flusher, "done", map[string]string{"run_id": runID, "status": record.Status}); err != nil {
+		log.Printf("[run_id=%s] run stream write failed: %v", runID, err)
+	}
+}
+
+func handleRunSteps(w http.ResponseWriter, r *http.Request) {
+	runID := strings.TrimSpace(r.PathValue("id"))
+	var steps []runStep
+	var done bool
+	var status string
+	if stream := lookupRunStream(runID); stream != nil {
+		if steps, done, status = stream.stepList(); !done {
+			status = "running"
+		}
+	} else if record, ok := lookupRunHistory(runID); ok {
+		// The stream is gone (evicted or a restart); use the saved steps.
+		var err error
+		if steps, err = loadRunSteps(runID); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		status = record.Status
+		done = status != "running" && status != "pending" && status != "awaiting_approval"
+	} else {
+		writeJSON(w, http.StatusNotFound, map[string]string{
+			"error": fmt.Sprintf("run steps not found: %s", runID),
+		})
+		return
+	}
+	if steps == nil {
+		steps = []runStep{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"run_id": runID, "status": status, "done": done, "total": len(steps), "steps": steps})
+}
+
+func writeSSEEvent(w http.ResponseWriter, flusher http.Flusher, event string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+func beginRunStream(runID string) *runStream {
+	if runID == "" {
+		return nil
+	}
+
+	runStreamsMu.Lock()
+	defer runStreamsMu.Unlock()
+	if stream, ok := runStreams[runID]; ok {
+		return stream
+	}
+	stream := &runStream{notify: make(chan struct{})}
+	runStreams[runID] = stream
+	runStreamOrder = append(runStreamOrder, runID)
+	if len(runStreamOrder) > maxRunHistorySize {
+		evicted := runStreamOrder[:len(runStreamOrder)-maxRunHistorySize]
+		runStreamOrder = runStreamOrder[len(evicted):]
+		for _, id := range evicted {
+			delete(runStreams, id)
+		}
+	}
+	return stream
+}
+
+func lookupRunStream(runID string) *runStream {
+	runStreamsMu.Lock()
+	defer runStreamsMu.Unlock()
+	return runStreams[runID]
+}
+
+func finishRunStream(runID, status string) {
+	if stream := lookupRunStream(runID); stream != nil {
+		stream.finish(status)
+	}
+}
+
+func (s *runStream) append(name, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done || s.truncated {
+		return
+	}
+	if s.size+len(text) > maxTranscriptSize {
+		s.truncated = true
+		s.chunks = append(s.chunks, runOutputChunk{Stream: "jgo", Text: "...(transcript truncated)\n"})
+	} else {
+		s.size += len(text)
+		s.chunks = append(s.chunks, runOutputChunk{Stream: name, Text: text})
+	}
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+func (s *runStream) finish(status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return
+	}
+	s.done = true
+	s.status = status
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// putStep appends step, or updates the step with the same ID (a command
+// first reported as running, then completed). s may be nil outside the
+// server.
+func (s *runStream) putStep(step runStep) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if step.ID != "" {
+		for i := len(s.steps) - 1; i >= 0; i-- {
+			prev := s.steps[i]
+			if prev.ID != step.ID || prev.Type != step.Type {
+				continue
+			}
+			step.Index, step.started, step.StartedAt = prev.Index, prev.started, prev.StartedAt
+			if step.Command == "" {
+				step.Command = prev.Command
+			}
+			if step.Status != "running" {
+				step.DurationMs = now.Sub(prev.started).Milliseconds()
+			}
+			s.steps[i] = step
+			return
+		}
+	}
+	if len(s.steps) >= maxRunSteps {
+		return
+	}
+	step.Index = len(s.steps)
+	step.started, step.StartedAt = now, now.UTC().Format(time.RFC3339Nano)
+	s.steps = append(s.steps, step)
+}
+
+// stepList returns a copy of the steps; once the run is done the last
+// message is marked as the final answer.
+func (s *runStream) stepList() ([]runStep, bool, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	steps := slices.Clone(s.steps)
+	if s.done {
+		for i := len(steps) - 1; i >= 0; i-- {
+			if steps[i].Type == "message" {
+				steps[i].Final = true
+				break
+			}
+		}
+	}
+	return steps, s.done, s.status
+}
+
+func (s *runStream) since(offset int) ([]runOutputChunk, <-chan struct{}, bool, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var chunks []runOutputChunk
+	if offset < len(s.chunks) {
+		chunks = append(chunks, s.chunks[offset:]...)
+	}
+	return chunks, s.notify, s.done, s.status
+}
+
+func (w runStreamWriter) Write(p []byte) (int, error) {
+	if w.stream != nil && len(p) > 0 {
+		w.stream.append(w.name, string(p))
+	}
+	return len(p), nil
+}
+
+func notifyWebhooks(ctx context.Context, hooks []WebhookConfig, entry runHistoryRecord) {
+	if len(hooks) == 0 {
+		return
+	}
+	payload, err := json.Marshal(webhookPayload{Event: "run." + entry.Status, runHistoryRecord: entry})
+	if err != nil {
+		logRunf(ctx, "webhook payload encode failed: %v", err)
+		return
+	}
+	deliveryCtx := context.WithValue(context.Background(), runIDContextKey{}, entry.RunID)
+	for _, hook := range hooks {
+		if !webhookWantsEvent(hook, entry.Status) {
+			continue
+		}
+		go deliverWebhook(deliveryCtx, hook, entry.Status, payload)
+	}
+}
+
+func webhookWantsEvent(hook WebhookConfig, status string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, event := range hook.Events {
+		if event == "*" || event == status {
+			return true
+		}
+	}
+	return false
+}
+
+func deliverWebhook(ctx context.Context, hook WebhookConfig, status string, payload []byte) {
+	client := &http.Client{Timeout: webhookTimeout}
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		retry, err := postWebhook(ctx, client, hook, status, payload)
+		if err == nil {
+			logRunf(ctx, "webhook delivered: url=%s event=run.%s attempt=%d", sanitizeURL(hook.URL), status, attempt)
+			return
+		}
+		logRunf(ctx, "webhook delivery failed: url=%s event=run.%s attempt=%d/%d: %v", sanitizeURL(hook.URL), status, attempt, webhookAttempts, err)
+		if !retry || attempt == webhookAttempts {
+			return
+		}
+		time.Sleep(webhookBackoff(attempt))
+	}
+}
+
+// webhookBackoff returns the wait after failed attempt n (1-based): 1s
+// doubling each attempt, with jitter so receivers that come back are not hit
+// by every run's retries at once.
+func webhookBackoff(attempt int) time.Duration {
+	base := time.Second << (attempt - 1)
+	return base/2 + rand.N(base/2+1)
+}
+
+func postWebhook(ctx context.Context, client *http.Client, hook WebhookConfig, status string, payload []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "jgo-webhook")
+	req.Header.Set("X-JGO-Event", "run."+status)
+	req.Header.Set("X-JGO-Run-ID", runIDFromContext(ctx))
+	if hook.Secret != "" {
+		req.Header.Set("X-JGO-Signature-256", signWebhookPayload(hook.Secret, payload))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func loadScheduler(live *liveConfig) (*scheduler, error) {
+	cfg := live.Load()
+	sched := &scheduler{cfg: live, path: cfg.SchedulesFile, entries: make(map[string]*scheduleEntry)}
+	raw, err := os.ReadFile(sched.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return sched, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read schedules file (%s): %w", sched.path, err)
+	}
+	var defs []Schedule
+	if len(bytes.TrimSpace(raw)) > 0 {
+		if err := json.Unmarshal(raw, &defs); err != nil {
+			return nil, fmt.Errorf("parse schedules file (%s): %w", sched.path, err)
+		}
+	}
+
+	now := time.Now()
+	for _, def := range defs {
+		entry, err := newScheduleEntry(def, now)
+		if err != nil {
+			return nil, fmt.Errorf("schedules file (%s): %w", sched.path, err)
+		}
+		if _, exists := sched.entries[entry.def.Name]; exists {
+			return nil, fmt.Errorf("schedules file (%s): duplicate schedule %q", sched.path, entry.def.Name)
+		}
+		sched.entries[entry.def.Name] = entry
+	}
+	log.Printf("schedules loaded: file=%s count=%d", sched.path, len(sched.entries))
+	return sched, nil
+}
+
+func newScheduleEntry(def Schedule, now time.Time) (*scheduleEntry, error) {
+	def.Name = strings.TrimSpace(def.Name)
+	def.Cron = strings.TrimSpace(def.Cron)
+	def.Instruction = strings.TrimSpace(def.Instruction)
+	def.Timezone = strings.TrimSpace(def.Timezone)
+	def.ReasoningEffort = strings.TrimSpace(def.ReasoningEffort)
+	def.Timeout = strings.TrimSpace(def.Timeout)
+	def.MissedRunPolicy = strings.ToLower(strings.TrimSpace(def.MissedRunPolicy))
+
+	if def.Name == "" || strings.ContainsAny(def.Name, "/ \t") {
+		return nil, fmt.Errorf("invalid schedule name %q", def.Name)
+	}
+	if def.Instruction == "" {
+		return nil, fmt.Errorf("schedule %q: instruction is required", def.Name)
+	}
+	spec, err := parseCron(def.Cron)
+	if err != nil {
+		return nil, fmt.Errorf("schedule %q: %w", def.Name, err)
+	}
+	loc := time.UTC
+	if def.Timezone != "" {
+		loc, err = time.LoadLocation(def.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: invalid timezone %q", def.Name, def.Timezone)
+		}
+	}
+	if def.Timeout != "" {
+		if d, err := time.ParseDuration(def.Timeout); err != nil || d <= 0 {
+			return nil, fmt.Errorf("schedule %q: invalid timeout %q", def.Name, def.Timeout)
+		}
+	}
+	switch def.MissedRunPolicy {
+	case "":
+		def.MissedRunPolicy = missedRunSkip
+	case missedRunSkip, missedRunOnce:
+	default:
+		return nil, fmt.Errorf("schedule %q: invalid missed_run_policy %q (expected: skip or run_once)", def.Name, def.MissedRunPolicy)
+	}
+
+	entry := &scheduleEntry{def: def, spec: spec, loc: loc}
+	entry.next = spec.next(now.In(loc))
+	if def.MissedRunPolicy == missedRunOnce && def.LastRunAt != "" {
+		if last, err := time.Parse(time.RFC3339, def.LastRunAt); err == nil {
+			if missed := spec.next(last.In(loc)); !missed.IsZero() && missed.Before(now) {
+				entry.next = now
+			}
+		}
+	}
+	return entry, nil
+}
+
+func (s *scheduler) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.fireDue(now)
+		}
+	}
+}
+
+func (s *scheduler) fireDue(now time.Time) {
+	if draining, _ := serverRuns.state(); draining {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := false
+	for _, entry := range s.entries {
+		if entry.def.Paused || entry.next.IsZero() || now.Before(entry.next) {
+			continue
+		}
+		entry.next = entry.spec.next(now.In(entry.loc))
+		changed = true
+		if entry.running && !entry.def.AllowOverlap {
+			entry.def.SkippedRuns++
+			log.Printf("schedule %q skipped: previous run %s is still in progress", entry.def.Name, entry.def.LastRunID)
+			continue
+		}
+		s.startLocked(entry, now)
+	}
+	if changed {
+		s.saveLocked()
+	}
+}
+
+func (s *scheduler) startLocked(entry *scheduleEntry, now time.Time) {
+	runID := nextRunID()
+	entry.running = true
+	entry.def.LastRunAt = now.UTC().Format(time.RFC3339)
+	entry.def.LastRunID = runID
+	entry.def.LastStatus = "running"
+
+	def := entry.def
+	cfg := s.cfg.Load()
+	if def.OptimizePrompt != nil {
+		cfg.OptimizePrompt = *def.OptimizePrompt
+	}
+	if def.ReasoningEffort != "" {
+		cfg.ReasoningEffort = def.ReasoningEffort
+	}
+	if def.Timeout != "" {
+		cfg.RunTimeout, _ = time.ParseDuration(def.Timeout)
+	}
+
+	go func() {
+		ctx := context.WithValue(context.Background(), runIDContextKey{}, runID)
+		ctx = context.WithValue(ctx, callerContextKey{}, callerIdentity{Name: "schedule:" + def.Name})
+		logRunf(ctx, "scheduled run start: schedule=%q cron=%q", def.Name, def.Cron)
+		_, record, err := runRecorded(ctx, cfg, servedModelID, def.Instruction)
+		if errors.Is(err, errServerDraining) {
+			record.Status = "skipped"
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// An update replaces the entry but keeps LastRunID, so match on the
+		// run rather than on the entry pointer.
+		if current, ok := s.entries[def.Name]; ok && current.def.LastRunID == runID {
+			current.running = false
+			current.def.LastStatus = record.Status
+			s.saveLocked()
+		}
+	}()
+}
+
+func (s *scheduler) saveLocked() {
+	defs := make([]Schedule, 0, len(s.entries))
+	for _, entry := range s.entries {
+		defs = append(defs, entry.def)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	payload, err := json.MarshalIndent(defs, "", "  ")
+	if err != nil {
+		log.Printf("save schedules failed: %v", err)
+		return
+	}
+	if err := writeFileAtomic(s.path, append(payload, '\n')); err != nil {
+		log.Printf("save schedules failed: %v", err)
+	}
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *scheduler) list() []scheduleView {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]scheduleView, 0, len(s.entries))
+	for _, entry := range s.entries {
+		out = append(out, entry.view())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (e *scheduleEntry) view() scheduleView {
+	v := scheduleView{Schedule: e.def, Running: e.running}
+	if !e.def.Paused && !e.next.IsZero() {
+		v.NextRunAt = e.next.In(e.loc).Format(time.RFC3339)
+	}
+	return v
+}
+
+func (s *scheduler) handleCreate(w http.ResponseWriter, r *http.Request) {
+	var def Schedule
+	if err := json.NewDecoder(r.Body).Decode(&def); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid JSON body: %v", err)})
+		return
+	}
+	clearScheduleState(&def)
+	entry, err := newScheduleEntry(def, time.Now())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.entries[entry.def.Name]; exists {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("schedule already exists: %s", entry.def.Name)})
+		return
+	}
+	s.entries[entry.def.Name] = entry
+	s.saveLocked()
+	log.Printf("schedule created: name=%q cron=%q", entry.def.Name, entry.def.Cron)
+	writeJSON(w, http.StatusCreated, entry.view())
+}
+
+func (s *scheduler) handleGet(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[r.PathValue("name")]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("schedule not found: %s", r.PathValue("name"))})
+		return
+	}
+	writeJSON(w, http.StatusOK, entry.view())
+}
+
+func (s *scheduler) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var def Schedule
+	if err := json.NewDecoder(r.Body).Decode(&def); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid JSON body: %v", err)})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.entries[name]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("schedule not found: %s", name)})
+		return
+	}
+	def.Name = name
+	def.LastRunAt = existing.def.LastRunAt
+	def.LastRunID = existing.def.LastRunID
+	def.LastStatus = existing.def.LastStatus
+	def.SkippedRuns = existing.def.SkippedRuns
+	entry, err := newScheduleEntry(def, time.Now())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	entry.running = existing.running
+	s.entries[name] = entry
+	s.saveLocked()
+	log.Printf("schedule updated: name=%q cron=%q paused=%t", name, entry.def.Cron, entry.def.Paused)
+	writeJSON(w, http.StatusOK, entry.view())
+}
+
+func (s *scheduler) handleDelete(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[name]; !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("schedule not found: %s", name)})
+		return
+	}
+	delete(s.entries, name)
+	s.saveLocked()
+	log.Printf("schedule deleted: name=%q", name)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted", "name": name})
+}
+
+func clearScheduleState(def *Schedule) {
+	def.LastRunAt = ""
+	def.LastRunID = ""
+	def.LastStatus = ""
+	def.SkippedRuns = 0
+}
+
+func parseCron(expr string) (*cronSpec, error) {
+	macros := map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+	if v, ok := macros[strings.ToLower(expr)]; ok {
+		expr = v
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron %q (expected 5 fields: minute hour day-of-month month day-of-week)", expr)
+	}
+
+	var spec cronSpec
+	var err error
+	if spec.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("invalid cron minute %q: %w", fields[0], err)
+	}
+	if spec.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("invalid cron hour %q: %w", fields[1], err)
+	}
+	if spec.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("invalid cron day-of-month %q: %w", fields[2], err)
+	}
+	if spec.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("invalid cron month %q: %w", fields[3], err)
+	}
+	if spec.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("invalid cron day-of-week %q: %w", fields[4], err)
+	}
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+	// As in Vixie cron, a field starting with "*" (including "*/n") counts
+	// as unrestricted when combining day-of-month and day-of-week.
+	spec.domStar = strings.HasPrefix(fields[2], "*")
+	spec.dowStar = strings.HasPrefix(fields[4], "*")
+	return &spec, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			a, b, _ := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("invalid value %q", a)
+			}
+			if hi, err = strconv.Atoi(b); err != nil {
+				return 0, fmt.Errorf("invalid value %q", b)
+			}
+		default:
+			n, err := strconv.Atoi(rangePart)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", rangePart)
+			}
+			lo = n
+			if !hasStep {
+				hi = n
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("value out of range %d-%d", min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSpec) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func loadTemplateStore(path string) (*templateStore, error) {
+	store := &templateStore{path: path, templates: make(map[string]PromptTemplate)}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read templates file (%s): %w", path, err)
+	}
+	var defs []PromptTemplate
+	if len(bytes.TrimSpace(raw)) > 0 {
+		if err := json.Unmarshal(raw, &defs); err != nil {
+			return nil, fmt.Errorf("parse templates file (%s): %w", path, err)
+		}
+	}
+	for _, def := range defs {
+		if err := validateTemplate(&def); err != nil {
+			return nil, fmt.Errorf("templates file (%s): %w", path, err)
+		}
+		if _, exists := store.templates[def.Name]; exists {
+			return nil, fmt.Errorf("templates file (%s): duplicate template %q", path, def.Name)
+		}
+		store.templates[def.Name] = def
+	}
+	return store, nil
+}
+
+func validateTemplate(t *PromptTemplate) error {
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" || strings.ContainsAny(t.Name, "/ \t") {
+		return fmt.Errorf("invalid template name %q", t.Name)
+	}
+	if strings.TrimSpace(t.Template) == "" {
+		return fmt.Errorf("template %q: template text is required", t.Name)
+	}
+
+	declared := make(map[string]bool, len(t.Params))
+	for i := range t.Params {
+		p := &t.Params[i]
+		p.Name = strings.TrimSpace(p.Name)
+		p.Type = strings.ToLower(strings.TrimSpace(p.Type))
+		if p.Type == "" {
+			p.Type = "string"
+		}
+		if !templatePlaceholderPattern.MatchString("{" + p.Name + "}") {
+			return fmt.Errorf("template %q: invalid param name %q", t.Name, p.Name)
+		}
+		if declared[p.Name] {
+			return fmt.Errorf("template %q: duplicate param %q", t.Name, p.Name)
+		}
+		declared[p.Name] = true
+		switch p.Type {
+		case "string", "int", "number", "bool":
+		case "enum":
+			if len(p.Enum) == 0 {
+				return fmt.Errorf("template %q: enum param %q requires enum values", t.Name, p.Name)
+			}
+		default:
+			return fmt.Errorf("template %q: param %q has invalid type %q (expected: string, int, number, bool or enum)", t.Name, p.Name, p.Type)
+		}
+		if p.Default != "" {
+			if _, err := checkTemplateValue(*p, p.Default); err != nil {
+				return fmt.Errorf("template %q: param %q default: %w", t.Name, p.Name, err)
+			}
+		}
+	}
+	for _, m := range templatePlaceholderPattern.FindAllStringSubmatch(t.Template, -1) {
+		if !declared[m[1]] {
+			return fmt.Errorf("template %q: placeholder {%s} is not declared in params", t.Name, m[1])
+		}
+	}
+	return nil
+}
+
+func checkTemplateValue(p TemplateParam, raw string) (string, error) {
+	value := strings.TrimSpace(raw)
+	switch p.Type {
+	case "int":
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return "", fmt.Errorf("expected int, got %q", raw)
+		}
+	case "number":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return "", fmt.Errorf("expected number, got %q", raw)
+		}
+	case "bool":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("expected bool, got %q", raw)
+		}
+		value = strconv.FormatBool(b)
+	case "enum":
+		for _, allowed := range p.Enum {
+			if value == allowed {
+				return value, nil
+			}
+		}
+		return "", fmt.Errorf("expected one of %s, got %q", strings.Join(p.Enum, ", "), raw)
+	}
+	return value, nil
+}
+
+func renderTemplate(t PromptTemplate, values map[string]string) (string, error) {
+	declared := make(map[string]TemplateParam, len(t.Params))
+	for _, p := range t.Params {
+		declared[p.Name] = p
+	}
+	for name := range values {
+		if _, ok := declared[name]; !ok {
+			return "", &templateParamError{Param: name, Message: fmt.Sprintf("unknown parameter %q for template %q", name, t.Name)}
+		}
+	}
+
+	resolved := make(map[string]string, len(t.Params))
+	for _, p := range t.Params {
+		raw, ok := values[p.Name]
+		if !ok || strings.TrimSpace(raw) == "" {
+			if p.Default != "" {
+				raw = p.Default
+			} else if p.Required {
+				return "", &templateParamError{Param: p.Name, Message: fmt.Sprintf("missing required parameter %q for template %q", p.Name, t.Name)}
+			} else {
+				resolved[p.Name] = ""
+				continue
+			}
+		}
+		value, err := checkTemplateValue(p, raw)
+		if err != nil {
+			return "", &templateParamError{Param: p.Name, Message: fmt.Sprintf("invalid parameter %q for template %q: %v", p.Name, t.Name, err)}
+		}
+		resolved[p.Name] = value
+	}
+
+	rendered := templatePlaceholderPattern.ReplaceAllStringFunc(t.Template, func(m string) string {
+		return resolved[m[1:len(m)-1]]
+	})
+	return strings.TrimSpace(rendered), nil
+}
+
+func renderTemplateAny(t PromptTemplate, params map[string]any) (string, error) {
+	values := make(map[string]string, len(params))
+	for name, raw := range params {
+		switch v := raw.(type) {
+		case nil:
+		case string:
+			values[name] = v
+		case bool:
+			values[name] = strconv.FormatBool(v)
+		case float64:
+			values[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return "", &templateParamError{Param: name, Message: fmt.Sprintf("parameter %q must be a string, number or bool", name)}
+		}
+	}
+	return renderTemplate(t, values)
+}
+
+func (e *templateParamError) Error() string {
+	return e.Message
+}
+
+func writeTemplateError(w http.ResponseWriter, err error, runID, paramPrefix string) {
+	var paramErr *templateParamError
+	if errors.As(err, &paramErr) {
+		writeOpenAIParamError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", paramErr.Message, runID), paramPrefix+"."+paramErr.Param)
+		return
+	}
+	writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID))
+}
+
+func (s *templateStore) get(name string) (PromptTemplate, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.templates[name]
+	return t, ok
+}
+
+func (s *templateStore) list() []PromptTemplate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]PromptTemplate, 0, len(s.templates))
+	for _, t := range s.templates {
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (s *templateStore) saveLocked() error {
+	defs := make([]PromptTemplate, 0, len(s.templates))
+	for _, t := range s.templates {
+		defs = append(defs, t)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	payload, err := json.MarshalIndent(defs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, append(payload, '\n'))
+}
+
+func (s *templateStore) handleGet(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.get(r.PathValue("name"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("template not found: %s", r.PathValue("name"))})
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+func (s *templateStore) handlePut(w http.ResponseWriter, r *http.Request) {
+	var t PromptTemplate
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid JSON body: %v", err)})
+		return
+	}
+	t.Name = r.PathValue("name")
+	if err := validateTemplate(&t); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, existed := s.templates[t.Name]
+	s.templates[t.Name] = t
+	if err := s.saveLocked(); err != nil {
+		log.Printf("save templates failed: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("save templates: %v", err)})
+		return
+	}
+	log.Printf("template saved: name=%q params=%d", t.Name, len(t.Params))
+	status := http.StatusOK
+	if !existed {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, t)
+}
+
+func (s *templateStore) handleDelete(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.templates[name]; !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("template not found: %s", name)})
+		return
+	}
+	delete(s.templates, name)
+	if err := s.saveLocked(); err != nil {
+		log.Printf("save templates failed: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("save templates: %v", err)})
+		return
+	}
+	log.Printf("template deleted: name=%q", name)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted", "name": name})
+}
+
+func handleTemplateRun(live *liveConfig, templates *templateStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := live.Load()
+		runID := nextRunID()
+		ctx := context.WithValue(r.Context(), runIDContextKey{}, runID)
+		w.Header().Set("X-JGO-Run-ID", runID)
+
+		name := r.PathValue("name")
+		var req templateRunRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			logRunf(ctx, "request rejected: invalid JSON body: %v", err)
+			writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("invalid JSON body: %s (run_id=%s)", err.Error(), runID))
+			return
+		}
+		logRunf(ctx, "incoming template run: template=%q params=%d stream=%t remote=%s", name, len(req.Params), req.Stream, r.RemoteAddr)
+
+		tmpl, ok := templates.get(name)
+		if !ok {
+			logRunf(ctx, "request rejected: unknown template=%q", name)
+			writeOpenAIParamError(w, http.StatusNotFound, fmt.Sprintf("unknown template %q (run_id=%s)", name, runID), "template")
+			return
+		}
+		instruction, err := renderTemplateAny(tmpl, req.Params)
+		if err != nil {
+			logRunf(ctx, "request rejected: template=%q: %v", name, err)
+			writeTemplateError(w, err, runID, "params")
+			return
+		}
+		logRunf(ctx, "instruction preview=%q", truncateForLog(instruction, 160))
+		respondWithRun(ctx, w, cfg, servedModelID, instruction, runOptions{
+			Stream:             req.Stream,
+			DryRun:             req.DryRun,
+			RequireApproval:    req.RequireApproval,
+			ConfirmDestructive: req.ConfirmDestructive,
+		})
+	}
+}
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+func resolveMonitorDir() string {
 	mainFile := strings.TrimSpace(os.Getenv("JGO_MAIN_FILE"))
 	mainFileDir := "./monitor"
 	if mainFile != "" {
 		mainFileDir = filepath.Join(filepath.Dir(mainFile), "monitor")
 	}
 
-	candidates := []string{
-		strings.TrimSpace(os.Getenv("JGO_MONITOR_DIR")),
-		strings.TrimSpace(mainFileDir),
-		strings.TrimSpace(filepath.Join("/opt/jgo", "monitor")),
-		strings.TrimSpace(filepath.Join(".", "monitor")),
+	candidates := []string{
+		strings.TrimSpace(os.Getenv("JGO_MONITOR_DIR")),
+		strings.TrimSpace(mainFileDir),
+		strings.TrimSpace(filepath.Join("/opt/jgo", "monitor")),
+		strings.TrimSpace(filepath.Join(".", "monitor")),
+	}
+
+	for _, candidate := range candidates {
+		if candidate == "" {
+			continue
+		}
+		info, err := os.Stat(candidate)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		return candidate
+	}
+	return ""
+}
+
+func handleChatCompletions(live *liveConfig, templates *templateStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := live.Load()
+		runID := nextRunID()
+		ctx := context.WithValue(r.Context(), runIDContextKey{}, runID)
+		w.Header().Set("X-JGO-Run-ID", runID)
+
+		var req openAIChatCompletionRequest
+		if param, err := decodeRunRequest(cfg, r, &req); err != nil {
+			logRunf(ctx, "request rejected: %v", err)
+			writeOpenAIParamError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID), param)
+			return
+		}
+		ctx, param, err := withRequestParams(ctx, req.openAIRequestParams, cfg.StrictParams)
+		if err != nil {
+			logRunf(ctx, "request rejected: %v", err)
+			writeOpenAIParamError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID), param)
+			return
+		}
+
+		logRunf(
+			ctx,
+			"incoming chat request: path=%s method=%s model=%q stream=%t messages=%d remote=%s",
+			r.URL.Path,
+			r.Method,
+			strings.TrimSpace(req.Model),
+			req.Stream,
+			len(req.Messages),
+			r.RemoteAddr,
+		)
+
+		session, param, err := newToolSession(req.Tools, req.ToolChoice, req.ParallelToolCalls)
+		if err != nil {
+			logRunf(ctx, "request rejected: %v", err)
+			writeOpenAIParamError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID), param)
+			return
+		}
+		instruction, parts := extractInstructionFromMessages(req.Messages)
+		results, err := session.takeResults(ctx, req.Messages)
+		if err != nil {
+			logRunf(ctx, "request rejected: %v", err)
+			writeOpenAIParamError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID), "messages")
+			return
+		}
+		if session.Results {
+			logRunf(ctx, "tool results received: resume_thread=%q", session.Thread)
+			instruction, parts = results, nil
+		}
+		ctx = withToolSession(ctx, session)
+		attachments, err := collectAttachments(parts)
+		if err != nil {
+			logRunf(ctx, "request rejected: %v", err)
+			writeOpenAIParamError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID), "messages")
+			return
+		}
+		ctx = withAttachments(ctx, attachments)
+		if name := strings.TrimSpace(req.Template); name != "" && !session.Results {
+			tmpl, ok := templates.get(name)
+			if !ok {
+				logRunf(ctx, "request rejected: unknown template=%q", name)
+				writeOpenAIParamError(w, http.StatusBadRequest, fmt.Sprintf("unknown template %q (run_id=%s)", name, runID), "template")
+				return
+			}
+			rendered, err := renderTemplateAny(tmpl, req.TemplateParams)
+			if err != nil {
+				logRunf(ctx, "request rejected: template=%q: %v", name, err)
+				writeTemplateError(w, err, runID, "template_params")
+				return
+			}
+			logRunf(ctx, "template rendered: name=%q", name)
+			instruction = rendered
+		}
+		if instruction == "" {
+			logRunf(ctx, "request rejected: missing user instruction in messages")
+			writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("missing user instruction in messages (run_id=%s)", runID))
+			return
+		}
+		logRunf(ctx, "instruction preview=%q", truncateForLog(instruction, 160))
+		runModel, err := resolveRunModel(cfg, req.Model)
+		if err != nil {
+			logRunf(ctx, "request rejected: %v", err)
+			writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID))
+			return
+		}
+
+		respondWithRun(ctx, w, cfg, runModel, instruction, runOptions{
+			Stream:             req.Stream,
+			IncludeUsage:       req.StreamOptions != nil && req.StreamOptions.IncludeUsage,
+			DryRun:             req.DryRun,
+			RequireApproval:    req.RequireApproval,
+			ConfirmDestructive: req.ConfirmDestructive,
+			MaxTokens:          req.maxTokens(),
+			Stop:               req.stopSequences(),
+		})
+	}
+}
+
+func handleResponses(live *liveConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := live.Load()
+		runID := nextRunID()
+		ctx := context.WithValue(r.Context(), runIDContextKey{}, runID)
+		w.Header().Set("X-JGO-Run-ID", runID)
+
+		var req openAIResponsesRequest
+		if param, err := decodeRunRequest(cfg, r, &req); err != nil {
+			logRunf(ctx, "request rejected: %v", err)
+			writeOpenAIParamError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID), param)
+			return
+		}
+		ctx, param, err := withRequestParams(ctx, req.openAIRequestParams, cfg.StrictParams)
+		if err != nil {
+			logRunf(ctx, "request rejected: %v", err)
+			writeOpenAIParamError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID), param)
+			return
+		}
+		logRunf(
+			ctx,
+			"incoming responses request: path=%s method=%s model=%q stream=%t remote=%s",
+			r.URL.Path,
+			r.Method,
+			strings.TrimSpace(req.Model),
+			req.Stream,
+			r.RemoteAddr,
+		)
+
+		instruction, err := extractInstructionFromInput(req.Input)
+		if err != nil {
+			logRunf(ctx, "request rejected: %v", err)
+			writeOpenAIParamError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID), "input")
+			return
+		}
+		if instruction == "" {
+			logRunf(ctx, "request rejected: missing user instruction in input")
+			writeOpenAIParamError(w, http.StatusBadRequest, fmt.Sprintf("missing user instruction in input (run_id=%s)", runID), "input")
+			return
+		}
+		logRunf(ctx, "instruction preview=%q", truncateForLog(instruction, 160))
+		runModel, err := resolveRunModel(cfg, req.Model)
+		if err != nil {
+			logRunf(ctx, "request rejected: %v", err)
+			writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID))
+			return
+		}
+
+		respondWithRun(ctx, w, cfg, runModel, instruction, runOptions{
+			Stream:             req.Stream,
+			DryRun:             req.DryRun,
+			RequireApproval:    req.RequireApproval,
+			ConfirmDestructive: req.ConfirmDestructive,
+			MaxTokens:          req.maxTokens(),
+			Stop:               req.stopSequences(),
+			Respond:            writeResponsesResult,
+		})
+	}
+}
+
+// extractInstructionFromInput reads a Responses API input: a plain string,
+// or items whose last user message (string content or input_text parts)
+// becomes the instruction.
+func extractInstructionFromInput(raw json.RawMessage) (string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return strings.TrimSpace(text), nil
+	}
+	var items []responsesInputItem
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return "", fmt.Errorf("input must be a string or an array of input items")
+	}
+	for i := len(items) - 1; i >= 0; i-- {
+		item := items[i]
+		if (item.Type != "" && item.Type != "message") || !strings.EqualFold(strings.TrimSpace(item.Role), "user") {
+			continue
+		}
+		if err := json.Unmarshal(item.Content, &text); err == nil {
+			if text = strings.TrimSpace(text); text != "" {
+				return text, nil
+			}
+			continue
+		}
+		var parts []responsesContentPart
+		if err := json.Unmarshal(item.Content, &parts); err != nil {
+			return "", fmt.Errorf("input[%d].content must be a string or an array of content parts", i)
+		}
+		var texts []string
+		for _, part := range parts {
+			if (part.Type == "input_text" || part.Type == "text") && strings.TrimSpace(part.Text) != "" {
+				texts = append(texts, strings.TrimSpace(part.Text))
+			}
+		}
+		if len(texts) > 0 {
+			return strings.Join(texts, "\n"), nil
+		}
+	}
+	return "", nil
+}
+
+func handleCompletions(live *liveConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := live.Load()
+		runID := nextRunID()
+		ctx := context.WithValue(r.Context(), runIDContextKey{}, runID)
+		w.Header().Set("X-JGO-Run-ID", runID)
+
+		var req openAICompletionRequest
+		if param, err := decodeRunRequest(cfg, r, &req); err != nil {
+			logRunf(ctx, "request rejected: %v", err)
+			writeOpenAIParamError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID), param)
+			return
+		}
+		ctx, param, err := withRequestParams(ctx, req.openAIRequestParams, cfg.StrictParams)
+		if err != nil {
+			logRunf(ctx, "request rejected: %v", err)
+			writeOpenAIParamError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID), param)
+			return
+		}
+		logRunf(
+			ctx,
+			"incoming completions request: path=%s method=%s model=%q stream=%t remote=%s",
+			r.URL.Path,
+			r.Method,
+			strings.TrimSpace(req.Model),
+			req.Stream,
+			r.RemoteAddr,
+		)
+
+		instruction, err := extractInstructionFromPrompt(req.Prompt)
+		if err != nil {
+			logRunf(ctx, "request rejected: %v", err)
+			writeOpenAIParamError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID), "prompt")
+			return
+		}
+		if instruction == "" {
+			logRunf(ctx, "request rejected: missing prompt")
+			writeOpenAIParamError(w, http.StatusBadRequest, fmt.Sprintf("missing prompt (run_id=%s)", runID), "prompt")
+			return
+		}
+		logRunf(ctx, "instruction preview=%q", truncateForLog(instruction, 160))
+		runModel, err := resolveRunModel(cfg, req.Model)
+		if err != nil {
+			logRunf(ctx, "request rejected: %v", err)
+			writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID))
+			return
+		}
+
+		respondWithRun(ctx, w, cfg, runModel, instruction, runOptions{
+			Stream:             req.Stream,
+			IncludeUsage:       req.StreamOptions != nil && req.StreamOptions.IncludeUsage,
+			DryRun:             req.DryRun,
+			RequireApproval:    req.RequireApproval,
+			ConfirmDestructive: req.ConfirmDestructive,
+			MaxTokens:          req.maxTokens(),
+			Stop:               req.stopSequences(),
+			Respond:            writeCompletionResult,
+		})
+	}
+}
+
+// extractInstructionFromPrompt reads a legacy completions prompt: a string,
+// or the last non-empty string of an array. Token arrays are rejected.
+func extractInstructionFromPrompt(raw json.RawMessage) (string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return strings.TrimSpace(text), nil
+	}
+	var prompts []string
+	if err := json.Unmarshal(raw, &prompts); err != nil {
+		return "", fmt.Errorf("prompt must be a string or an array of strings")
+	}
+	for i := len(prompts) - 1; i >= 0; i-- {
+		if text = strings.TrimSpace(prompts[i]); text != "" {
+			return text, nil
+		}
+	}
+	return "", nil
+}
+
+func handleMessages(live *liveConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := live.Load()
+		runID := nextRunID()
+		ctx := context.WithValue(r.Context(), runIDContextKey{}, runID)
+		w.Header().Set("X-JGO-Run-ID", runID)
+
+		var req anthropicMessagesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logRunf(ctx, "request rejected: invalid JSON body: %v", err)
+			writeAnthropicError(w, http.StatusBadRequest, fmt.Sprintf("invalid JSON body: %s (run_id=%s)", err.Error(), runID))
+			return
+		}
+		logRunf(
+			ctx,
+			"incoming messages request: path=%s method=%s model=%q messages=%d stream=%t remote=%s",
+			r.URL.Path,
+			r.Method,
+			strings.TrimSpace(req.Model),
+			len(req.Messages),
+			req.Stream,
+			r.RemoteAddr,
+		)
+
+		instruction, err := extractInstructionFromAnthropicMessages(req.Messages)
+		if err != nil {
+			logRunf(ctx, "request rejected: %v", err)
+			writeAnthropicError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID))
+			return
+		}
+		if instruction == "" {
+			logRunf(ctx, "request rejected: missing user instruction in messages")
+			writeAnthropicError(w, http.StatusBadRequest, fmt.Sprintf("missing user instruction in messages (run_id=%s)", runID))
+			return
+		}
+		logRunf(ctx, "instruction preview=%q", truncateForLog(instruction, 160))
+		runModel, err := resolveRunModel(cfg, req.Model)
+		if err != nil {
+			logRunf(ctx, "request rejected: %v", err)
+			writeAnthropicError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID))
+			return
+		}
+
+		respondWithRun(ctx, w, cfg, runModel, instruction, runOptions{
+			Stream:             req.Stream,
+			DryRun:             req.DryRun,
+			RequireApproval:    req.RequireApproval,
+			ConfirmDestructive: req.ConfirmDestructive,
+			Respond:            writeMessagesResult,
+			Fail:               writeAnthropicError,
+		})
+	}
+}
+
+// extractInstructionFromAnthropicMessages returns the last user message,
+// whose content is a string or a list of blocks; text blocks are joined.
+func extractInstructionFromAnthropicMessages(messages []anthropicMessage) (string, error) {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if !strings.EqualFold(strings.TrimSpace(messages[i].Role), "user") {
+			continue
+		}
+		var text string
+		if err := json.Unmarshal(messages[i].Content, &text); err == nil {
+			if text = strings.TrimSpace(text); text != "" {
+				return text, nil
+			}
+			continue
+		}
+		var blocks []anthropicContentBlock
+		if err := json.Unmarshal(messages[i].Content, &blocks); err != nil {
+			return "", fmt.Errorf("messages[%d].content must be a string or an array of content blocks", i)
+		}
+		var texts []string
+		for _, block := range blocks {
+			if block.Type == "text" && strings.TrimSpace(block.Text) != "" {
+				texts = append(texts, strings.TrimSpace(block.Text))
+			}
+		}
+		if len(texts) > 0 {
+			return strings.Join(texts, "\n"), nil
+		}
+	}
+	return "", nil
+}
+
+// decodeRunRequest decodes a /v1 request body. In strict mode unknown
+// parameters are rejected and the returned param names the offender.
+func decodeRunRequest(cfg Config, r *http.Request, v any) (string, error) {
+	dec := json.NewDecoder(r.Body)
+	if cfg.StrictParams {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok && cfg.StrictParams {
+			param, _ := strconv.Unquote(field)
+			return param, fmt.Errorf("unsupported parameter %s (strict mode)", field)
+		}
+		return "", fmt.Errorf("invalid JSON body: %w", err)
+	}
+	return "", nil
+}
+
+// check rejects parameters jgo cannot honor and returns the offending
+// param name with the error.
+func (p openAIRequestParams) check() (string, error) {
+	if p.N != nil && *p.N != 1 {
+		return "n", fmt.Errorf("n=%d is not supported; jgo returns a single choice per run", *p.N)
+	}
+	if tools := bytes.TrimSpace(p.Tools); len(tools) > 0 && string(tools) != "null" && string(tools) != "[]" {
+		return "tools", fmt.Errorf("tools are only supported on /v1/chat/completions")
+	}
+	for _, field := range []struct {
+		name string
+		val  *int
+	}{
+		{"max_tokens", p.MaxTokens},
+		{"max_completion_tokens", p.MaxCompletionTokens},
+		{"max_output_tokens", p.MaxOutputTokens},
+	} {
+		if field.val != nil && *field.val <= 0 {
+			return field.name, fmt.Errorf("%s must be > 0", field.name)
+		}
+	}
+	if _, err := parseStopSequences(p.Stop); err != nil {
+		return "stop", err
+	}
+	return "", nil
+}
+
+// metadata returns the string entries of the metadata object and the keys
+// it dropped. Clients such as the OpenAI SDKs may send numbers, booleans or
+// nested values; those are ignored unless strict is set, which rejects them.
+func (p openAIRequestParams) metadata(strict bool) (map[string]string, []string, error) {
+	raw := bytes.TrimSpace(p.Metadata)
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		if strict {
+			return nil, nil, fmt.Errorf("metadata must be an object of string values")
+		}
+		return nil, []string{"metadata"}, nil
+	}
+	if len(fields) > maxRequestMetadata {
+		return nil, nil, fmt.Errorf("metadata has %d keys; at most %d are allowed", len(fields), maxRequestMetadata)
+	}
+	var values map[string]string
+	var dropped []string
+	for key, field := range fields {
+		var value string
+		if err := json.Unmarshal(field, &value); err != nil {
+			if strict {
+				return nil, nil, fmt.Errorf("metadata value for key %q must be a string (strict mode)", truncateForLog(key, 64))
+			}
+			dropped = append(dropped, key)
+			continue
+		}
+		if len(key) > 64 || len(value) > 512 {
+			return nil, nil, fmt.Errorf("metadata key %q exceeds 64 characters or its value exceeds 512", truncateForLog(key, 64))
+		}
+		if values == nil {
+			values = make(map[string]string, len(fields))
+		}
+		values[key] = value
+	}
+	sort.Strings(dropped)
+	return values, dropped, nil
+}
+
+// maxTokens returns the tightest output token limit requested, or 0.
+func (p openAIRequestParams) maxTokens() int {
+	limit := 0
+	for _, v := range []*int{p.MaxTokens, p.MaxCompletionTokens, p.MaxOutputTokens} {
+		if v != nil && (limit == 0 || *v < limit) {
+			limit = *v
+		}
+	}
+	return limit
+}
+
+// ignored lists the sampling parameters that were sent; codex does not
+// take them, so they are accepted and logged.
+func (p openAIRequestParams) ignored() []string {
+	var names []string
+	for _, field := range []struct {
+		name string
+		set  bool
+	}{
+		{"temperature", p.Temperature != nil},
+		{"top_p", p.TopP != nil},
+		{"presence_penalty", p.PresencePenalty != nil},
+		{"frequency_penalty", p.FrequencyPenalty != nil},
+		{"seed", p.Seed != nil},
+		{"tool_choice", len(p.ToolChoice) > 0},
+	} {
+		if field.set {
+			names = append(names, field.name)
+		}
+	}
+	return names
+}
+
+// withRequestParams validates p, logs ignored parameters and records user
+// and metadata on the caller for history and audit. strict rejects
+// metadata values that are not strings instead of dropping them.
+func withRequestParams(ctx context.Context, p openAIRequestParams, strict bool) (context.Context, string, error) {
+	if param, err := p.check(); err != nil {
+		return ctx, param, err
+	}
+	metadata, dropped, err := p.metadata(strict)
+	if err != nil {
+		return ctx, "metadata", err
+	}
+	if len(dropped) > 0 {
+		logRunf(ctx, "ignored non-string metadata: %s", strings.Join(dropped, ", "))
+	}
+	if names := p.ignored(); len(names) > 0 {
+		logRunf(ctx, "accepted and ignored params: %s", strings.Join(names, ", "))
+	}
+	caller := callerFromContext(ctx)
+	caller.User, caller.Metadata = strings.TrimSpace(p.User), metadata
+	return context.WithValue(ctx, callerContextKey{}, caller), "", nil
+}
+
+func (p openAIRequestParams) stopSequences() []string {
+	stop, _ := parseStopSequences(p.Stop)
+	return stop
+}
+
+// parseStopSequences reads stop as a string or up to four strings.
+func parseStopSequences(raw json.RawMessage) ([]string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var one string
+	if err := json.Unmarshal(raw, &one); err == nil {
+		if one == "" {
+			return nil, nil
+		}
+		return []string{one}, nil
+	}
+	var many []string
+	if err := json.Unmarshal(raw, &many); err != nil {
+		return nil, fmt.Errorf("stop must be a string or an array of strings")
+	}
+	if len(many) > maxStopSequences {
+		return nil, fmt.Errorf("stop has %d sequences; at most %d are allowed", len(many), maxStopSequences)
+	}
+	return slices.DeleteFunc(many, func(v string) bool { return v == "" }), nil
+}
+
+// shapeRunOutput cuts content at the first stop sequence, then truncates it
+// to roughly maxTokens tokens. Codex has already run, so this only limits
+// what is returned.
+func shapeRunOutput(content string, opts runOptions) (string, bool) {
+	cut := -1
+	for _, stop := range opts.Stop {
+		if i := strings.Index(content, stop); i >= 0 && (cut < 0 || i < cut) {
+			cut = i
+		}
+	}
+	if cut >= 0 {
+		content = content[:cut]
+	}
+	if opts.MaxTokens <= 0 {
+		return content, false
+	}
+	limit := opts.MaxTokens * approxCharsPerToken
+	if utf8.RuneCountInString(content) <= limit {
+		return content, false
+	}
+	return string([]rune(content)[:limit]), true
+}
+
+// resolveRunModel checks the requested model name against servedModelID
+// and the configured profiles; empty means servedModelID.
+func resolveRunModel(cfg Config, model string) (string, error) {
+	model = strings.TrimSpace(model)
+	if model == "" {
+		return servedModelID, nil
+	}
+	if _, ok := lookupModelProfile(cfg, model); model != servedModelID && !ok {
+		names := []string{servedModelID}
+		for _, p := range cfg.Profiles {
+			names = append(names, p.Name)
+		}
+		return "", fmt.Errorf("unsupported model %q; use one of %s", model, strings.Join(names, ", "))
+	}
+	return model, nil
+}
+
+func respondWithRun(ctx context.Context, w http.ResponseWriter, cfg Config, model, instruction string, opts runOptions) {
+	opts.Model = model
+	if profile, ok := lookupModelProfile(cfg, model); ok {
+		logRunf(ctx, "model profile=%s", profile.Name)
+		cfg = profile.apply(cfg)
+		opts.DryRun = opts.DryRun || profile.DryRun
+	}
+	if opts.DryRun || opts.RequireApproval {
+		respondWithPlan(ctx, w, cfg, model, instruction, opts)
+		return
+	}
+	if opts.ConfirmDestructive {
+		ctx = withDestructiveConfirmed(ctx)
+	}
+	result, entry, err := runRecorded(ctx, cfg, model, instruction)
+	writeRunResult(ctx, w, result, entry, err, opts)
+}
+
+func writeRunResult(ctx context.Context, w http.ResponseWriter, result AutomationResult, entry runHistoryRecord, err error, opts runOptions) {
+	runID := runIDFromContext(ctx)
+	if err != nil {
+		var hold *policyHold
+		if errors.As(err, &hold) {
+			writeJSON(w, http.StatusAccepted, runPlanResponse{
+				Object:    "jgo.run_plan",
+				RunID:     runID,
+				Status:    entry.Status,
+				ExpiresAt: entry.ExpiresAt,
+				Plan:      hold.plan,
+			})
+			return
+		}
+		if errors.Is(err, errServerDraining) || errors.Is(err, errRunInterrupted) {
+			w.Header().Set("Retry-After", "30")
+			opts.writeError(w, http.StatusServiceUnavailable, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID))
+			return
+		}
+		if errors.Is(err, errDestructiveUnconfirmed) {
+			opts.writeError(w, http.StatusConflict, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID))
+			return
+		}
+		if errors.Is(err, errDailyQuota) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(untilNextDay(time.Now())/time.Second)))
+			if opts.Fail == nil {
+				writeJSON(w, http.StatusTooManyRequests, openAIErrorResponse{
+					Error: openAIErrorBody{Message: err.Error(), Type: "insufficient_quota", Code: "rate_limit_exceeded"},
+				})
+				return
+			}
+			opts.writeError(w, http.StatusTooManyRequests, err.Error())
+			return
+		}
+		if !errors.Is(err, errCodexLoginRequired) {
+			opts.writeError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID))
+			return
+		}
+		// A missing codex login is answered as assistant content.
+		result.CodexResponse = entry.Response
+	}
+
+	respond := opts.Respond
+	if respond == nil {
+		respond = writeChatCompletion
+	}
+	out := runOutput{Usage: result.Usage.openAIUsage}
+	if err == nil {
+		var toolErr error
+		result.CodexResponse, out.ToolCalls, toolErr = parseToolCalls(result.CodexResponse, toolSessionFromContext(ctx), runID)
+		if toolErr != nil {
+			logRunf(ctx, "tool calls ignored: %v", toolErr)
+		}
+		if len(out.ToolCalls) > 0 {
+			logRunf(ctx, "tool calls requested: count=%d", len(out.ToolCalls))
+		}
+	}
+	out.Content, out.Truncated = shapeRunOutput(result.CodexResponse, opts)
+	if out.Truncated {
+		logRunf(ctx, "output truncated: max_tokens=%d", opts.MaxTokens)
+	}
+	respond(ctx, w, out, opts)
+}
+
+// runOutput is the content returned for a finished run. Truncated is set
+// when max tokens cut the content; ToolCalls when codex asked the caller to
+// run tools.
+type runOutput struct {
+	Content   string
+	Usage     openAIUsage
+	Truncated bool
+	ToolCalls []chatToolCall
+}
+
+func (out runOutput) finishReason() string {
+	if len(out.ToolCalls) > 0 {
+		return "tool_calls"
+	}
+	if out.Truncated {
+		return "length"
+	}
+	return "stop"
+}
+
+// runResponder writes a run's output in one API's response format.
+type runResponder func(ctx context.Context, w http.ResponseWriter, out runOutput, opts runOptions)
+
+func writeChatCompletion(ctx context.Context, w http.ResponseWriter, out runOutput, opts runOptions) {
+	if opts.Stream {
+		var streamUsage *openAIUsage
+		if opts.IncludeUsage {
+			streamUsage = &out.Usage
+		}
+		if err := writeStreamingChatCompletion(w, opts.model(), out, streamUsage); err != nil {
+			logRunf(ctx, "stream write failed: %v", err)
+		}
+		logRunf(ctx, "request completed: stream=true content_len=%d", len(out.Content))
+		return
+	}
+
+	resp := buildAssistantChatCompletion(opts.model(), out)
+	writeJSON(w, http.StatusOK, resp)
+	logRunf(ctx, "request completed: stream=false content_len=%d", len(out.Content))
+}
+
+// respondWithPlan prepares the run without executing codex. A dry run
+// returns the plan; with requireApproval the plan is held as a pending run
+// until POST /api/runs/{id}/approve or /reject.
+func respondWithPlan(ctx context.Context, w http.ResponseWriter, cfg Config, model, instruction string, opts runOptions) {
+	runID := runIDFromContext(ctx)
+	requireApproval := opts.RequireApproval
+	if draining, _ := serverRuns.state(); draining && requireApproval {
+		w.Header().Set("Retry-After", "30")
+		opts.writeError(w, http.StatusServiceUnavailable, fmt.Sprintf("%s (run_id=%s)", errServerDraining.Error(), runID))
+		return
+	}
+	plan, err := prepareRun(ctx, cfg, instruction)
+	if err != nil {
+		logRunf(ctx, "plan failed: %v", err)
+		opts.writeError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID))
+		return
+	}
+	if !requireApproval {
+		logRunf(ctx, "dry run: returning plan without executing codex")
+		writeJSON(w, http.StatusOK, runPlanResponse{Object: "jgo.run_plan", RunID: runID, Status: "dry_run", Plan: plan})
+		return
+	}
+
+	pendingRunsMu.Lock()
+	if len(pendingRuns) >= maxRunHistorySize {
+		pendingRunsMu.Unlock()
+		opts.writeError(w, http.StatusTooManyRequests, fmt.Sprintf("too many pending runs; approve or reject some first (run_id=%s)", runID))
+		return
+	}
+	pending := &pendingRun{cfg: cfg, model: model, plan: plan, caller: callerFromContext(ctx), status: "pending", createdAt: time.Now()}
+	pending.expiresAt = pending.createdAt.Add(cfg.Policy.ApprovalTimeout)
+	pendingRuns[runID] = pending
+	pendingRunsMu.Unlock()
+
+	appendRunHistory(pendingRunRecord(runID, pending), 0)
+	audit := newAuditEntry(ctx, cfg, "run.held", instruction)
+	audit.Prompt, audit.Outcome, audit.Policy = plan.WorkspacePrompt, pending.status, plan.Policy
+	appendAudit(ctx, cfg, audit)
+	logRunf(ctx, "run pending approval until %s", pending.expiresAt.UTC().Format(time.RFC3339))
+	writeJSON(w, http.StatusAccepted, pendingRunResponse(runID, pending))
+}
+
+// holdRun stores a policy-held run until an approver decides or it expires.
+func holdRun(ctx context.Context, cfg Config, model string, plan runPlan) *pendingRun {
+	pending := &pendingRun{cfg: cfg, model: model, plan: plan, caller: callerFromContext(ctx), status: "awaiting_approval", createdAt: time.Now()}
+	pending.expiresAt = pending.createdAt.Add(cfg.Policy.ApprovalTimeout)
+	pendingRunsMu.Lock()
+	pendingRuns[runIDFromContext(ctx)] = pending
+	pendingRunsMu.Unlock()
+	logRunf(ctx, "run held for approval until %s: %s", pending.expiresAt.UTC().Format(time.RFC3339), strings.Join(plan.Policy, "; "))
+	return pending
+}
+
+func pendingRunRecord(runID string, pending *pendingRun) runHistoryRecord {
+	return runHistoryRecord{
+		RunID:       runID,
+		Model:       pending.model,
+		Instruction: pending.plan.Instruction,
+		Status:      pending.status,
+		Optimizer:   pending.plan.OptimizerProvider,
+		RiskLevel:   pending.plan.RiskLevel,
+		Summary:     pending.plan.Summary,
+		Policy:      pending.plan.Policy,
+		ExpiresAt:   pending.expiresAt.UTC().Format(time.RFC3339),
+		Caller:      pending.caller.Name,
+		User:        pending.caller.User,
+		Metadata:    pending.caller.Metadata,
+	}
+}
+
+func pendingRunResponse(runID string, pending *pendingRun) runPlanResponse {
+	return runPlanResponse{
+		Object:    "jgo.run_plan",
+		RunID:     runID,
+		Status:    pending.status,
+		ExpiresAt: pending.expiresAt.UTC().Format(time.RFC3339),
+		Plan:      pending.plan,
+	}
+}
+
+// expirePendingRuns drops runs whose approval window has passed and records
+// them as "expired".
+func expirePendingRuns(now time.Time) {
+	pendingRunsMu.Lock()
+	expired := make(map[string]*pendingRun)
+	for runID, pending := range pendingRuns {
+		if now.After(pending.expiresAt) {
+			expired[runID] = pending
+			delete(pendingRuns, runID)
+		}
+	}
+	pendingRunsMu.Unlock()
+
+	for runID, pending := range expired {
+		ctx := context.WithValue(context.Background(), runIDContextKey{}, runID)
+		logRunf(ctx, "%s run expired without a decision", pending.status)
+		entry := pendingRunRecord(runID, pending)
+		entry.Status = "expired"
+		entry.Error = fmt.Sprintf("no approval within %s", pending.cfg.Policy.ApprovalTimeout)
+		entry = appendRunHistory(entry, now.Sub(pending.createdAt))
+		audit := newAuditEntry(ctx, pending.cfg, "run.expired", pending.plan.Instruction)
+		audit.Caller, audit.Outcome, audit.Policy, audit.Detail = "jgo", entry.Status, entry.Policy, entry.Error
+		appendAudit(ctx, pending.cfg, audit)
+		notifyWebhooks(ctx, pending.cfg.Webhooks, entry)
+	}
+}
+
+func lookupPendingRun(runID string) (*pendingRun, bool) {
+	pendingRunsMu.Lock()
+	defer pendingRunsMu.Unlock()
+	pending, ok := pendingRuns[runID]
+	return pending, ok
+}
+
+func takePendingRun(runID string) (*pendingRun, bool) {
+	pendingRunsMu.Lock()
+	defer pendingRunsMu.Unlock()
+	pending, ok := pendingRuns[runID]
+	delete(pendingRuns, runID)
+	return pending, ok
+}
+
+func handleRunGet(w http.ResponseWriter, r *http.Request) {
+	expirePendingRuns(time.Now())
+	runID := r.PathValue("id")
+	entry, ok := lookupRunHistory(runID)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("unknown run %q", runID)})
+		return
+	}
+	body := map[string]any{"run": entry}
+	pendingRunsMu.Lock()
+	if pending, ok := pendingRuns[runID]; ok {
+		body["plan"] = pending.plan
+	}
+	pendingRunsMu.Unlock()
+	writeJSON(w, http.StatusOK, body)
+}
+
+func handleRunApprove(w http.ResponseWriter, r *http.Request) {
+	runID := r.PathValue("id")
+	ctx := context.WithValue(r.Context(), runIDContextKey{}, runID)
+	w.Header().Set("X-JGO-Run-ID", runID)
+
+	var req approveRunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("invalid JSON body: %s (run_id=%s)", err.Error(), runID))
+		return
+	}
+	if draining, _ := serverRuns.state(); draining {
+		w.Header().Set("Retry-After", "30")
+		writeOpenAIError(w, http.StatusServiceUnavailable, fmt.Sprintf("%s (run_id=%s)", errServerDraining.Error(), runID))
+		return
+	}
+	expirePendingRuns(time.Now())
+	pending, ok := lookupPendingRun(runID)
+	if !ok {
+		writeOpenAIError(w, http.StatusNotFound, fmt.Sprintf("no pending run %q", runID))
+		return
+	}
+
+	// Checks that fail here leave the run pending so the approver can retry.
+	plan := pending.plan
+	edited := strings.TrimSpace(req.OptimizedPrompt)
+	if edited != "" {
+		var err error
+		if plan, err = editPlanPrompt(pending.cfg.Policy, plan, edited); err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID))
+			return
+		}
+	}
+	if err := plan.unconfirmedRisk(); err != nil && !req.ConfirmDestructive {
+		writeOpenAIError(w, http.StatusConflict, fmt.Sprintf("%s; approve with confirm_destructive (run_id=%s)", err.Error(), runID))
+		return
+	}
+	if pending, ok = takePendingRun(runID); !ok {
+		writeOpenAIError(w, http.StatusNotFound, fmt.Sprintf("no pending run %q", runID))
+		return
+	}
+	approver := callerFromContext(ctx).Name
+	ctx = withApprover(ctx, approver)
+	logRunf(ctx, "%s run approved by %s", pending.status, approver)
+
+	audit := newAuditEntry(ctx, pending.cfg, "run.approved", plan.Instruction)
+	audit.Outcome, audit.Policy = pending.status, plan.Policy
+	var details []string
+	if edited != "" {
+		details = append(details, "approved with edited prompt")
+		logRunf(ctx, "pending run approved with edited prompt: optimized_prompt_len=%d policy=%s", len(edited), strings.Join(plan.Policy, "; "))
+	} else {
+		logRunf(ctx, "pending run approved after %s", time.Since(pending.createdAt).Round(time.Second))
+	}
+	if req.ConfirmDestructive {
+		details = append(details, "destructive confirmed")
+	}
+	audit.Detail = strings.Join(details, "; ")
+	audit.Prompt = plan.WorkspacePrompt
+	appendAudit(ctx, pending.cfg, audit)
+	// The run itself is still attributed to whoever requested it.
+	ctx = context.WithValue(ctx, callerContextKey{}, pending.caller)
+	ctx = withToolSession(ctx, plan.ToolSession)
+	if req.ConfirmDestructive {
+		ctx = withDestructiveConfirmed(ctx)
+	}
+	result, entry, err := runRecordedPlan(ctx, pending.cfg, pending.model, plan.Instruction, &plan)
+	writeRunResult(ctx, w, result, entry, err, runOptions{Stream: req.Stream, Model: pending.model})
+}
+
+func handleRunReject(w http.ResponseWriter, r *http.Request) {
+	runID := r.PathValue("id")
+	ctx := context.WithValue(r.Context(), runIDContextKey{}, runID)
+	w.Header().Set("X-JGO-Run-ID", runID)
+
+	var req rejectRunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("invalid JSON body: %s (run_id=%s)", err.Error(), runID))
+		return
+	}
+	expirePendingRuns(time.Now())
+	pending, ok := takePendingRun(runID)
+	if !ok {
+		writeOpenAIError(w, http.StatusNotFound, fmt.Sprintf("no pending run %q", runID))
+		return
+	}
+	reason := strings.TrimSpace(req.Reason)
+	if reason == "" {
+		reason = "rejected before execution"
+	}
+	writeJSON(w, http.StatusOK, rejectPendingRun(ctx, pending, reason))
+}
+
+// rejectPendingRun records a pending run as rejected by the caller in ctx.
+func rejectPendingRun(ctx context.Context, pending *pendingRun, reason string) runHistoryRecord {
+	runID := runIDFromContext(ctx)
+	approver := callerFromContext(ctx).Name
+	logRunf(ctx, "%s run rejected by %s: %s", pending.status, approver, reason)
+	entry := pendingRunRecord(runID, pending)
+	entry.Status, entry.Error, entry.Approver, entry.ExpiresAt = "rejected", reason, approver, ""
+	entry = appendRunHistory(entry, time.Since(pending.createdAt))
+	audit := newAuditEntry(ctx, pending.cfg, "run.rejected", pending.plan.Instruction)
+	audit.Approver, audit.Outcome, audit.Policy, audit.Detail = approver, entry.Status, entry.Policy, reason
+	appendAudit(ctx, pending.cfg, audit)
+	notifyWebhooks(ctx, pending.cfg.Webhooks, entry)
+	return entry
+}
+
+// mcpProtocolVersions are the MCP revisions jgo speaks, newest first.
+var mcpProtocolVersions = []string{"2025-06-18", "2025-03-26", "2024-11-05"}
+
+var mcpTools = []mcpTool{
+	{
+		Name:        "run_instruction",
+		Description: "Run an infrastructure instruction with codex on the jgo execution target and return codex's answer. Runs are recorded in jgo's run history and audit log.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"instruction":         map[string]any{"type": "string", "description": "What to do, in natural language."},
+				"model":               map[string]any{"type": "string", "description": "jgo or a model profile such as jgo-fast or jgo-k8s."},
+				"dry_run":             map[string]any{"type": "boolean", "description": "Return the plan without running codex."},
+				"confirm_destructive": map[string]any{"type": "boolean", "description": "Allow a plan classified as destructive to run."},
+				"wait":                map[string]any{"type": "boolean", "description": "Wait for the run to finish (default true); false returns the run_id at once."},
+			},
+			"required": []string{"instruction"},
+		},
+	},
+	{
+		Name:        "get_run",
+		Description: "Get a run from jgo's history: status, response, error, usage and policy.",
+		InputSchema: map[string]any{
+			"type":       "object",
+			"properties": map[string]any{"run_id": map[string]any{"type": "string"}},
+			"required":   []string{"run_id"},
+		},
+	},
+	{
+		Name:        "list_runs",
+		Description: "List recent runs, newest first.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"limit":  map[string]any{"type": "integer", "description": "Number of runs (default 20)."},
+				"status": map[string]any{"type": "string", "description": "Only runs with this status, e.g. running, completed, failed, awaiting_approval."},
+			},
+		},
+	},
+	{
+		Name:        "cancel_run",
+		Description: "Cancel a running run, or reject a run waiting for approval.",
+		InputSchema: map[string]any{
+			"type":       "object",
+			"properties": map[string]any{"run_id": map[string]any{"type": "string"}},
+			"required":   []string{"run_id"},
+		},
+	},
+}
+
+// mcpServer answers MCP requests with the run tools. The caller is taken
+// from the request context: the API key over HTTP, the local user on stdio.
+// A stdio server has no approval endpoint, so it cannot hold runs.
+type mcpServer struct {
+	live  *liveConfig
+	stdio bool
+	// background tracks runs started with wait=false.
+	background sync.WaitGroup
+}
+
+// handle answers one JSON-RPC message; notifications get no response.
+func (s *mcpServer) handle(ctx context.Context, req jsonRPCRequest) *jsonRPCResponse {
+	if len(req.ID) == 0 {
+		return nil
+	}
+	resp := &jsonRPCResponse{JSONRPC: "2.0", ID: req.ID}
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+			ClientInfo      struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"clientInfo"`
+		}
+		_ = json.Unmarshal(req.Params, &params)
+		version := mcpProtocolVersions[0]
+		if slices.Contains(mcpProtocolVersions, params.ProtocolVersion) {
+			version = params.ProtocolVersion
+		}
+		log.Printf("mcp client initialized: client=%s/%s protocol=%s caller=%s", params.ClientInfo.Name, params.ClientInfo.Version, version, callerFromContext(ctx).Name)
+		resp.Result = map[string]any{
+			"protocolVersion": version,
+			"capabilities":    map[string]any{"tools": map[string]any{"listChanged": false}},
+			"serverInfo":      map[string]string{"name": "jgo", "version": buildVersion()},
+			"instructions":    "jgo runs infrastructure tasks with codex on a configured host. Use run_instruction to delegate a task, get_run or list_runs to follow runs, cancel_run to stop one.",
+		}
+	case "ping":
+		resp.Result = map[string]any{}
+	case "tools/list":
+		resp.Result = map[string]any{"tools": mcpTools}
+	case "tools/call":
+		var params struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			resp.Error = &jsonRPCError{Code: -32602, Message: fmt.Sprintf("invalid params: %v", err)}
+			return resp
+		}
+		if !slices.ContainsFunc(mcpTools, func(t mcpTool) bool { return t.Name == params.Name }) {
+			resp.Error = &jsonRPCError{Code: -32602, Message: fmt.Sprintf("unknown tool %q", params.Name)}
+			return resp
+		}
+		if len(bytes.TrimSpace(params.Arguments)) == 0 {
+			params.Arguments = json.RawMessage("{}")
+		}
+		resp.Result = s.callTool(ctx, params.Name, params.Arguments)
+	default:
+		resp.Error = &jsonRPCError{Code: -32601, Message: fmt.Sprintf("method not found: %s", req.Method)}
+	}
+	return resp
+}
+
+func (s *mcpServer) callTool(ctx context.Context, name string, rawArgs json.RawMessage) mcpToolResult {
+	var args struct {
+		mcpRunArgs
+		RunID  string `json:"run_id"`
+		Limit  int    `json:"limit"`
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(rawArgs, &args); err != nil {
+		return mcpErrorResult(fmt.Sprintf("invalid arguments: %v", err))
+	}
+	switch name {
+	case "run_instruction":
+		return s.runInstruction(ctx, args.mcpRunArgs)
+	case "list_runs":
+		expirePendingRuns(time.Now())
+		items := snapshotRunHistory(maxRunHistorySize)
+		if status := strings.TrimSpace(args.Status); status != "" {
+			items = slices.DeleteFunc(items, func(item runHistoryRecord) bool { return item.Status != status })
+		}
+		limit := args.Limit
+		if limit <= 0 {
+			limit = 20
+		}
+		items = items[:min(limit, len(items))]
+		return mcpJSONResult(map[string]any{"total": len(items), "items": items})
+	}
+	runID := strings.TrimSpace(args.RunID)
+	if runID == "" {
+		return mcpErrorResult("run_id is required")
+	}
+	ctx = context.WithValue(ctx, runIDContextKey{}, runID)
+	if name == "get_run" {
+		expirePendingRuns(time.Now())
+		entry, ok := lookupRunHistory(runID)
+		if !ok {
+			return mcpErrorResult(fmt.Sprintf("run %q not found", runID))
+		}
+		return mcpJSONResult(entry)
+	}
+	// cancel_run: callers cancel their own runs unless they hold "*", and
+	// rejecting a run waiting for approval also takes the approve scope.
+	cfg := s.live.Load()
+	caller := callerFromContext(ctx)
+	expirePendingRuns(time.Now())
+	entry, ok := lookupRunHistory(runID)
+	if !ok {
+		return mcpErrorResult(fmt.Sprintf("run %q not found", runID))
+	}
+	if entry.Caller != caller.Name && !callerHasScope(cfg, caller, "*") {
+		logRunf(ctx, "run cancel denied: caller=%s owner=%s", caller.Name, entry.Caller)
+		return mcpErrorResult(fmt.Sprintf("run %q was started by another caller; cancelling it needs the \"*\" scope", runID))
+	}
+	switch entry.Status {
+	case "pending", "awaiting_approval":
+		if !callerHasScope(cfg, caller, scopeApprove) {
+			logRunf(ctx, "run reject denied: caller=%s lacks scope %q", caller.Name, scopeApprove)
+			return mcpErrorResult(fmt.Sprintf("run %q is waiting for approval; rejecting it needs the %q scope", runID, scopeApprove))
+		}
+		if pending, ok := takePendingRun(runID); ok {
+			return mcpJSONResult(rejectPendingRun(ctx, pending, "cancelled via MCP"))
+		}
+	case "running":
+		if serverRuns.cancel(runID) {
+			logRunf(ctx, "run cancel requested by %s", caller.Name)
+			return mcpJSONResult(map[string]string{"run_id": runID, "status": "cancelling"})
+		}
+	}
+	return mcpErrorResult(fmt.Sprintf("run %q is not running or pending", runID))
+}
+
+// callerHasScope reports whether caller holds scope. Without API keys
+// every caller may do everything, as on the HTTP API.
+func callerHasScope(cfg Config, caller callerIdentity, scope string) bool {
+	if len(cfg.APIKeys) == 0 {
+		return true
+	}
+	return slices.Contains(caller.Scopes, scope) || slices.Contains(caller.Scopes, "*")
+}
+
+// record runs instruction. Over stdio a policy hold is rejected at once:
+// nothing in this process could approve it, so it would wait until expiry.
+func (s *mcpServer) record(ctx context.Context, cfg Config, model, instruction string) (AutomationResult, runHistoryRecord, error) {
+	result, entry, err := runRecorded(ctx, cfg, model, instruction)
+	var hold *policyHold
+	if !s.stdio || !errors.As(err, &hold) {
+		return result, entry, err
 	}
+	reason := "policy approval is not available over MCP stdio"
+	if pending, ok := takePendingRun(runIDFromContext(ctx)); ok {
+		entry = rejectPendingRun(context.WithValue(ctx, callerContextKey{}, callerIdentity{Name: "jgo"}), pending, reason)
+	}
+	return result, entry, fmt.Errorf("run needs approval (%s) but %s; send it to a jgo server instead", strings.Join(hold.plan.Policy, "; "), reason)
+}
 
-	for _, candidate := range candidates {
-		if candidate == "" {
+// runInstruction starts a run like /v1/chat/completions does. Over HTTP it
+// takes from the caller's rate limits; stdio runs are local like jgo exec.
+func (s *mcpServer) runInstruction(ctx context.Context, args mcpRunArgs) mcpToolResult {
+	cfg := s.live.Load()
+	instruction := strings.TrimSpace(args.Instruction)
+	if instruction == "" {
+		return mcpErrorResult("instruction is required")
+	}
+	model, err := resolveRunModel(cfg, args.Model)
+	if err != nil {
+		return mcpErrorResult(err.Error())
+	}
+	if caller := callerFromContext(ctx); caller.Remote != "" {
+		ipWindow, keyWindow := rateLimitWindows(cfg, caller)
+		if denied, retry, _ := limiter.take(time.Now(), ipWindow, keyWindow); denied != nil {
+			return mcpErrorResult(fmt.Sprintf("rate limit reached for %s; retry in %s", denied.id, retry.Round(time.Second)))
+		}
+	}
+	runID := nextRunID()
+	ctx = context.WithValue(ctx, runIDContextKey{}, runID)
+	dryRun := args.DryRun
+	if profile, ok := lookupModelProfile(cfg, model); ok {
+		logRunf(ctx, "model profile=%s", profile.Name)
+		cfg = profile.apply(cfg)
+		dryRun = dryRun || profile.DryRun
+	}
+	logRunf(ctx, "incoming mcp run: model=%q dry_run=%t instruction_preview=%q", model, dryRun, truncateForLog(instruction, 160))
+	if dryRun {
+		plan, err := prepareRun(ctx, cfg, instruction)
+		if err != nil {
+			return mcpErrorResult(fmt.Sprintf("%s (run_id=%s)", err.Error(), runID))
+		}
+		return mcpJSONResult(runPlanResponse{Object: "jgo.run_plan", RunID: runID, Status: "dry_run", Plan: plan})
+	}
+	if args.ConfirmDestructive {
+		ctx = withDestructiveConfirmed(ctx)
+	}
+	if args.Wait != nil && !*args.Wait {
+		s.background.Add(1)
+		go func() {
+			defer s.background.Done()
+			s.record(context.WithoutCancel(ctx), cfg, model, instruction)
+		}()
+		return mcpJSONResult(map[string]string{"run_id": runID, "status": "accepted"})
+	}
+
+	result, entry, err := s.record(ctx, cfg, model, instruction)
+	var hold *policyHold
+	switch {
+	case errors.As(err, &hold):
+		out := mcpJSONResult(entry)
+		out.Content[0].Text = fmt.Sprintf("run %s is awaiting approval (%s); approve it with jgo runs approve %s\n\n%s", runID, strings.Join(hold.plan.Policy, "; "), runID, out.Content[0].Text)
+		return out
+	case err != nil:
+		out := mcpErrorResult(fmt.Sprintf("%s (run_id=%s)", err.Error(), runID))
+		out.StructuredContent = entry
+		return out
+	}
+	return mcpToolResult{Content: []mcpContent{{Type: "text", Text: result.CodexResponse}}, StructuredContent: entry}
+}
+
+func mcpJSONResult(v any) mcpToolResult {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return mcpErrorResult(fmt.Sprintf("encode result: %v", err))
+	}
+	return mcpToolResult{Content: []mcpContent{{Type: "text", Text: string(data)}}, StructuredContent: v}
+}
+
+func mcpErrorResult(message string) mcpToolResult {
+	return mcpToolResult{Content: []mcpContent{{Type: "text", Text: message}}, IsError: true}
+}
+
+// serveStdio reads one JSON-RPC message per line and writes responses as
+// they finish, so cancel_run and notifications/cancelled can reach a run
+// that is still going. It returns once in is closed and calls are done.
+func (s *mcpServer) serveStdio(ctx context.Context, in io.Reader, out io.Writer) error {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		inflight = make(map[string]context.CancelFunc)
+	)
+	enc := json.NewEncoder(out)
+	write := func(resp *jsonRPCResponse) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := enc.Encode(resp); err != nil {
+			log.Printf("mcp write failed: %v", err)
+		}
+	}
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64<<10), maxMCPMessageBytes)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
 			continue
 		}
-		info, err := os.Stat(candidate)
-		if err != nil || !info.IsDir() {
+		var req jsonRPCRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			write(&jsonRPCResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &jsonRPCError{Code: -32700, Message: fmt.Sprintf("parse error: %v", err)}})
 			continue
 		}
-		return candidate
+		if req.Method == "notifications/cancelled" {
+			var params struct {
+				RequestID json.RawMessage `json:"requestId"`
+			}
+			_ = json.Unmarshal(req.Params, &params)
+			mu.Lock()
+			if cancel, ok := inflight[string(params.RequestID)]; ok {
+				cancel()
+			}
+			mu.Unlock()
+			continue
+		}
+		reqCtx, cancel := context.WithCancel(ctx)
+		key := string(req.ID)
+		mu.Lock()
+		inflight[key] = cancel
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := s.handle(reqCtx, req)
+			mu.Lock()
+			delete(inflight, key)
+			mu.Unlock()
+			cancel()
+			if resp != nil {
+				write(resp)
+			}
+		}()
 	}
-	return ""
+	// Calls in flight and runs started with wait=false keep going after the
+	// client hangs up, for the drain timeout like a server shutdown; then
+	// they are cancelled and recorded as interrupted.
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		s.background.Wait()
+		close(done)
+	}()
+	drainTimeout := s.live.Load().DrainTimeout
+	select {
+	case <-done:
+	case <-time.After(drainTimeout):
+		cancelled := serverRuns.cancelAll()
+		log.Printf("mcp input closed: drain timeout %s reached; cancelled %d run(s)", drainTimeout, cancelled)
+		select {
+		case <-done:
+		case <-time.After(interruptGrace):
+			log.Printf("mcp input closed: cancelled runs did not exit within %s", interruptGrace)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read mcp input: %w", err)
+	}
+	return nil
 }
 
-func handleChatCompletions(cfg Config) http.HandlerFunc {
+// handleMCP serves MCP over streamable HTTP without sessions: each POST
+// carries one JSON-RPC message and gets a JSON response. There is no
+// server-initiated stream, so only POST is allowed.
+func handleMCP(server *mcpServer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		runID := nextRunID()
-		ctx := context.WithValue(r.Context(), runIDContextKey{}, runID)
-		w.Header().Set("X-JGO-Run-ID", runID)
-
-		var req openAIChatCompletionRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			logRunf(ctx, "request rejected: invalid JSON body: %v", err)
-			writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("invalid JSON body: %s (run_id=%s)", err.Error(), runID))
+		var req jsonRPCRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxMCPMessageBytes)).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, jsonRPCResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &jsonRPCError{Code: -32700, Message: fmt.Sprintf("parse error: %v", err)}})
+			return
+		}
+		resp := server.handle(r.Context(), req)
+		if resp == nil {
+			w.WriteHeader(http.StatusAccepted)
 			return
 		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
 
-		logRunf(
-			ctx,
-			"incoming chat request: path=%s method=%s model=%q stream=%t messages=%d remote=%s",
-			r.URL.Path,
-			r.Method,
-			strings.TrimSpace(req.Model),
-			req.Stream,
-			len(req.Messages),
-			r.RemoteAddr,
-		)
+func buildVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "dev"
+}
 
-		instruction := extractInstructionFromMessages(req.Messages)
-		if instruction == "" {
-			logRunf(ctx, "request rejected: missing user instruction in messages")
-			writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("missing user instruction in messages (run_id=%s)", runID))
+func runRecorded(ctx context.Context, cfg Config, model, instruction string) (AutomationResult, runHistoryRecord, error) {
+	return runRecordedPlan(ctx, cfg, model, instruction, nil)
+}
+
+func runRecordedPlan(ctx context.Context, cfg Config, model, instruction string, plan *runPlan) (AutomationResult, runHistoryRecord, error) {
+	runID := runIDFromContext(ctx)
+	start := time.Now()
+
+	ctx, release, ok := serverRuns.begin(ctx, runID)
+	if !ok {
+		logRunf(ctx, "run rejected: %v", errServerDraining)
+		return AutomationResult{}, runHistoryRecord{}, errServerDraining
+	}
+	defer release()
+	caller := callerFromContext(ctx)
+	// An approved plan was charged when it was first submitted.
+	if caller.Metered && plan == nil {
+		_, window := rateLimitWindows(cfg, caller)
+		if err := limiter.chargeRun(time.Now(), window); err != nil {
+			logRunf(ctx, "run rejected: caller=%s: %v", caller.Name, err)
+			return AutomationResult{}, runHistoryRecord{}, err
+		}
+	}
+	entry := runHistoryRecord{RunID: runID, Model: model, Instruction: instruction, Status: "running", Caller: caller.Name, User: caller.User, Metadata: caller.Metadata}
+	appendRunHistory(entry, 0)
+	appendAudit(ctx, cfg, newAuditEntry(ctx, cfg, "run.started", instruction))
+
+	result, err := executeRun(ctx, cfg, instruction, plan)
+	entry.Optimizer, entry.RiskLevel, entry.Summary = result.OptimizerProvider, result.RiskLevel, result.Summary
+	entry.CodexThread = result.CodexThread
+	if result.Usage.TotalTokens > 0 {
+		entry.Usage = &result.Usage
+	}
+	entry.Approver = approverFromContext(ctx)
+	if plan != nil {
+		entry.Policy = plan.Policy
+	}
+	var hold *policyHold
+	switch {
+	case errors.As(err, &hold):
+		pending := holdRun(ctx, cfg, model, hold.plan)
+		entry = pendingRunRecord(runID, pending)
+	case err != nil && errors.Is(context.Cause(ctx), errRunCancelled):
+		logRunf(ctx, "automation cancelled: %v", err)
+		err = fmt.Errorf("%w: %v", errRunCancelled, err)
+		entry.Status, entry.Error = "cancelled", err.Error()
+	case err != nil && errors.Is(context.Cause(ctx), errRunInterrupted):
+		logRunf(ctx, "automation interrupted: %v", err)
+		err = fmt.Errorf("%w: %v", errRunInterrupted, err)
+		entry.Status, entry.Error = "interrupted", err.Error()
+	case err == nil:
+		entry.Status, entry.Response = "completed", result.CodexResponse
+	case errors.Is(err, errCodexLoginRequired):
+		logRunf(ctx, "automation blocked detail: %v", err)
+		logRunf(ctx, "automation blocked: %s", codexLoginRequiredMessage)
+		entry.Status, entry.Response = "blocked", codexLoginRequiredMessage
+	case errors.Is(err, errDestructiveUnconfirmed), errors.Is(err, errRequiredCLIMissing):
+		logRunf(ctx, "automation blocked: %v", err)
+		entry.Status, entry.Error = "blocked", err.Error()
+	case errors.Is(err, errRunTimeout):
+		logRunf(ctx, "automation timed out: %v", err)
+		entry.Status, entry.Error = "timeout", err.Error()
+	default:
+		logRunf(ctx, "automation failed: %v", err)
+		entry.Status, entry.Error = "failed", err.Error()
+	}
+	entry = appendRunHistory(entry, time.Since(start))
+	audit := newAuditEntry(ctx, cfg, "run.finished", instruction)
+	audit.Prompt, audit.Outcome, audit.Policy, audit.Detail = result.Prompt, entry.Status, entry.Policy, entry.Error
+	if hold != nil {
+		audit.Event, audit.Prompt = "run.held", hold.plan.WorkspacePrompt
+	}
+	appendAudit(ctx, cfg, audit)
+	notifyWebhooks(ctx, cfg.Webhooks, entry)
+	return result, entry, err
+}
+
+func handleGitHubWebhook(live *liveConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := live.Load()
+		if cfg.GitHub.WebhookSecret == "" {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "github webhook is not configured"})
 			return
 		}
-		logRunf(ctx, "instruction preview=%q", truncateForLog(instruction, 160))
-		runModel := strings.TrimSpace(req.Model)
-		if runModel == "" {
-			runModel = servedModelID
-		}
-		if runModel != servedModelID {
-			logRunf(ctx, "request rejected: unsupported model=%q", runModel)
-			writeOpenAIError(
-				w,
-				http.StatusBadRequest,
-				fmt.Sprintf("unsupported model %q; use %q (run_id=%s)", runModel, servedModelID, runID),
-			)
+		body, err := io.ReadAll(io.LimitReader(r.Body, 5<<20))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("read body: %v", err)})
+			return
+		}
+		if !verifyGitHubSignature(cfg.GitHub.WebhookSecret, body, r.Header.Get("X-Hub-Signature-256")) {
+			log.Printf("github webhook rejected: invalid signature delivery=%s remote=%s", r.Header.Get("X-GitHub-Delivery"), r.RemoteAddr)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid signature"})
 			return
 		}
 
-		start := time.Now()
-
-		result, err := runAutomation(ctx, cfg, instruction)
-		if err != nil {
-			if errors.Is(err, errCodexLoginRequired) {
-				msg := "codex가 로그인되어 있지 않습니다. 먼저 `codex login`을 실행한 뒤 다시 요청하세요."
-				logRunf(ctx, "automation blocked detail: %v", err)
-				logRunf(ctx, "automation blocked: %s", msg)
-				appendRunHistory(runID, runModel, instruction, "blocked", msg, "", time.Since(start))
-				if req.Stream {
-					if streamErr := writeStreamingChatCompletion(w, servedModelID, msg); streamErr != nil {
-						logRunf(ctx, "stream write failed: %v", streamErr)
-					}
-					return
-				}
-				writeJSON(w, http.StatusOK, buildAssistantChatCompletion(servedModelID, msg))
-				return
-			}
-			logRunf(ctx, "automation failed: %v", err)
-			appendRunHistory(runID, runModel, instruction, "failed", "", err.Error(), time.Since(start))
-			writeOpenAIError(w, http.StatusBadRequest, fmt.Sprintf("%s (run_id=%s)", err.Error(), runID))
+		eventName := r.Header.Get("X-GitHub-Event")
+		if eventName == "ping" {
+			writeJSON(w, http.StatusOK, map[string]string{"status": "pong"})
+			return
+		}
+		var event githubWebhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid JSON body: %v", err)})
+			return
+		}
+		req, reason := parseGitHubRunRequest(cfg.GitHub, eventName, event)
+		if reason != "" {
+			writeJSON(w, http.StatusOK, map[string]string{"status": "ignored", "reason": reason})
 			return
 		}
 
-		content := result.CodexResponse
-		appendRunHistory(runID, runModel, instruction, "completed", content, "", time.Since(start))
-		if req.Stream {
-			if err := writeStreamingChatCompletion(w, servedModelID, content); err != nil {
-				logRunf(ctx, "stream write failed: %v", err)
-			}
-			logRunf(ctx, "request completed: stream=true content_len=%d", len(content))
+		if draining, _ := serverRuns.state(); draining {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": errServerDraining.Error()})
+			return
+		}
+		if !claimGitHubDelivery(r.Header.Get("X-GitHub-Delivery")) {
+			writeJSON(w, http.StatusOK, map[string]string{"status": "ignored", "reason": "duplicate delivery"})
 			return
 		}
+		runID := nextRunID()
+		ctx := context.WithValue(context.Background(), runIDContextKey{}, runID)
+		ctx = context.WithValue(ctx, callerContextKey{}, callerIdentity{Name: "github:" + req.Author, Remote: r.RemoteAddr})
+		w.Header().Set("X-JGO-Run-ID", runID)
+		logRunf(
+			ctx,
+			"incoming github request: event=%s delivery=%s repo=%s %s=%d author=%s association=%s",
+			eventName,
+			r.Header.Get("X-GitHub-Delivery"),
+			req.Repo,
+			req.Kind,
+			req.Number,
+			req.Author,
+			req.Association,
+		)
+		instruction := buildGitHubInstruction(cfg.GitHub, req, runID)
+		go runRecorded(ctx, cfg, servedModelID, instruction)
 
-		resp := buildAssistantChatCompletion(servedModelID, content)
-		writeJSON(w, http.StatusOK, resp)
-		logRunf(ctx, "request completed: stream=false content_len=%d", len(content))
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "accepted", "run_id": runID})
+	}
+}
+
+// claimGitHubDelivery records a webhook delivery ID and reports whether it
+// was new, so GitHub redeliveries of the same event do not start a second
+// run. The last maxGitHubDeliveries IDs are kept in memory.
+func claimGitHubDelivery(id string) bool {
+	if id == "" {
+		return true
+	}
+
+	githubDeliveriesMu.Lock()
+	defer githubDeliveriesMu.Unlock()
+	if githubDeliveries[id] {
+		return false
+	}
+	githubDeliveries[id] = true
+	githubDeliveryOrder = append(githubDeliveryOrder, id)
+	if len(githubDeliveryOrder) > maxGitHubDeliveries {
+		evicted := githubDeliveryOrder[:len(githubDeliveryOrder)-maxGitHubDeliveries]
+		githubDeliveryOrder = githubDeliveryOrder[len(evicted):]
+		for _, old := range evicted {
+			delete(githubDeliveries, old)
+		}
+	}
+	return true
+}
+
+func verifyGitHubSignature(secret string, body []byte, header string) bool {
+	got, ok := strings.CutPrefix(strings.TrimSpace(header), "sha256=")
+	if !ok {
+		return false
+	}
+	gotMAC, err := hex.DecodeString(got)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(gotMAC, mac.Sum(nil))
+}
+
+func parseGitHubRunRequest(cfg GitHubConfig, eventName string, event githubWebhookEvent) (githubRunRequest, string) {
+	req := githubRunRequest{Repo: event.Repository.FullName}
+	switch eventName {
+	case "issue_comment":
+		if event.Action != "created" || event.Comment == nil || event.Issue == nil {
+			return req, "unsupported issue_comment action"
+		}
+		req.Kind = "issue"
+		if len(event.Issue.PullRequest) > 0 && string(event.Issue.PullRequest) != "null" {
+			req.Kind = "pull_request"
+		}
+		req.Number = event.Issue.Number
+		req.URL = event.Comment.HTMLURL
+		req.Author = event.Comment.User.Login
+		req.Association = event.Comment.AuthorAssociation
+		req.Text = event.Comment.Body
+	default:
+		return req, fmt.Sprintf("unsupported event %q", eventName)
+	}
+
+	if strings.Contains(req.Text, githubReplyMarker) || strings.EqualFold(event.Sender.Type, "Bot") {
+		return req, "comment posted by jgo or a bot"
+	}
+	command, ok := extractGitHubTriggerCommand(req.Text, cfg.Trigger)
+	if !ok {
+		return req, "trigger not found"
+	}
+	allowed := false
+	for _, association := range cfg.AllowedAssociation {
+		if strings.EqualFold(association, req.Association) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return req, fmt.Sprintf("author association %q is not allowed", req.Association)
+	}
+	req.Command = command
+	return req, ""
+}
+
+func extractGitHubTriggerCommand(text, trigger string) (string, bool) {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		rest, ok := strings.CutPrefix(strings.TrimSpace(line), trigger)
+		if !ok || (rest != "" && rest[0] != ' ' && rest[0] != '\t') {
+			continue
+		}
+		parts := append([]string{strings.TrimSpace(rest)}, lines[i+1:]...)
+		return strings.TrimSpace(strings.Join(parts, "\n")), true
+	}
+	return "", false
+}
+
+func buildGitHubInstruction(cfg GitHubConfig, req githubRunRequest, runID string) string {
+	kind := "issue"
+	if req.Kind == "pull_request" {
+		kind = "pull request"
+	}
+	command := req.Command
+	if command == "" {
+		command = "Handle the request described in the comment below."
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "GitHub request from @%s on %s %s #%d (%s).\n", req.Author, req.Repo, kind, req.Number, req.URL)
+	fmt.Fprintf(&b, "Repository: %s\n", req.Repo)
+	fmt.Fprintf(&b, "Number: %d\n\n", req.Number)
+	fmt.Fprintf(&b, "Task:\n%s\n\n", command)
+	fmt.Fprintf(&b, "Full comment text:\n%s\n", strings.TrimSpace(req.Text))
+	if cfg.Reply {
+		fmt.Fprintf(
+			&b,
+			"\nWhen finished, post a concise result summary back with `gh issue comment %d --repo %s --body-file <file>`. The comment body must start with the line `%s %s -->`.\n",
+			req.Number,
+			req.Repo,
+			githubReplyMarker,
+			runID,
+		)
 	}
+	return b.String()
 }
 
-func buildAssistantChatCompletion(model, content string) openAIChatCompletionResponse {
+func buildAssistantChatCompletion(model string, out runOutput) openAIChatCompletionResponse {
 	resp := openAIChatCompletionResponse{
 		ID:      "chatcmpl-" + time.Now().UTC().Format("20060102150405"),
 		Object:  "chat.completion",
 		Created: time.Now().Unix(),
 		Model:   model,
-		Usage: openAIUsage{
-			PromptTokens:     0,
-			CompletionTokens: 0,
-			TotalTokens:      0,
-		},
+		Usage:   out.Usage,
 	}
 	resp.Choices = []struct {
-		Index        int         `json:"index"`
-		Message      chatMessage `json:"message"`
-		FinishReason string      `json:"finish_reason"`
+		Index        int                   `json:"index"`
+		Message      chatCompletionMessage `json:"message"`
+		FinishReason string                `json:"finish_reason"`
 	}{
 		{
 			Index:        0,
-			Message:      chatMessage{Role: "assistant", Content: content},
-			FinishReason: "stop",
+			Message:      chatCompletionMessage{Role: "assistant", Content: out.Content, ToolCalls: out.ToolCalls},
+			FinishReason: out.finishReason(),
 		},
 	}
 	return resp
 }
 
-func writeStreamingChatCompletion(w http.ResponseWriter, model, content string) error {
+// buildResponse renders a Responses API object; a nil out is a response
+// still in progress. Output cut by max_output_tokens is "incomplete".
+func buildResponse(runID, model string, out *runOutput) openAIResponse {
+	resp := openAIResponse{
+		ID:        "resp_" + runID,
+		Object:    "response",
+		CreatedAt: time.Now().Unix(),
+		Status:    "in_progress",
+		Model:     model,
+		Output:    []responsesOutputItem{},
+	}
+	if out == nil {
+		return resp
+	}
+	resp.Status = out.responseStatus()
+	if out.Truncated {
+		resp.IncompleteDetails = &responsesIncompleteDetails{Reason: "max_output_tokens"}
+	}
+	resp.Output = append(resp.Output, responsesMessageItem(runID, out))
+	resp.OutputText = out.Content
+	u := &responsesUsage{InputTokens: out.Usage.PromptTokens, OutputTokens: out.Usage.CompletionTokens, TotalTokens: out.Usage.TotalTokens}
+	if out.Usage.PromptTokensDetails != nil {
+		u.InputTokensDetails.CachedTokens = out.Usage.PromptTokensDetails.CachedTokens
+	}
+	resp.Usage = u
+	return resp
+}
+
+func (out runOutput) responseStatus() string {
+	if out.Truncated {
+		return "incomplete"
+	}
+	return "completed"
+}
+
+func responsesMessageItem(runID string, out *runOutput) responsesOutputItem {
+	item := responsesOutputItem{Type: "message", ID: "msg_" + runID, Status: "in_progress", Role: "assistant", Content: []responsesContentPart{}}
+	if out != nil {
+		item.Status = out.responseStatus()
+		item.Content = append(item.Content, responsesContentPart{Type: "output_text", Text: out.Content, Annotations: []any{}})
+	}
+	return item
+}
+
+func writeResponsesResult(ctx context.Context, w http.ResponseWriter, out runOutput, opts runOptions) {
+	runID := runIDFromContext(ctx)
+	if !opts.Stream {
+		writeJSON(w, http.StatusOK, buildResponse(runID, opts.model(), &out))
+		logRunf(ctx, "request completed: stream=false content_len=%d", len(out.Content))
+		return
+	}
+	if err := writeStreamingResponse(w, runID, opts.model(), out); err != nil {
+		logRunf(ctx, "stream write failed: %v", err)
+	}
+	logRunf(ctx, "request completed: stream=true content_len=%d", len(out.Content))
+}
+
+// writeStreamingResponse sends the Responses API event sequence for one
+// output_text part, ending in response.completed or response.incomplete.
+func writeStreamingResponse(w http.ResponseWriter, runID, model string, out runOutput) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("streaming is not supported by this server")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	itemID := "msg_" + runID
+	part := responsesContentPart{Type: "output_text", Text: "", Annotations: []any{}}
+	donePart := part
+	donePart.Text = out.Content
+	events := []struct {
+		name    string
+		payload map[string]any
+	}{
+		{"response.created", map[string]any{"response": buildResponse(runID, model, nil)}},
+		{"response.in_progress", map[string]any{"response": buildResponse(runID, model, nil)}},
+		{"response.output_item.added", map[string]any{"output_index": 0, "item": responsesMessageItem(runID, nil)}},
+		{"response.content_part.added", map[string]any{"item_id": itemID, "output_index": 0, "content_index": 0, "part": part}},
+		{"response.output_text.delta", map[string]any{"item_id": itemID, "output_index": 0, "content_index": 0, "delta": out.Content}},
+		{"response.output_text.done", map[string]any{"item_id": itemID, "output_index": 0, "content_index": 0, "text": out.Content}},
+		{"response.content_part.done", map[string]any{"item_id": itemID, "output_index": 0, "content_index": 0, "part": donePart}},
+		{"response.output_item.done", map[string]any{"output_index": 0, "item": responsesMessageItem(runID, &out)}},
+		{"response." + out.responseStatus(), map[string]any{"response": buildResponse(runID, model, &out)}},
+	}
+	for i, event := range events {
+		event.payload["type"] = event.name
+		event.payload["sequence_number"] = i
+		if err := writeSSEEvent(w, flusher, event.name, event.payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeCompletionResult(ctx context.Context, w http.ResponseWriter, out runOutput, opts runOptions) {
+	runID := runIDFromContext(ctx)
+	if opts.Stream {
+		var streamUsage *openAIUsage
+		if opts.IncludeUsage {
+			streamUsage = &out.Usage
+		}
+		if err := writeStreamingCompletion(w, runID, opts.model(), out.Content, out.finishReason(), streamUsage); err != nil {
+			logRunf(ctx, "stream write failed: %v", err)
+		}
+		logRunf(ctx, "request completed: stream=true content_len=%d", len(out.Content))
+		return
+	}
+
+	finishReason := out.finishReason()
+	writeJSON(w, http.StatusOK, openAICompletionResponse{
+		ID:      "cmpl-" + runID,
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   opts.model(),
+		Choices: []completionChoice{{Text: out.Content, FinishReason: &finishReason}},
+		Usage:   &out.Usage,
+	})
+	logRunf(ctx, "request completed: stream=false content_len=%d", len(out.Content))
+}
+
+// writeStreamingCompletion sends content as one text_completion chunk, a
+// finish chunk, an optional usage chunk and [DONE].
+func writeStreamingCompletion(w http.ResponseWriter, runID, model, content, finishReason string, usage *openAIUsage) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("streaming is not supported by this server")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	chunk := openAICompletionResponse{ID: "cmpl-" + runID, Object: "text_completion", Created: time.Now().Unix(), Model: model}
+	chunks := [][]completionChoice{
+		{{Text: content}},
+		{{FinishReason: &finishReason}},
+	}
+	if usage != nil {
+		chunks = append(chunks, []completionChoice{})
+	}
+	for i, choices := range chunks {
+		chunk.Choices = choices
+		if i == 2 {
+			chunk.Usage = usage
+		}
+		payload, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", payload); err != nil {
+			return err
+		}
+		flusher.Flush()
+	}
+	if _, err := fmt.Fprint(w, "data: [DONE]\n\n"); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
+
+func buildAnthropicMessage(runID, model string, content []anthropicContentBlock, stopReason *string, usage openAIUsage) anthropicMessageResponse {
+	cached := 0
+	if usage.PromptTokensDetails != nil {
+		cached = usage.PromptTokensDetails.CachedTokens
+	}
+	return anthropicMessageResponse{
+		ID:         "msg_" + runID,
+		Type:       "message",
+		Role:       "assistant",
+		Model:      model,
+		Content:    content,
+		StopReason: stopReason,
+		Usage: anthropicUsage{
+			InputTokens:          max(0, usage.PromptTokens-cached),
+			OutputTokens:         usage.CompletionTokens,
+			CacheReadInputTokens: cached,
+		},
+	}
+}
+
+func writeMessagesResult(ctx context.Context, w http.ResponseWriter, out runOutput, opts runOptions) {
+	runID := runIDFromContext(ctx)
+	if !opts.Stream {
+		stopReason := "end_turn"
+		writeJSON(w, http.StatusOK, buildAnthropicMessage(runID, opts.model(), []anthropicContentBlock{{Type: "text", Text: out.Content}}, &stopReason, out.Usage))
+		logRunf(ctx, "request completed: stream=false content_len=%d", len(out.Content))
+		return
+	}
+	if err := writeStreamingMessage(w, runID, opts.model(), out.Content, out.Usage); err != nil {
+		logRunf(ctx, "stream write failed: %v", err)
+	}
+	logRunf(ctx, "request completed: stream=true content_len=%d", len(out.Content))
+}
+
+// writeStreamingMessage sends the Anthropic Messages event sequence for one
+// text block holding content.
+func writeStreamingMessage(w http.ResponseWriter, runID, model, content string, usage openAIUsage) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("streaming is not supported by this server")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	start := buildAnthropicMessage(runID, model, []anthropicContentBlock{}, nil, usage)
+	start.Usage.OutputTokens = 0
+	events := []struct {
+		name    string
+		payload map[string]any
+	}{
+		{"message_start", map[string]any{"message": start}},
+		{"content_block_start", map[string]any{"index": 0, "content_block": anthropicContentBlock{Type: "text"}}},
+		{"ping", map[string]any{}},
+		{"content_block_delta", map[string]any{"index": 0, "delta": map[string]string{"type": "text_delta", "text": content}}},
+		{"content_block_stop", map[string]any{"index": 0}},
+		{"message_delta", map[string]any{"delta": map[string]any{"stop_reason": "end_turn", "stop_sequence": nil}, "usage": map[string]int{"output_tokens": usage.CompletionTokens}}},
+		{"message_stop", map[string]any{}},
+	}
+	for _, event := range events {
+		event.payload["type"] = event.name
+		if err := writeSSEEvent(w, flusher, event.name, event.payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeStreamingChatCompletion sends content as one chunk. A non-nil usage
+// is sent in a final chunk with no choices, as for stream_options.include_usage.
+func writeStreamingChatCompletion(w http.ResponseWriter, model string, out runOutput, usage *openAIUsage) error {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		return fmt.Errorf("streaming is not supported by this server")
@@ -692,13 +7339,44 @@ func writeStreamingChatCompletion(w http.ResponseWriter, model, content string)
 	if err := writeSSEChunk(w, flusher, chatID, created, model, chatMessageDelta{Role: "assistant"}, nil); err != nil {
 		return err
 	}
-	if err := writeSSEChunk(w, flusher, chatID, created, model, chatMessageDelta{Content: content}, nil); err != nil {
-		return err
+	if out.Content != "" || len(out.ToolCalls) == 0 {
+		if err := writeSSEChunk(w, flusher, chatID, created, model, chatMessageDelta{Content: out.Content}, nil); err != nil {
+			return err
+		}
+	}
+	if len(out.ToolCalls) > 0 {
+		calls := slices.Clone(out.ToolCalls)
+		for i := range calls {
+			calls[i].Index = &i
+		}
+		if err := writeSSEChunk(w, flusher, chatID, created, model, chatMessageDelta{ToolCalls: calls}, nil); err != nil {
+			return err
+		}
 	}
-	finishReason := "stop"
+	finishReason := out.finishReason()
 	if err := writeSSEChunk(w, flusher, chatID, created, model, chatMessageDelta{}, &finishReason); err != nil {
 		return err
 	}
+	if usage != nil {
+		payload, err := json.Marshal(openAIChatCompletionChunkResponse{
+			ID:      chatID,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   model,
+			Choices: []struct {
+				Index        int              `json:"index"`
+				Delta        chatMessageDelta `json:"delta"`
+				FinishReason *string          `json:"finish_reason"`
+			}{},
+			Usage: usage,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", payload); err != nil {
+			return err
+		}
+	}
 
 	if _, err := fmt.Fprint(w, "data: [DONE]\n\n"); err != nil {
 		return err
@@ -737,7 +7415,7 @@ func writeSSEChunk(w http.ResponseWriter, flusher http.Flusher, chatID string, c
 	return nil
 }
 
-func handleModels() http.HandlerFunc {
+func handleModels(live *liveConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, _ *http.Request) {
 		resp := openAIModelsResponse{
 			Object: "list",
@@ -750,6 +7428,9 @@ func handleModels() http.HandlerFunc {
 				},
 			},
 		}
+		for _, profile := range live.Load().Profiles {
+			resp.Data = append(resp.Data, openAIModel{ID: profile.Name, Object: "model", OwnedBy: "jgo", Description: profile.Description})
+		}
 		writeJSON(w, http.StatusOK, resp)
 	}
 }
@@ -761,16 +7442,410 @@ func writeMethodNotAllowed(w http.ResponseWriter, allowMethod string) {
 	})
 }
 
-func extractInstructionFromMessages(messages []chatMessage) string {
+// extractInstructionFromMessages returns the text of the last user message
+// with text, and the content parts that came with it.
+func extractInstructionFromMessages(messages []chatRequestMessage) (string, []chatContentPart) {
 	for i := len(messages) - 1; i >= 0; i-- {
 		if strings.EqualFold(strings.TrimSpace(messages[i].Role), "user") {
-			content := strings.TrimSpace(messages[i].Content)
+			content := strings.TrimSpace(messages[i].Content.Text)
 			if content != "" {
-				return content
+				return content, messages[i].Content.Parts
 			}
 		}
 	}
-	return ""
+	return "", nil
+}
+
+// collectAttachments turns image and file parts into run attachments. Data
+// URLs are decoded; http(s) image URLs are kept as references.
+func collectAttachments(parts []chatContentPart) ([]runAttachment, error) {
+	var attachments []runAttachment
+	for _, part := range parts {
+		var att runAttachment
+		switch part.Type {
+		case "text":
+			continue
+		case "image_url":
+			if part.ImageURL == nil || strings.TrimSpace(part.ImageURL.URL) == "" {
+				return nil, fmt.Errorf("image_url part needs image_url.url")
+			}
+			raw := strings.TrimSpace(part.ImageURL.URL)
+			if strings.HasPrefix(raw, "http://") || strings.HasPrefix(raw, "https://") {
+				att.URL = raw
+				break
+			}
+			mediaType, data, err := parseDataURL(raw)
+			if err != nil {
+				return nil, fmt.Errorf("image_url: %w", err)
+			}
+			att.Name, att.Data, att.Image = "image"+attachmentExt(mediaType), data, true
+		case "file":
+			if part.File == nil || (part.File.FileData == "" && part.File.FileID == "") {
+				return nil, fmt.Errorf("file part needs file.file_data")
+			}
+			if part.File.FileData == "" {
+				return nil, fmt.Errorf("file_id %q is not supported; send file_data", part.File.FileID)
+			}
+			mediaType, data, err := parseDataURL(part.File.FileData)
+			if err != nil {
+				return nil, fmt.Errorf("file %q: %w", part.File.Filename, err)
+			}
+			att.Name, att.Data = sanitizeAttachmentName(part.File.Filename), data
+			if att.Name == "" {
+				att.Name = "file" + attachmentExt(mediaType)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported content part type %q", part.Type)
+		}
+		if len(att.Data) > maxAttachmentBytes {
+			return nil, fmt.Errorf("attachment %s is %d bytes; the limit is %d", att.Name, len(att.Data), maxAttachmentBytes)
+		}
+		if att.Name != "" {
+			att.Name = fmt.Sprintf("%d-%s", len(attachments)+1, att.Name)
+		}
+		attachments = append(attachments, att)
+		if len(attachments) > maxAttachments {
+			return nil, fmt.Errorf("too many attachments; at most %d are allowed", maxAttachments)
+		}
+	}
+	return attachments, nil
+}
+
+// parseDataURL decodes a base64 data URL ("data:<type>;base64,<data>").
+func parseDataURL(raw string) (string, []byte, error) {
+	meta, payload, ok := strings.Cut(strings.TrimPrefix(raw, "data:"), ",")
+	if !ok || !strings.HasPrefix(raw, "data:") || !strings.HasSuffix(meta, ";base64") {
+		return "", nil, fmt.Errorf("expected a base64 data URL or an http(s) URL")
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid base64 data: %w", err)
+	}
+	return strings.TrimSuffix(meta, ";base64"), data, nil
+}
+
+func attachmentExt(mediaType string) string {
+	switch strings.ToLower(mediaType) {
+	case "image/png":
+		return ".png"
+	case "image/jpeg", "image/jpg":
+		return ".jpg"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	case "application/pdf":
+		return ".pdf"
+	case "text/plain":
+		return ".txt"
+	}
+	return ".bin"
+}
+
+func sanitizeAttachmentName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(strings.TrimSpace(name), "\\", "/"))
+	if name == "." || name == "/" {
+		return ""
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == '-' || r == '_' || (r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r))) {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// runAttachmentsDir is where a run's attachments are written on the
+// execution target while codex runs.
+func runAttachmentsDir(ctx context.Context) string {
+	return filepath.Join(cacheRootDir, "attachments", runIDFromContext(ctx))
+}
+
+// attachmentRefs returns where codex finds the attachments once they are
+// saved: files and image URLs for the workspace prompt, and image paths
+// for --image. Nothing is written, so dry runs and held runs leave no files.
+func attachmentRefs(ctx context.Context, cfg Config, attachments []runAttachment) ([]string, []string) {
+	dir := runAttachmentsDir(ctx)
+	var refs, images []string
+	for _, att := range attachments {
+		if att.URL != "" {
+			refs = append(refs, att.URL)
+			continue
+		}
+		path := filepath.Join(dir, att.Name)
+		if cfg.ExecTransport != transportSSH {
+			if abs, err := filepath.Abs(path); err == nil {
+				path = abs
+			}
+		}
+		if att.Image {
+			images = append(images, path)
+		} else {
+			refs = append(refs, path)
+		}
+	}
+	return refs, images
+}
+
+// saveRunAttachments writes attachments under .jgo-cache/attachments/<run_id>
+// on the execution target. The returned func removes them again and is
+// called when the run finishes.
+func saveRunAttachments(ctx context.Context, cfg Config, attachments []runAttachment) (func(), error) {
+	dir := runAttachmentsDir(ctx)
+	remove := func() {
+		// The run context may be cancelled already; cleanup still runs.
+		cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		if err := removeRunAttachments(cleanupCtx, cfg, dir); err != nil {
+			logRunf(ctx, "attachments cleanup failed: %v", err)
+			return
+		}
+		logRunf(ctx, "attachments removed: target=%s", formatExecutionTarget(cfg))
+	}
+	saved := 0
+	for _, att := range attachments {
+		if att.URL != "" {
+			continue
+		}
+		path := filepath.Join(dir, att.Name)
+		if cfg.ExecTransport == transportSSH {
+			if err := uploadSSHFile(ctx, cfg, path, att.Data); err != nil {
+				remove()
+				return nil, err
+			}
+			saved++
+			continue
+		}
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("create attachments dir: %w", err)
+		}
+		if err := os.WriteFile(path, att.Data, 0o600); err != nil {
+			remove()
+			return nil, fmt.Errorf("save attachment %s: %w", att.Name, err)
+		}
+		saved++
+	}
+	if saved == 0 {
+		return func() {}, nil
+	}
+	logRunf(ctx, "attachments saved: count=%d target=%s", saved, formatExecutionTarget(cfg))
+	return remove, nil
+}
+
+// removeRunAttachments deletes a run's attachments dir on the execution target.
+func removeRunAttachments(ctx context.Context, cfg Config, dir string) error {
+	if cfg.ExecTransport != transportSSH {
+		return os.RemoveAll(dir)
+	}
+	cmd := exec.CommandContext(ctx, "ssh", buildSSHArgs(cfg, "rm -rf "+shellQuote(dir))...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("remove %s: %w: %s", dir, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// uploadSSHFile copies data to path (relative to the remote home) over ssh.
+func uploadSSHFile(ctx context.Context, cfg Config, path string, data []byte) error {
+	command := fmt.Sprintf("mkdir -p %s && cat > %s", shellQuote(filepath.Dir(path)), shellQuote(path))
+	cmd := exec.CommandContext(ctx, "ssh", buildSSHArgs(cfg, command)...)
+	cmd.Stdin = bytes.NewReader(data)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("upload attachment %s: %w: %s", path, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// newToolSession validates the caller tools of a chat request and applies
+// tool_choice: "none" hides them, "required" or a named function makes a
+// call mandatory. The returned param names the offending field.
+func newToolSession(tools []chatTool, choice json.RawMessage, parallel *bool) (*toolSession, string, error) {
+	if len(tools) > maxChatTools {
+		return nil, "tools", fmt.Errorf("tools has %d entries; at most %d are allowed", len(tools), maxChatTools)
+	}
+	seen := make(map[string]bool, len(tools))
+	for i, tool := range tools {
+		if tool.Type != "function" {
+			return nil, "tools", fmt.Errorf("tools[%d].type %q is not supported; use function", i, tool.Type)
+		}
+		name := tool.Function.Name
+		if !toolNamePattern.MatchString(name) {
+			return nil, "tools", fmt.Errorf("tools[%d].function.name %q must be 1-64 letters, digits, '_' or '-'", i, name)
+		}
+		if seen[name] {
+			return nil, "tools", fmt.Errorf("tools[%d].function.name %q is duplicated", i, name)
+		}
+		seen[name] = true
+	}
+	session := &toolSession{Tools: tools, Single: parallel != nil && !*parallel}
+	choice = bytes.TrimSpace(choice)
+	if len(choice) == 0 || string(choice) == "null" {
+		return session, "", nil
+	}
+	var mode string
+	if err := json.Unmarshal(choice, &mode); err != nil {
+		var named struct {
+			Type     string `json:"type"`
+			Function struct {
+				Name string `json:"name"`
+			} `json:"function"`
+		}
+		if err := json.Unmarshal(choice, &named); err != nil || named.Type != "function" {
+			return nil, "tool_choice", fmt.Errorf("tool_choice must be none, auto, required or a function")
+		}
+		i := slices.IndexFunc(tools, func(t chatTool) bool { return t.Function.Name == named.Function.Name })
+		if i < 0 {
+			return nil, "tool_choice", fmt.Errorf("tool_choice names unknown function %q", named.Function.Name)
+		}
+		session.Tools, session.Required = tools[i:i+1], true
+		return session, "", nil
+	}
+	switch mode {
+	case "none":
+		session.Tools = nil
+	case "auto":
+	case "required":
+		if len(tools) == 0 {
+			return nil, "tool_choice", fmt.Errorf("tool_choice required needs tools")
+		}
+		session.Required = true
+	default:
+		return nil, "tool_choice", fmt.Errorf("tool_choice must be none, auto, required or a function")
+	}
+	return session, "", nil
+}
+
+// takeResults reads the tool messages that end a chat request and returns
+// the instruction that continues the run, or "" when there are none. The
+// codex thread to resume is found through the run ID in the tool call IDs;
+// only the caller that started that run may resume it.
+func (s *toolSession) takeResults(ctx context.Context, messages []chatRequestMessage) (string, error) {
+	start := len(messages)
+	for start > 0 && strings.EqualFold(strings.TrimSpace(messages[start-1].Role), "tool") {
+		start--
+	}
+	if start == len(messages) {
+		return "", nil
+	}
+	if start == 0 || len(messages[start-1].ToolCalls) == 0 {
+		return "", fmt.Errorf("tool messages must follow an assistant message with tool_calls")
+	}
+	calls := messages[start-1].ToolCalls
+	var results strings.Builder
+	for _, msg := range messages[start:] {
+		i := slices.IndexFunc(calls, func(call chatToolCall) bool { return call.ID == msg.ToolCallID })
+		if i < 0 {
+			return "", fmt.Errorf("tool_call_id %q does not match a tool call of the preceding assistant message", msg.ToolCallID)
+		}
+		fmt.Fprintf(&results, "\n[%s] %s(%s):\n%s\n", calls[i].ID, calls[i].Function.Name, calls[i].Function.Arguments, strings.TrimSpace(msg.Content.Text))
+	}
+	runID := toolCallRunID(calls[0].ID)
+	entry, ok := lookupRunHistory(runID)
+	caller := callerFromContext(ctx).Name
+	switch {
+	case !ok:
+		logRunf(ctx, "tool results rejected: run %q is not in history", runID)
+	case entry.Caller != caller:
+		logRunf(ctx, "tool results rejected: run %q belongs to caller %q, not %q", runID, entry.Caller, caller)
+	case entry.CodexThread == "":
+		logRunf(ctx, "tool results rejected: run %q recorded no codex thread", runID)
+	default:
+		s.Results, s.Thread = true, entry.CodexThread
+		return "Results of the caller tools you called:\n" + results.String() + "\nContinue the request with these results.", nil
+	}
+	return "", fmt.Errorf("run %q cannot be resumed", runID)
+}
+
+// toolCallID ties a tool call to its run so the results can resume it.
+func toolCallID(runID string, n int) string {
+	return fmt.Sprintf("call_%s_%d", runID, n)
+}
+
+func toolCallRunID(id string) string {
+	rest, ok := strings.CutPrefix(id, "call_")
+	i := strings.LastIndex(rest, "_")
+	if !ok || i < 0 {
+		return ""
+	}
+	return rest[:i]
+}
+
+// buildToolsPrompt describes the caller tools and the <tool_calls> block
+// codex ends its answer with to call them.
+func buildToolsPrompt(session *toolSession) string {
+	if session == nil || len(session.Tools) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\nCaller tools (functions the caller runs outside this environment):\n")
+	for _, tool := range session.Tools {
+		b.WriteString("- " + tool.Function.Name)
+		if description := strings.TrimSpace(tool.Function.Description); description != "" {
+			b.WriteString(": " + description)
+		}
+		if params := bytes.TrimSpace(tool.Function.Parameters); len(params) > 0 {
+			var compact bytes.Buffer
+			if json.Compact(&compact, params) == nil {
+				params = compact.Bytes()
+			}
+			fmt.Fprintf(&b, "\n  parameters (JSON Schema): %s", params)
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("To call caller tools, stop and end your final message with this block, with arguments matching the parameters:\n")
+	b.WriteString(toolCallsOpenTag + "\n[{\"name\": \"<tool name>\", \"arguments\": {}}]\n" + toolCallsCloseTag + "\n")
+	b.WriteString("The results come back in the next message; then continue the request.\n")
+	if session.Required {
+		b.WriteString("You must call at least one caller tool before giving a final answer.\n")
+	} else {
+		b.WriteString("Only call a caller tool when the request needs it.\n")
+	}
+	if session.Single {
+		b.WriteString("Call at most one caller tool per message.\n")
+	}
+	return b.String()
+}
+
+// parseToolCalls splits the trailing <tool_calls> block off codex's answer.
+// A malformed block or an unknown tool leaves the content unchanged.
+func parseToolCalls(content string, session *toolSession, runID string) (string, []chatToolCall, error) {
+	start := strings.LastIndex(content, toolCallsOpenTag)
+	if session == nil || len(session.Tools) == 0 || start < 0 {
+		return content, nil, nil
+	}
+	body, _, ok := strings.Cut(content[start+len(toolCallsOpenTag):], toolCallsCloseTag)
+	if !ok {
+		return content, nil, fmt.Errorf("unterminated %s block", toolCallsOpenTag)
+	}
+	var requested []struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(body)), &requested); err != nil {
+		return content, nil, fmt.Errorf("decode tool calls: %w", err)
+	}
+	if len(requested) == 0 {
+		return content, nil, fmt.Errorf("empty %s block", toolCallsOpenTag)
+	}
+	if session.Single {
+		requested = requested[:1]
+	}
+	calls := make([]chatToolCall, 0, len(requested))
+	for i, call := range requested {
+		if !slices.ContainsFunc(session.Tools, func(t chatTool) bool { return t.Function.Name == call.Name }) {
+			return content, nil, fmt.Errorf("unknown tool %q", call.Name)
+		}
+		var args string
+		if json.Unmarshal(call.Arguments, &args) != nil {
+			var compact bytes.Buffer
+			if json.Compact(&compact, call.Arguments) != nil || compact.String() == "null" {
+				compact.Reset()
+				compact.WriteString("{}")
+			}
+			args = compact.String()
+		}
+		calls = append(calls, chatToolCall{ID: toolCallID(runID, i+1), Type: "function", Function: chatFunctionCall{Name: call.Name, Arguments: args}})
+	}
+	return strings.TrimSpace(content[:start]), calls, nil
 }
 
 func writeOpenAIError(w http.ResponseWriter, status int, message string) {
@@ -782,6 +7857,40 @@ func writeOpenAIError(w http.ResponseWriter, status int, message string) {
 	})
 }
 
+func writeOpenAIParamError(w http.ResponseWriter, status int, message, param string) {
+	writeJSON(w, status, openAIErrorResponse{
+		Error: openAIErrorBody{
+			Message: message,
+			Type:    "invalid_request_error",
+			Param:   param,
+		},
+	})
+}
+
+// writeAnthropicError writes the Anthropic error shape, mapping the HTTP
+// status to its error type.
+func writeAnthropicError(w http.ResponseWriter, status int, message string) {
+	errType := "api_error"
+	switch status {
+	case http.StatusBadRequest, http.StatusConflict:
+		errType = "invalid_request_error"
+	case http.StatusUnauthorized:
+		errType = "authentication_error"
+	case http.StatusForbidden:
+		errType = "permission_error"
+	case http.StatusNotFound:
+		errType = "not_found_error"
+	case http.StatusTooManyRequests:
+		errType = "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		errType = "overloaded_error"
+	}
+	writeJSON(w, status, anthropicErrorResponse{
+		Type:  "error",
+		Error: anthropicErrorBody{Type: errType, Message: message},
+	})
+}
+
 func writeJSON(w http.ResponseWriter, status int, payload any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -795,8 +7904,68 @@ func nextRunID() string {
 	return fmt.Sprintf("run-%s-%06d", time.Now().UTC().Format("20060102T150405.000"), n)
 }
 
-func logRunf(ctx context.Context, format string, args ...any) {
+func runIDFromContext(ctx context.Context) string {
 	runID, _ := ctx.Value(runIDContextKey{}).(string)
+	return runID
+}
+
+// withAttachments carries the request's files to executeRun, which writes
+// them out only once codex is about to start.
+func withAttachments(ctx context.Context, attachments []runAttachment) context.Context {
+	if len(attachments) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, attachmentsContextKey{}, attachments)
+}
+
+func attachmentsFromContext(ctx context.Context) []runAttachment {
+	attachments, _ := ctx.Value(attachmentsContextKey{}).([]runAttachment)
+	return attachments
+}
+
+func withToolSession(ctx context.Context, session *toolSession) context.Context {
+	if session == nil || (len(session.Tools) == 0 && !session.Results) {
+		return ctx
+	}
+	return context.WithValue(ctx, toolSessionContextKey{}, session)
+}
+
+func toolSessionFromContext(ctx context.Context) *toolSession {
+	session, _ := ctx.Value(toolSessionContextKey{}).(*toolSession)
+	return session
+}
+
+// withDestructiveConfirmed marks the run as explicitly confirmed by the
+// caller, allowing plans classified as destructive to execute.
+func withDestructiveConfirmed(ctx context.Context) context.Context {
+	return context.WithValue(ctx, confirmDestructiveContextKey{}, true)
+}
+
+// withApprover records who approved the run; approved runs skip the policy
+// hold and the approver is kept in run history.
+func withApprover(ctx context.Context, approver string) context.Context {
+	return context.WithValue(ctx, approverContextKey{}, approver)
+}
+
+func approverFromContext(ctx context.Context) string {
+	approver, _ := ctx.Value(approverContextKey{}).(string)
+	return approver
+}
+
+func callerFromContext(ctx context.Context) callerIdentity {
+	if caller, ok := ctx.Value(callerContextKey{}).(callerIdentity); ok {
+		return caller
+	}
+	return callerIdentity{Name: "anonymous"}
+}
+
+func destructiveConfirmed(ctx context.Context) bool {
+	confirmed, _ := ctx.Value(confirmDestructiveContextKey{}).(bool)
+	return confirmed
+}
+
+func logRunf(ctx context.Context, format string, args ...any) {
+	runID := runIDFromContext(ctx)
 	if runID == "" {
 		log.Printf(format, args...)
 		return
@@ -836,83 +8005,391 @@ func sanitizeURL(raw string) string {
 }
 
 func runAutomation(ctx context.Context, cfg Config, instruction string) (AutomationResult, error) {
-	logRunf(ctx, "automation start")
+	return executeRun(ctx, cfg, instruction, nil)
+}
+
+// prepareRun resolves the CLI list and the (optionally optimized) prompt
+// without starting codex. It is the "plan" half of runAutomation.
+func prepareRun(ctx context.Context, cfg Config, instruction string) (runPlan, error) {
 	if err := validateExecutionConfig(&cfg); err != nil {
-		return AutomationResult{}, err
+		return runPlan{}, err
 	}
 	envMap := environToMap(os.Environ())
 	applyProviderFallbacks(envMap)
-	availableCLIs := resolveAvailableCLIs(envMap, cfg.CodexBin)
+	availableCLIs := resolveAvailableCLIs(envMap, cfg.CodexBin, cfg.AvailableCLIs)
+	if len(cfg.CLIAllowlist) > 0 {
+		availableCLIs = slices.DeleteFunc(availableCLIs, func(name string) bool { return !slices.Contains(cfg.CLIAllowlist, name) })
+	}
 	logRunf(ctx, "available_clis=%s", strings.Join(availableCLIs, ", "))
+	session := toolSessionFromContext(ctx)
+	if session != nil && session.Results && cfg.OptimizePrompt {
+		// Tool results go to codex as they are.
+		logRunf(ctx, "stage=prompt_optimize skipped: request carries tool results")
+		cfg.OptimizePrompt = false
+	}
 	logRunf(ctx, "prompt_optimize_enabled=%t", cfg.OptimizePrompt)
 
-	optimizedPrompt := strings.TrimSpace(instruction)
+	plan := runPlan{
+		Instruction:     strings.TrimSpace(instruction),
+		OptimizedPrompt: strings.TrimSpace(instruction),
+		AvailableCLIs:   availableCLIs,
+		ToolSession:     session,
+	}
 	if cfg.OptimizePrompt {
-		openaiCfg, err := loadOpenAIConfig(envMap)
+		providers, err := resolveOptimizerProviders(ctx, envMap, cfg)
+		if err != nil {
+			return runPlan{}, err
+		}
+		for _, provider := range providers {
+			logRunf(
+				ctx,
+				"openai config loaded: provider=%s base_url=%s model=%s timeout=%s api_key_set=%t",
+				provider.Name,
+				sanitizeURL(provider.BaseURL),
+				provider.Model,
+				provider.Timeout,
+				strings.TrimSpace(provider.APIKey) != "",
+			)
+		}
+
+		logRunf(ctx, "stage=prompt_optimize start")
+		optimized, providerName, err := optimizePrompt(ctx, providers, instruction, availableCLIs)
+		if err != nil && cfg.OptimizerPolicy.FallbackToRaw && ctx.Err() == nil {
+			logRunf(ctx, "stage=prompt_optimize failed, falling back to raw instruction: %v", err)
+			optimized, providerName, err = RequestPlan{OptimizedPrompt: instruction}, "raw-fallback", nil
+		}
 		if err != nil {
-			return AutomationResult{}, err
+			return runPlan{}, wrapRunTimeout(ctx, cfg, fmt.Errorf("prompt optimize: %w", err))
+		}
+		plan.OptimizerProvider = providerName
+		if strings.TrimSpace(optimized.OptimizedPrompt) != "" {
+			plan.OptimizedPrompt = strings.TrimSpace(optimized.OptimizedPrompt)
+		}
+		plan.RiskLevel = optimized.RiskLevel
+		plan.TargetSystems = optimized.TargetSystems
+		plan.RequiredCLIs = optimized.RequiredCLIs
+		plan.Summary = optimized.Summary
+		if optimized.Usage.TotalTokens > 0 {
+			plan.OptimizerUsage = &optimized.Usage
 		}
 		logRunf(
 			ctx,
-			"openai config loaded: base_url=%s model=%s api_key_set=%t",
-			sanitizeURL(openaiCfg.BaseURL),
-			openaiCfg.Model,
-			strings.TrimSpace(openaiCfg.APIKey) != "",
+			"stage=prompt_optimize done: provider=%s optimized_prompt_len=%d risk_level=%s target_systems=%s required_clis=%s",
+			providerName,
+			len(plan.OptimizedPrompt),
+			valueOrUnknown(plan.RiskLevel),
+			strings.Join(plan.TargetSystems, ","),
+			strings.Join(plan.RequiredCLIs, ","),
 		)
+		if missing := missingCLIs(plan.RequiredCLIs, availableCLIs); len(missing) > 0 {
+			return plan, fmt.Errorf("%w: %s (available: %s)", errRequiredCLIMissing, strings.Join(missing, ", "), strings.Join(availableCLIs, ", "))
+		}
+	} else {
+		logRunf(ctx, "stage=prompt_optimize skipped: enabled=false")
+	}
+	if attachments := attachmentsFromContext(ctx); len(attachments) > 0 {
+		plan.attachments = attachments
+		plan.Attachments, plan.Images = attachmentRefs(ctx, cfg, attachments)
+	}
+	plan.WorkspacePrompt = plan.workspacePrompt()
+	plan.Policy = evaluatePolicy(cfg.Policy, plan)
+	return plan, nil
+}
 
-		logRunf(ctx, "stage=prompt_optimize start")
-		plan, err := analyzeRequest(ctx, openaiCfg, instruction, availableCLIs)
+// workspacePrompt renders the prompt codex runs. A resumed codex thread
+// already has the workspace instructions, so it only gets the request.
+func (plan runPlan) workspacePrompt() string {
+	tools := buildToolsPrompt(plan.ToolSession)
+	if plan.ToolSession != nil && plan.ToolSession.Thread != "" {
+		return plan.OptimizedPrompt + "\n" + tools
+	}
+	prompt := buildWorkspacePrompt(plan.OptimizedPrompt, plan.AvailableCLIs, plan.Attachments)
+	if tools != "" {
+		prompt = strings.TrimSpace(prompt) + "\n" + tools
+	}
+	return prompt
+}
+
+// unconfirmedRisk returns errDestructiveUnconfirmed when plan may only run
+// with confirm_destructive. The optimizer always classifies risk, so a plan
+// it handled without a risk level (raw fallback) is unclassified and gated
+// like a destructive one.
+func (plan runPlan) unconfirmedRisk() error {
+	switch {
+	case plan.RiskLevel == riskDestructive:
+		return fmt.Errorf("%w: %s", errDestructiveUnconfirmed, valueOrUnknown(plan.Summary))
+	case plan.RiskLevel == "" && plan.OptimizerProvider != "":
+		return fmt.Errorf("%w: risk level unknown (optimizer provider %s)", errDestructiveUnconfirmed, plan.OptimizerProvider)
+	}
+	return nil
+}
+
+// editPlanPrompt replaces plan's optimized prompt with an approver's edit.
+// The optimizer's risk level and summary described the old prompt, so an
+// optimized plan becomes unclassified; CLIs the new prompt names must be
+// available, and policy is evaluated again so the record shows what the
+// approver signed off on.
+func editPlanPrompt(policy PolicyConfig, plan runPlan, prompt string) (runPlan, error) {
+	plan.OptimizedPrompt = prompt
+	if plan.OptimizerProvider != "" {
+		plan.RiskLevel, plan.Summary = "", ""
+	}
+	lower := strings.ToLower(prompt)
+	required := slices.Clone(plan.RequiredCLIs)
+	for _, cli := range detectedCLIs {
+		if containsWord(lower, cli) && !slices.Contains(required, cli) {
+			required = append(required, cli)
+		}
+	}
+	plan.RequiredCLIs = required
+	if missing := missingCLIs(plan.RequiredCLIs, plan.AvailableCLIs); len(missing) > 0 {
+		return plan, fmt.Errorf("%w: %s (available: %s)", errRequiredCLIMissing, strings.Join(missing, ", "), strings.Join(plan.AvailableCLIs, ", "))
+	}
+	plan.WorkspacePrompt = plan.workspacePrompt()
+	plan.Policy = evaluatePolicy(policy, plan)
+	return plan, nil
+}
+
+// evaluatePolicy returns why plan needs a human approver before codex runs;
+// nil means it may run unattended. The prod-kubectl rule is built in.
+func evaluatePolicy(policy PolicyConfig, plan runPlan) []string {
+	text := plan.Instruction + "\n" + plan.OptimizedPrompt
+	lower := strings.ToLower(text)
+	var reasons []string
+	if ns := prodKubectlChange(policy.ProdNamespaces, plan, lower); ns != "" {
+		reasons = append(reasons, fmt.Sprintf("prod-kubectl: kubectl change in namespace %q", ns))
+	}
+	for _, rule := range policy.Rules {
+		if matched, ok := matchPolicyRule(rule, plan, text, lower); ok {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", rule.Name, strings.Join(matched, ", ")))
+		}
+	}
+	return reasons
+}
+
+// prodKubectlChange returns the production namespace a kubectl change
+// targets. Without a planner risk level any kubectl mutation verb counts.
+func prodKubectlChange(prodNamespaces []string, plan runPlan, lower string) string {
+	usesKubectl := containsWord(lower, "kubectl") || slices.Contains(plan.RequiredCLIs, "kubectl") || slices.Contains(plan.TargetSystems, "k8s")
+	if !usesKubectl {
+		return ""
+	}
+	switch plan.RiskLevel {
+	case riskReadOnly:
+		return ""
+	case "":
+		if !kubectlChangePattern.MatchString(lower) {
+			return ""
+		}
+	}
+	for _, ns := range prodNamespaces {
+		if containsWord(lower, strings.ToLower(ns)) {
+			return ns
+		}
+	}
+	return ""
+}
+
+// matchPolicyRule reports whether every condition rule sets matches, with a
+// description of what matched.
+func matchPolicyRule(rule PolicyRule, plan runPlan, text, lower string) ([]string, bool) {
+	var matched []string
+	if len(rule.Keywords) > 0 {
+		i := slices.IndexFunc(rule.Keywords, func(k string) bool { return strings.Contains(lower, k) })
+		if i < 0 {
+			return nil, false
+		}
+		matched = append(matched, fmt.Sprintf("keyword %q", rule.Keywords[i]))
+	}
+	if rule.Pattern != "" {
+		// A rule that never went through validatePolicyRule has no compiled
+		// pattern; hold the run rather than let the condition pass silently.
+		if rule.re != nil && !rule.re.MatchString(text) {
+			return nil, false
+		}
+		matched = append(matched, fmt.Sprintf("pattern %q", rule.Pattern))
+	}
+	if len(rule.RiskLevels) > 0 {
+		level := valueOrUnknown(plan.RiskLevel)
+		if !slices.Contains(rule.RiskLevels, level) {
+			return nil, false
+		}
+		matched = append(matched, "risk "+level)
+	}
+	if len(rule.Namespaces) > 0 {
+		i := slices.IndexFunc(rule.Namespaces, func(ns string) bool { return containsWord(lower, ns) })
+		if i < 0 {
+			return nil, false
+		}
+		matched = append(matched, fmt.Sprintf("namespace %q", rule.Namespaces[i]))
+	}
+	if len(rule.Repos) > 0 {
+		repo := ""
+		for _, ref := range repoRefPattern.FindAllString(lower, -1) {
+			if slices.ContainsFunc(rule.Repos, func(pattern string) bool {
+				ok, _ := filepath.Match(pattern, ref)
+				return ok
+			}) {
+				repo = ref
+				break
+			}
+		}
+		if repo == "" {
+			return nil, false
+		}
+		matched = append(matched, fmt.Sprintf("repo %q", repo))
+	}
+	if len(rule.CLIs) > 0 {
+		i := slices.IndexFunc(rule.CLIs, func(cli string) bool {
+			return slices.Contains(plan.RequiredCLIs, cli) || containsWord(lower, cli)
+		})
+		if i < 0 {
+			return nil, false
+		}
+		matched = append(matched, fmt.Sprintf("cli %q", rule.CLIs[i]))
+	}
+	return matched, true
+}
+
+// containsWord reports whether word appears in text delimited by characters
+// that cannot be part of a name (letters, digits, '-' and '_').
+func containsWord(text, word string) bool {
+	if word == "" {
+		return false
+	}
+	isName := func(r rune) bool {
+		return r == '-' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+	}
+	for offset := 0; ; {
+		i := strings.Index(text[offset:], word)
+		if i < 0 {
+			return false
+		}
+		start, end := offset+i, offset+i+len(word)
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if (start == 0 || !isName(before)) && (end == len(text) || !isName(after)) {
+			return true
+		}
+		offset = start + 1
+	}
+}
+
+// executeRun runs codex for instruction. A nil plan is prepared first; an
+// approved plan is executed as-is.
+func executeRun(ctx context.Context, cfg Config, instruction string, plan *runPlan) (AutomationResult, error) {
+	logRunf(ctx, "automation start")
+	beginRunStream(runIDFromContext(ctx))
+	if cfg.RunTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.RunTimeout)
+		defer cancel()
+		logRunf(ctx, "run_timeout=%s", cfg.RunTimeout)
+	}
+	if err := validateExecutionConfig(&cfg); err != nil {
+		return AutomationResult{}, err
+	}
+	if plan == nil {
+		prepared, err := prepareRun(ctx, cfg, instruction)
 		if err != nil {
-			return AutomationResult{}, fmt.Errorf("prompt optimize: %w", err)
+			return AutomationResult{OptimizerProvider: prepared.OptimizerProvider, RiskLevel: prepared.RiskLevel, Summary: prepared.Summary, Usage: newRunUsage(openAIUsage{}, prepared.OptimizerUsage)}, err
 		}
-		if strings.TrimSpace(plan.OptimizedPrompt) != "" {
-			optimizedPrompt = strings.TrimSpace(plan.OptimizedPrompt)
+		if len(prepared.Policy) > 0 {
+			if approverFromContext(ctx) == "" {
+				return AutomationResult{OptimizerProvider: prepared.OptimizerProvider, RiskLevel: prepared.RiskLevel, Summary: prepared.Summary, Usage: newRunUsage(openAIUsage{}, prepared.OptimizerUsage)}, &policyHold{plan: prepared}
+			}
+			logRunf(ctx, "policy matched, approved by %s: %s", approverFromContext(ctx), strings.Join(prepared.Policy, "; "))
 		}
-		logRunf(ctx, "stage=prompt_optimize done: optimized_prompt_len=%d", len(optimizedPrompt))
+		plan = &prepared
 	} else {
-		logRunf(ctx, "stage=prompt_optimize skipped: enabled=false")
+		logRunf(ctx, "stage=prompt_optimize skipped: using approved plan")
+	}
+	result := AutomationResult{
+		Prompt:            plan.WorkspacePrompt,
+		OptimizerProvider: plan.OptimizerProvider,
+		RiskLevel:         plan.RiskLevel,
+		Summary:           plan.Summary,
+		Usage:             newRunUsage(openAIUsage{}, plan.OptimizerUsage),
+	}
+	if err := plan.unconfirmedRisk(); err != nil {
+		if !destructiveConfirmed(ctx) {
+			return result, err
+		}
+		logRunf(ctx, "%s plan confirmed by caller", valueOrUnknown(plan.RiskLevel))
 	}
 
 	if cfg.ExecTransport == transportSSH {
 		if _, err := exec.LookPath("ssh"); err != nil {
-			return AutomationResult{}, fmt.Errorf("ssh is required in PATH when JGO_EXEC_TRANSPORT=ssh: %w", err)
+			return result, fmt.Errorf("ssh is required in PATH when JGO_EXEC_TRANSPORT=ssh: %w", err)
 		}
 		logRunf(ctx, "transport=ssh target=%s", formatSSHAddress(cfg))
 	} else {
 		logRunf(ctx, "transport=local target=local")
 	}
 
+	envMap := environToMap(os.Environ())
+	applyProviderFallbacks(envMap)
 	codexEnv := mapToEnviron(envMap)
 	logRunf(ctx, "stage=codex_login_check start")
 	if err := ensureCodexLogin(ctx, cfg, codexEnv); err != nil {
-		return AutomationResult{}, err
+		return result, wrapRunTimeout(ctx, cfg, err)
 	}
 	logRunf(ctx, "stage=codex_login_check done")
 
+	if len(plan.attachments) > 0 {
+		removeAttachments, err := saveRunAttachments(ctx, cfg, plan.attachments)
+		if err != nil {
+			return result, wrapRunTimeout(ctx, cfg, err)
+		}
+		defer removeAttachments()
+	}
+
 	logRunf(ctx, "stage=codex_exec start")
-	execPrompt := buildWorkspacePrompt(optimizedPrompt, availableCLIs)
-	execResp, err := runCodexExec(ctx, cfg, codexEnv, execPrompt)
+	var resumeThread string
+	if plan.ToolSession != nil {
+		resumeThread = plan.ToolSession.Thread
+	}
+	execResp, codexUsage, codexThread, err := runCodexExec(ctx, cfg, codexEnv, plan.WorkspacePrompt, resumeThread, plan.Images)
+	result.Usage, result.CodexThread = newRunUsage(codexUsage, plan.OptimizerUsage), codexThread
+	if codexUsage.TotalTokens > 0 {
+		logRunf(ctx, "codex usage: prompt_tokens=%d completion_tokens=%d total_tokens=%d", codexUsage.PromptTokens, codexUsage.CompletionTokens, codexUsage.TotalTokens)
+	}
 	if err != nil {
-		return AutomationResult{}, fmt.Errorf("codex execution failed: %w", err)
+		return result, wrapRunTimeout(ctx, cfg, fmt.Errorf("codex execution failed: %w", err))
 	}
-	codexOutput := strings.TrimSpace(execResp)
+	result.CodexResponse = strings.TrimSpace(execResp)
 	logRunf(ctx, "stage=codex_exec done")
 	logRunf(ctx, "automation success")
 
-	return AutomationResult{
-		CodexResponse: codexOutput,
-	}, nil
+	return result, nil
+}
+
+func wrapRunTimeout(ctx context.Context, cfg Config, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %s: %v", errRunTimeout, cfg.RunTimeout, err)
+	}
+	return err
 }
 
-func loadOpenAIConfig(env map[string]string) (OpenAIConfig, error) {
-	cfg := OpenAIConfig{
-		BaseURL: strings.TrimSpace(env["OPENAI_BASE_URL"]),
-		APIKey:  strings.TrimSpace(env["OPENAI_API_KEY"]),
-		Model:   strings.TrimSpace(env["MODEL"]),
+func resolveOpenAIConfig(env map[string]string, base OpenAIConfig) OpenAIConfig {
+	cfg := base
+	if v := strings.TrimSpace(env["OPENAI_BASE_URL"]); v != "" {
+		cfg.BaseURL = v
+	}
+	if v := strings.TrimSpace(env["OPENAI_API_KEY"]); v != "" {
+		cfg.APIKey = v
+	}
+	if v := strings.TrimSpace(env["MODEL"]); v != "" {
+		cfg.Model = v
 	}
 	if cfg.BaseURL == "" {
 		cfg.BaseURL = defaultOpenAIBase
 	}
+	return cfg
+}
+
+func loadOpenAIConfig(env map[string]string, base OpenAIConfig) (OpenAIConfig, error) {
+	cfg := resolveOpenAIConfig(env, base)
 
 	var missing []string
 	if cfg.APIKey == "" {
@@ -928,7 +8405,88 @@ func loadOpenAIConfig(env map[string]string) (OpenAIConfig, error) {
 	return cfg, nil
 }
 
-func analyzeRequest(ctx context.Context, cfg OpenAIConfig, instruction string, availableCLIs []string) (RequestPlan, error) {
+// resolveOptimizerProviders returns the ordered provider chain; without an
+// explicit list the single OPENAI_* (or optimizer.*) provider is used. A
+// provider whose key is missing is skipped with a warning so one unset
+// api_key_env does not disable optimization; it fails only when no provider
+// is usable.
+func resolveOptimizerProviders(ctx context.Context, env map[string]string, cfg Config) ([]OpenAIConfig, error) {
+	if len(cfg.Providers) == 0 {
+		single, err := loadOpenAIConfig(env, cfg.Optimizer)
+		if err != nil {
+			return nil, err
+		}
+		single.Name = "default"
+		single.Timeout = cfg.OptimizerPolicy.Timeout
+		single.Policy = cfg.OptimizerPolicy
+		return []OpenAIConfig{single}, nil
+	}
+
+	out := make([]OpenAIConfig, 0, len(cfg.Providers))
+	var missing []string
+	for _, p := range cfg.Providers {
+		provider := OpenAIConfig{
+			Name:    p.Name,
+			BaseURL: p.BaseURL,
+			APIKey:  strings.TrimSpace(p.APIKey),
+			Model:   p.Model,
+			Timeout: cfg.OptimizerPolicy.Timeout,
+			Policy:  cfg.OptimizerPolicy,
+		}
+		if provider.APIKey == "" {
+			provider.APIKey = strings.TrimSpace(env[p.APIKeyEnv])
+		}
+		if provider.APIKey == "" {
+			logRunf(ctx, "optimizer provider %s skipped: %s is not set", p.Name, p.APIKeyEnv)
+			missing = append(missing, fmt.Sprintf("%s (%s)", p.Name, p.APIKeyEnv))
+			continue
+		}
+		if provider.BaseURL == "" {
+			provider.BaseURL = defaultOpenAIBase
+		}
+		if d, err := time.ParseDuration(strings.TrimSpace(p.Timeout)); err == nil && d > 0 {
+			provider.Timeout = d
+		}
+		out = append(out, provider)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no usable optimizer provider: api key not set for %s", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
+
+// optimizePrompt tries providers in order, failing over to the next one when
+// a provider is unavailable (5xx, 429, timeout, network error, invalid JSON).
+func optimizePrompt(ctx context.Context, providers []OpenAIConfig, instruction string, availableCLIs []string) (RequestPlan, string, error) {
+	var failures []string
+	for i, provider := range providers {
+		plan, err := analyzeRequest(ctx, provider, instruction, availableCLIs)
+		if err == nil {
+			return plan, provider.Name, nil
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", provider.Name, err))
+		if ctx.Err() != nil || !errors.Is(err, errOptimizerUnavailable) {
+			return RequestPlan{}, "", fmt.Errorf("provider %s: %w", provider.Name, err)
+		}
+		if i+1 < len(providers) {
+			logRunf(ctx, "stage=prompt_optimize provider=%s failed, failing over to %s: %v", provider.Name, providers[i+1].Name, err)
+		}
+	}
+	if len(failures) == 1 {
+		return RequestPlan{}, "", fmt.Errorf("provider %s", failures[0])
+	}
+	return RequestPlan{}, "", fmt.Errorf("all optimizer providers failed: %s", strings.Join(failures, "; "))
+}
+
+func analyzeRequest(ctx context.Context, cfg OpenAIConfig, instruction string, availableCLIs []string) (plan RequestPlan, err error) {
+	breaker := optimizerBreaker(cfg)
+	if retryAt, ok := breaker.allow(time.Now()); !ok {
+		return RequestPlan{}, fmt.Errorf("%w: circuit open until %s", errOptimizerUnavailable, retryAt.Format(time.RFC3339))
+	}
+	defer func() {
+		breaker.record(ctx, cfg, err)
+	}()
+
 	cliList := strings.Join(availableCLIs, ", ")
 	if strings.TrimSpace(cliList) == "" {
 		cliList = "codex, git"
@@ -941,7 +8499,7 @@ func analyzeRequest(ctx context.Context, cfg OpenAIConfig, instruction string, a
 		Messages: []chatMessage{
 			{
 				Role:    "system",
-				Content: fmt.Sprintf("Return strict JSON only with key: optimized_prompt(string). Do not include any other keys or text. Your job is prompt optimization only, not execution decision. Rewrite the user request into a clear, concrete Codex execution prompt. Available CLI tools from environment: %s. Prefer these CLIs in optimized_prompt. For GitHub tasks, use gh when available. For Kubernetes tasks, use kubectl when available. For AWS tasks, use aws when available.", cliList),
+				Content: fmt.Sprintf("Return strict JSON only with keys: optimized_prompt(string), risk_level(\"read-only\"|\"mutating\"|\"destructive\"), target_systems(array of \"github\"|\"k8s\"|\"aws\"|\"git\"|\"local\"), required_clis(array of CLI names the prompt needs), summary(string, one sentence). Do not include any other keys or text. Classify risk_level as destructive when the task deletes, drops, force-pushes, scales to zero or otherwise loses data or availability; mutating when it changes state; read-only otherwise. Your job is prompt optimization only, not execution decision. Rewrite the user request into a clear, concrete Codex execution prompt. Available CLI tools from environment: %s. Prefer these CLIs in optimized_prompt. For GitHub tasks, use gh when available. For Kubernetes tasks, use kubectl when available. For AWS tasks, use aws when available.", cliList),
 			},
 			{
 				Role:    "user",
@@ -958,25 +8516,13 @@ func analyzeRequest(ctx context.Context, cfg OpenAIConfig, instruction string, a
 	endpoint := strings.TrimRight(cfg.BaseURL, "/") + "/chat/completions"
 	logRunf(
 		ctx,
-		"stage=prompt_optimize call_openai: endpoint=%s model=%s instruction_len=%d",
+		"stage=prompt_optimize call_openai: provider=%s endpoint=%s model=%s instruction_len=%d",
+		cfg.Name,
 		sanitizeURL(endpoint),
 		cfg.Model,
 		len(instruction),
 	)
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
-	if err != nil {
-		return RequestPlan{}, err
-	}
-	httpReq.Header.Set("Authorization", "Bearer "+cfg.APIKey)
-	httpReq.Header.Set("Content-Type", "application/json")
-
-	resp, err := http.DefaultClient.Do(httpReq)
-	if err != nil {
-		return RequestPlan{}, err
-	}
-	defer resp.Body.Close()
-
-	respBody, err := io.ReadAll(resp.Body)
+	resp, respBody, err := postOptimizer(ctx, cfg, endpoint, payload)
 	if err != nil {
 		return RequestPlan{}, err
 	}
@@ -986,6 +8532,15 @@ func analyzeRequest(ctx context.Context, cfg OpenAIConfig, instruction string, a
 		resp.Status,
 		truncateForLog(strings.TrimSpace(string(respBody)), 400),
 	)
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return RequestPlan{}, fmt.Errorf(
+			"%w (endpoint=%s, status=%s): %s",
+			errOptimizerUnavailable,
+			sanitizeURL(endpoint),
+			resp.Status,
+			truncateForLog(strings.TrimSpace(string(respBody)), 400),
+		)
+	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		return RequestPlan{}, fmt.Errorf(
 			"request failed (endpoint=%s, status=%s): %s",
@@ -997,18 +8552,151 @@ func analyzeRequest(ctx context.Context, cfg OpenAIConfig, instruction string, a
 
 	var chatResp plannerChatResponse
 	if err := json.Unmarshal(respBody, &chatResp); err != nil {
-		return RequestPlan{}, fmt.Errorf("decode chat response: %w", err)
+		return RequestPlan{}, fmt.Errorf("%w: decode chat response: %v", errOptimizerUnavailable, err)
 	}
 	if len(chatResp.Choices) == 0 {
-		return RequestPlan{}, fmt.Errorf("chat response has no choices")
+		return RequestPlan{}, fmt.Errorf("%w: chat response has no choices", errOptimizerUnavailable)
 	}
 
 	content := strings.TrimSpace(chatResp.Choices[0].Message.Content)
 	if content == "" {
-		return RequestPlan{}, fmt.Errorf("chat response content is empty")
+		return RequestPlan{}, fmt.Errorf("%w: chat response content is empty", errOptimizerUnavailable)
+	}
+
+	plan, err = parseRequestPlan(content)
+	if err != nil {
+		return RequestPlan{}, fmt.Errorf("%w: %v", errOptimizerUnavailable, err)
+	}
+	plan.Usage = chatResp.Usage
+	if plan.Usage.TotalTokens == 0 {
+		plan.Usage.TotalTokens = plan.Usage.PromptTokens + plan.Usage.CompletionTokens
+	}
+	return plan, nil
+}
+
+// postOptimizer sends the planner request, retrying 429 and 5xx responses
+// with jittered exponential backoff or the upstream Retry-After delay.
+func postOptimizer(ctx context.Context, cfg OpenAIConfig, endpoint string, payload []byte) (*http.Response, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		resp, body, err := postOptimizerOnce(ctx, cfg, endpoint, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		if !retryable || attempt >= cfg.Policy.Retries {
+			return resp, body, nil
+		}
+
+		wait := optimizerBackoff(attempt, parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()))
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			logRunf(ctx, "stage=prompt_optimize provider=%s status=%s: no time left for retry", cfg.Name, resp.Status)
+			return resp, body, nil
+		}
+		logRunf(ctx, "stage=prompt_optimize provider=%s status=%s: retry %d/%d in %s", cfg.Name, resp.Status, attempt+1, cfg.Policy.Retries, wait.Round(time.Millisecond))
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func postOptimizerOnce(ctx context.Context, cfg OpenAIConfig, endpoint string, payload []byte) (*http.Response, []byte, error) {
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, nil, err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+cfg.APIKey)
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := optimizerHTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errOptimizerUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: read response: %v", errOptimizerUnavailable, err)
+	}
+	return resp, respBody, nil
+}
+
+func optimizerBackoff(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return min(retryAfter, maxRetryAfter)
+	}
+	base := min(500*time.Millisecond<<attempt, maxOptimizerBackoff)
+	return base/2 + rand.N(base/2+1)
+}
+
+func parseRetryAfter(raw string, now time.Time) time.Duration {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(raw); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if at, err := http.ParseTime(raw); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+func optimizerBreaker(cfg OpenAIConfig) *circuitBreaker {
+	key := cfg.Name + "|" + cfg.BaseURL
+	optimizerBreakersMu.Lock()
+	defer optimizerBreakersMu.Unlock()
+	b, ok := optimizerBreakers[key]
+	if !ok {
+		b = &circuitBreaker{}
+		optimizerBreakers[key] = b
+	}
+	return b
+}
+
+// allow reports whether a call may proceed. After the cooldown a single
+// probe call is let through (half-open); its outcome closes or reopens it.
+func (b *circuitBreaker) allow(now time.Time) (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return time.Time{}, true
 	}
+	if now.Before(b.openUntil) || b.probing {
+		return b.openUntil, false
+	}
+	b.probing = true
+	return time.Time{}, true
+}
 
-	return parseRequestPlan(content)
+func (b *circuitBreaker) record(ctx context.Context, cfg OpenAIConfig, err error) {
+	if cfg.Policy.BreakerThreshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil || !errors.Is(err, errOptimizerUnavailable) {
+		if !b.openUntil.IsZero() {
+			logRunf(ctx, "optimizer circuit closed: provider=%s", cfg.Name)
+		}
+		b.failures, b.openUntil, b.probing = 0, time.Time{}, false
+		return
+	}
+	b.failures++
+	if b.probing || b.failures >= cfg.Policy.BreakerThreshold {
+		b.openUntil = time.Now().Add(cfg.Policy.BreakerCooldown)
+		b.probing = false
+		logRunf(ctx, "optimizer circuit opened: provider=%s failures=%d cooldown=%s", cfg.Name, b.failures, cfg.Policy.BreakerCooldown)
+	}
 }
 
 func parseRequestPlan(raw string) (RequestPlan, error) {
@@ -1028,10 +8716,61 @@ func parseRequestPlan(raw string) (RequestPlan, error) {
 	if plan.OptimizedPrompt == "" {
 		return RequestPlan{}, fmt.Errorf("parse plan json: optimized_prompt is required")
 	}
+	plan.RiskLevel = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(plan.RiskLevel)), "_", "-")
+	switch plan.RiskLevel {
+	case riskReadOnly, riskMutating, riskDestructive:
+	case "":
+		return RequestPlan{}, fmt.Errorf("parse plan json: risk_level is required")
+	default:
+		return RequestPlan{}, fmt.Errorf("parse plan json: unknown risk_level %q (expected: read-only, mutating or destructive)", plan.RiskLevel)
+	}
+	plan.TargetSystems = normalizeNameList(plan.TargetSystems)
+	plan.RequiredCLIs = normalizeNameList(plan.RequiredCLIs)
+	plan.Summary = strings.TrimSpace(plan.Summary)
 
 	return plan, nil
 }
 
+func normalizeNameList(items []string) []string {
+	var out []string
+	seen := make(map[string]bool, len(items))
+	for _, item := range items {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" || seen[item] {
+			continue
+		}
+		seen[item] = true
+		out = append(out, item)
+	}
+	return out
+}
+
+// missingCLIs returns the required CLIs that are not in available.
+func missingCLIs(required, available []string) []string {
+	have := make(map[string]bool, len(available))
+	for _, name := range available {
+		have[strings.ToLower(name)] = true
+	}
+	var missing []string
+	for _, name := range required {
+		if !have[name] {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+func valueOrUnknown(v string) string {
+	return valueOrDefault(v, "unknown")
+}
+
+func valueOrDefault(v, fallback string) string {
+	if strings.TrimSpace(v) == "" {
+		return fallback
+	}
+	return v
+}
+
 func ensureCodexLogin(ctx context.Context, cfg Config, codexEnv []string) error {
 	args := []string{"login", "status"}
 	target := formatExecutionTarget(cfg)
@@ -1096,10 +8835,27 @@ func ensureCodexLogin(ctx context.Context, cfg Config, codexEnv []string) error
 	return nil
 }
 
-func runCodexExec(ctx context.Context, cfg Config, codexEnv []string, prompt string) (string, error) {
+// runCodexExec runs codex once and returns its output, token usage and
+// thread ID. With cfg.CodexJSON the JSONL events are parsed: the response is
+// the final agent message and the run stream gets a readable transcript. A
+// non-empty resumeThread continues that codex thread instead of starting one;
+// images are attached to the prompt with --image.
+func runCodexExec(ctx context.Context, cfg Config, codexEnv []string, prompt, resumeThread string, images []string) (string, openAIUsage, string, error) {
 	reasoningArg := fmt.Sprintf("reasoning_effort=%q", cfg.ReasoningEffort)
-	args := []string{"exec", "--full-auto", "--skip-git-repo-check", "-c", reasoningArg, prompt}
-	logArgs := []string{"exec", "--full-auto", "--skip-git-repo-check", "-c", reasoningArg, "<inline-prompt>"}
+	args := []string{"exec", "--full-auto", "--skip-git-repo-check", "-c", reasoningArg}
+	if cfg.CodexJSON {
+		args = append(args, "--json")
+	}
+	if len(images) > 0 {
+		// --image takes a comma-separated list; the = form keeps it from
+		// swallowing the prompt argument.
+		args = append(args, "--image="+strings.Join(images, ","))
+	}
+	if resumeThread != "" {
+		args = append(args, "resume", resumeThread)
+	}
+	logArgs := append(slices.Clone(args), "<inline-prompt>")
+	args = append(args, prompt)
 	var cmd *exec.Cmd
 	target := formatExecutionTarget(cfg)
 	if cfg.ExecTransport == transportSSH {
@@ -1129,13 +8885,24 @@ func runCodexExec(ctx context.Context, cfg Config, codexEnv []string, prompt str
 	}
 
 	cmd.Env = codexEnv
+	// Tools spawned by codex may keep the output pipes open after codex is
+	// killed on cancellation; stop waiting for them after a short delay.
+	cmd.WaitDelay = codexWaitDelay
 	var stdoutBuf bytes.Buffer
 	var stderrBuf bytes.Buffer
-	cmd.Stdout = &stdoutBuf
-	cmd.Stderr = &stderrBuf
+	stream := lookupRunStream(runIDFromContext(ctx))
+	events := &codexEventWriter{out: runStreamWriter{stream: stream, name: "stdout"}, stream: stream, parse: cfg.CodexJSON}
+	cmd.Stdout = io.MultiWriter(&stdoutBuf, events)
+	cmd.Stderr = io.MultiWriter(&stderrBuf, runStreamWriter{stream: stream, name: "stderr"})
 
 	err := cmd.Run()
+	events.Flush()
+	// Without a final agent message the raw stdout is the response, so
+	// nothing jgo rendered is passed off as codex output.
 	stdoutResp := strings.TrimSpace(stdoutBuf.String())
+	if final := strings.TrimSpace(events.final); final != "" {
+		stdoutResp = final
+	}
 	stderrResp := strings.TrimSpace(stderrBuf.String())
 	logCommandOutput(ctx, "codex exec stdout", stdoutBuf.Bytes())
 	logCommandOutput(ctx, "codex exec stderr", stderrBuf.Bytes())
@@ -1147,12 +8914,226 @@ func runCodexExec(ctx context.Context, cfg Config, codexEnv []string, prompt str
 		if detail == "" {
 			detail = err.Error()
 		}
-		return stdoutResp, fmt.Errorf("%w: %s", err, detail)
+		return stdoutResp, events.usage, events.thread, fmt.Errorf("%w: %s", err, detail)
 	}
 	if stdoutResp != "" {
-		return stdoutResp, nil
+		return stdoutResp, events.usage, events.thread, nil
+	}
+	return stderrResp, events.usage, events.thread, nil
+}
+
+// codexEventWriter decodes `codex exec --json` output line by line. It
+// renders each event as plain text for out (the run stream), keeps the last
+// agent message and sums token usage. Lines that are not JSON events pass
+// through unchanged, so codex builds without --json support still work.
+type codexEventWriter struct {
+	out    io.Writer
+	stream *runStream
+	parse  bool
+	buf    []byte
+	final  string
+	thread string
+	usage  openAIUsage
+}
+
+func (c *codexEventWriter) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	for {
+		i := bytes.IndexByte(c.buf, '\n')
+		if i < 0 {
+			break
+		}
+		c.writeLine(c.buf[:i+1])
+		c.buf = c.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush handles a trailing line without a newline once codex has exited.
+func (c *codexEventWriter) Flush() {
+	if len(c.buf) > 0 {
+		c.writeLine(append(c.buf, '\n'))
+		c.buf = nil
+	}
+}
+
+func (c *codexEventWriter) writeLine(line []byte) {
+	var event codexEvent
+	trimmed := bytes.TrimSpace(line)
+	if !c.parse || len(trimmed) == 0 || trimmed[0] != '{' || json.Unmarshal(trimmed, &event) != nil || (event.Type == "" && event.Msg == nil) {
+		c.out.Write(line)
+		return
+	}
+	text := c.handleEvent(event)
+	if text == "" {
+		return
+	}
+	io.WriteString(c.out, strings.TrimRight(text, "\n")+"\n")
+}
+
+// handleEvent records usage, the final message and the run step for event
+// and returns the text to show for it, if any.
+func (c *codexEventWriter) handleEvent(event codexEvent) string {
+	if msg := event.Msg; msg != nil {
+		switch msg.Type {
+		case "agent_message":
+			c.final = msg.Message
+			c.stream.putStep(runStep{Type: "message", Status: "completed", Text: msg.Message})
+			return msg.Message
+		case "agent_reasoning":
+			c.stream.putStep(runStep{Type: "reasoning", Status: "completed", Text: msg.Text})
+			return "thinking: " + msg.Text
+		case "task_complete":
+			if msg.LastAgentMessage != "" {
+				c.final = msg.LastAgentMessage
+			}
+		case "exec_command_begin":
+			command := strings.Join(msg.Command, " ")
+			c.stream.putStep(runStep{ID: msg.CallID, Type: "command", Status: "running", Command: command})
+			return "exec: " + command
+		case "exec_command_end":
+			c.stream.putStep(commandStep(msg.CallID, strings.Join(msg.Command, " "), msg.AggregatedOutput, msg.ExitCode, ""))
+			return commandOutput(msg.AggregatedOutput, msg.ExitCode)
+		case "patch_apply_begin":
+			files := make([]runStepFile, 0, len(msg.Changes))
+			for path := range msg.Changes {
+				files = append(files, runStepFile{Path: path, Kind: "update"})
+			}
+			sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+			c.stream.putStep(runStep{ID: msg.CallID, Type: "file_change", Status: "completed", Files: files})
+			return fileChangesText(files)
+		case "error", "stream_error":
+			c.stream.putStep(runStep{Type: "error", Status: "failed", Text: msg.Message})
+			return "error: " + msg.Message
+		case "token_count":
+			// Legacy token_count events carry running totals.
+			total := msg.codexTokenUsage
+			if msg.Info != nil {
+				total = msg.Info.TotalTokenUsage
+			}
+			c.usage = openAIUsage{}
+			c.addUsage(total)
+		}
+		return ""
+	}
+
+	switch event.Type {
+	case "thread.started":
+		c.thread = event.ThreadID
+	case "turn.completed":
+		if event.Usage != nil {
+			c.addUsage(*event.Usage)
+		}
+	case "turn.failed":
+		if event.Error != nil {
+			c.stream.putStep(runStep{Type: "error", Status: "failed", Text: event.Error.Message})
+			return "error: " + event.Error.Message
+		}
+	case "error":
+		c.stream.putStep(runStep{Type: "error", Status: "failed", Text: event.Message})
+		return "error: " + event.Message
+	case "item.started", "item.updated":
+		item := event.Item
+		if item == nil {
+			return ""
+		}
+		switch item.Type {
+		case "command_execution":
+			c.stream.putStep(runStep{ID: item.ID, Type: "command", Status: "running", Command: item.Command})
+			if event.Type == "item.started" {
+				return "exec: " + item.Command
+			}
+		case "mcp_tool_call":
+			c.stream.putStep(runStep{ID: item.ID, Type: "tool_call", Status: "running", Text: item.Server + "." + item.Tool})
+		}
+	case "item.completed":
+		item := event.Item
+		if item == nil {
+			return ""
+		}
+		switch item.Type {
+		case "agent_message":
+			c.final = item.Text
+			c.stream.putStep(runStep{ID: item.ID, Type: "message", Status: "completed", Text: item.Text})
+			return item.Text
+		case "reasoning":
+			c.stream.putStep(runStep{ID: item.ID, Type: "reasoning", Status: "completed", Text: item.Text})
+			return "thinking: " + item.Text
+		case "command_execution":
+			c.stream.putStep(commandStep(item.ID, item.Command, item.AggregatedOutput, item.ExitCode, item.Status))
+			return commandOutput(item.AggregatedOutput, item.ExitCode)
+		case "file_change":
+			files := make([]runStepFile, 0, len(item.Changes))
+			for _, change := range item.Changes {
+				files = append(files, runStepFile{Path: change.Path, Kind: change.Kind})
+			}
+			c.stream.putStep(runStep{ID: item.ID, Type: "file_change", Status: valueOrDefault(item.Status, "completed"), Files: files})
+			return fileChangesText(files)
+		case "mcp_tool_call":
+			c.stream.putStep(runStep{ID: item.ID, Type: "tool_call", Status: valueOrDefault(item.Status, "completed"), Text: item.Server + "." + item.Tool})
+			return "tool: " + item.Server + "." + item.Tool
+		case "web_search":
+			c.stream.putStep(runStep{ID: item.ID, Type: "web_search", Status: "completed", Text: item.Query})
+			return "web search: " + item.Query
+		case "error":
+			c.stream.putStep(runStep{ID: item.ID, Type: "error", Status: "failed", Text: item.Message})
+			return "error: " + item.Message
+		}
+	}
+	return ""
+}
+
+func commandStep(id, command, output string, exitCode *int, status string) runStep {
+	step := runStep{ID: id, Type: "command", Status: "completed", Command: command, Output: truncateForLog(output, maxStepOutput), ExitCode: exitCode}
+	if status == "failed" || (exitCode != nil && *exitCode != 0) {
+		step.Status = "failed"
+	}
+	return step
+}
+
+func commandOutput(output string, exitCode *int) string {
+	out := strings.TrimRight(output, "\n")
+	if exitCode != nil && *exitCode != 0 {
+		out = strings.TrimLeft(out+fmt.Sprintf("\nexit code %d", *exitCode), "\n")
+	}
+	return out
+}
+
+func fileChangesText(files []runStepFile) string {
+	changes := make([]string, 0, len(files))
+	for _, file := range files {
+		changes = append(changes, file.Kind+" "+file.Path)
+	}
+	return "file changes: " + strings.Join(changes, ", ")
+}
+
+func (c *codexEventWriter) addUsage(u codexTokenUsage) {
+	c.usage.PromptTokens += u.InputTokens
+	c.usage.CompletionTokens += u.OutputTokens
+	c.usage.TotalTokens = c.usage.PromptTokens + c.usage.CompletionTokens
+	if u.CachedInputTokens > 0 {
+		if c.usage.PromptTokensDetails == nil {
+			c.usage.PromptTokensDetails = &promptTokensDetails{}
+		}
+		c.usage.PromptTokensDetails.CachedTokens += u.CachedInputTokens
+	}
+}
+
+func newRunUsage(codex openAIUsage, optimizer *openAIUsage) runUsage {
+	u := runUsage{openAIUsage: codex, Codex: codex, Optimizer: optimizer}
+	if optimizer != nil {
+		u.PromptTokens += optimizer.PromptTokens
+		u.CompletionTokens += optimizer.CompletionTokens
+		u.TotalTokens += optimizer.TotalTokens
+		if optimizer.PromptTokensDetails != nil {
+			cached := optimizer.PromptTokensDetails.CachedTokens
+			if codex.PromptTokensDetails != nil {
+				cached += codex.PromptTokensDetails.CachedTokens
+			}
+			u.PromptTokensDetails = &promptTokensDetails{CachedTokens: cached}
+		}
 	}
-	return stderrResp, nil
+	return u
 }
 
 func buildSSHArgs(cfg Config, remoteCommand string) []string {
@@ -1194,11 +9175,15 @@ func formatExecutionTarget(cfg Config) string {
 	return "local"
 }
 
-func buildWorkspacePrompt(optimizedPrompt string, availableCLIs []string) string {
+func buildWorkspacePrompt(optimizedPrompt string, availableCLIs, attachments []string) string {
 	cliList := strings.Join(availableCLIs, ", ")
 	if strings.TrimSpace(cliList) == "" {
 		cliList = "codex, git"
 	}
+	attached := ""
+	if len(attachments) > 0 {
+		attached = "\nAttachments from the request (open or view them as needed):\n- " + strings.Join(attachments, "\n- ") + "\n"
+	}
 
 	return fmt.Sprintf(`You are operating inside a remote execution environment.
 
@@ -1216,12 +9201,12 @@ Execution guidance:
 
 Execute this optimized request exactly:
 %s
-
+%s
 Constraints:
 - Use non-interactive commands only.
 - Keep changes focused and minimal.
 - Do not ask for extra user input.
-	`, cliList, optimizedPrompt)
+	`, cliList, optimizedPrompt, attached)
 }
 
 func applyProviderFallbacks(env map[string]string) {
@@ -1242,7 +9227,11 @@ func applyProviderFallbacks(env map[string]string) {
 	}
 }
 
-func resolveAvailableCLIs(env map[string]string, codexBin string) []string {
+// detectedCLIs are the CLIs resolveAvailableCLIs adds only when their
+// credentials are configured.
+var detectedCLIs = []string{"aws", "gh", "kubectl"}
+
+func resolveAvailableCLIs(env map[string]string, codexBin string, extra []string) []string {
 	set := make(map[string]struct{})
 	add := func(v string) {
 		name := strings.TrimSpace(v)
@@ -1259,10 +9248,8 @@ func resolveAvailableCLIs(env map[string]string, codexBin string) []string {
 		add("codex")
 	}
 
-	if raw := strings.TrimSpace(env["JGO_AVAILABLE_CLIS"]); raw != "" {
-		for _, item := range strings.Split(raw, ",") {
-			add(item)
-		}
+	for _, item := range extra {
+		add(item)
 	}
 
 	if hasAnyEnv(env, "AWS_ACCESS_KEY_ID", "AWS_PROFILE", "AWS_DEFAULT_REGION", "AWS_REGION") {
@@ -1292,48 +9279,266 @@ func hasAnyEnv(env map[string]string, keys ...string) bool {
 	return false
 }
 
-func loadEnvFile(path string) error {
-	file, err := os.Open(path)
-	if err != nil {
-		return err
+// loadEnvFiles applies dotenv files in order, later files overriding earlier
+// ones. Variables already present in the process environment win unless
+// override is set, matching docker compose.
+func loadEnvFiles(paths []string, override bool) error {
+	inherited := environToMap(os.Environ())
+	loaded := make(map[string]string)
+	lookup := func(key string) (string, bool) {
+		if v, ok := inherited[key]; ok && !override {
+			return v, true
+		}
+		if v, ok := loaded[key]; ok {
+			return v, true
+		}
+		v, ok := inherited[key]
+		return v, ok
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	lineNo := 0
-	for scanner.Scan() {
-		lineNo++
-		raw := scanner.Text()
-		line := strings.TrimSpace(raw)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		err = parseDotenv(path, data, lookup, func(pair dotenvPair) error {
+			if _, ok := inherited[pair.key]; ok && !override {
+				log.Printf("env file %s:%d: %s is already set in the environment; keeping it (use --env-override to replace)", path, pair.line, pair.key)
+				return nil
+			}
+			loaded[pair.key] = pair.value
+			if err := os.Setenv(pair.key, pair.value); err != nil {
+				return fmt.Errorf("%s:%d: set %s: %w", path, pair.line, pair.key, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseDotenv parses KEY=VALUE lines with compose-style quoting: single
+// quotes are literal, double quotes support escapes and may span lines,
+// unquoted values end at an inline " #" comment. ${VAR}, $VAR,
+// ${VAR:-default} (defaults may nest ${...}) and ${VAR:?error} are expanded
+// except in single quotes.
+// Each pair is handed to apply before the next line is read, so later lines
+// can reference earlier ones through lookup.
+func parseDotenv(path string, data []byte, lookup func(string) (string, bool), apply func(dotenvPair) error) error {
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.TrimPrefix(text, "\ufeff")
+	lines := strings.Split(text, "\n")
+
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		fail := func(format string, args ...any) error {
+			return fmt.Errorf("%s:%d: %s", path, lineNo, fmt.Sprintf(format, args...))
+		}
+		line := strings.TrimSpace(lines[i])
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
-		if strings.HasPrefix(line, "export ") {
-			line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		if rest, ok := strings.CutPrefix(line, "export "); ok {
+			line = strings.TrimSpace(rest)
 		}
 
-		eq := strings.Index(line, "=")
-		if eq <= 0 {
-			return fmt.Errorf("invalid format at line %d", lineNo)
+		key, raw, hasValue := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !dotenvKeyPattern.MatchString(key) {
+			return fail("invalid variable name %q", key)
+		}
+		if !hasValue {
+			// A bare KEY passes the current value through, as in compose;
+			// for the process environment that is a no-op.
+			continue
+		}
+		raw = strings.TrimLeft(raw, " \t")
+
+		var value string
+		switch {
+		case strings.HasPrefix(raw, "'") || strings.HasPrefix(raw, "\""):
+			quote := raw[0]
+			body := raw[1:]
+			end := findClosingQuote(body, quote)
+			for end < 0 && i+1 < len(lines) {
+				i++
+				body += "\n" + lines[i]
+				end = findClosingQuote(body, quote)
+			}
+			if end < 0 {
+				return fail("unterminated %c-quoted value for %s", quote, key)
+			}
+			if trailing := strings.TrimSpace(body[end+1:]); trailing != "" && !strings.HasPrefix(trailing, "#") {
+				return fmt.Errorf("%s:%d: unexpected characters after closing quote for %s", path, i+1, key)
+			}
+			value = body[:end]
+			if quote == '"' {
+				var err error
+				if value, err = expandDotenvValue(unescapeDotenv(value), lookup); err != nil {
+					return fail("%s: %v", key, err)
+				}
+			}
+		default:
+			if idx := strings.Index(raw, " #"); idx >= 0 {
+				raw = raw[:idx]
+			} else if idx := strings.Index(raw, "\t#"); idx >= 0 {
+				raw = raw[:idx]
+			}
+			var err error
+			if value, err = expandDotenvValue(strings.TrimSpace(raw), lookup); err != nil {
+				return fail("%s: %v", key, err)
+			}
 		}
 
-		key := strings.TrimSpace(line[:eq])
-		val := strings.TrimSpace(line[eq+1:])
-		if strings.HasPrefix(val, "\"") && strings.HasSuffix(val, "\"") && len(val) >= 2 {
-			val = strings.Trim(val, "\"")
-		} else if strings.HasPrefix(val, "'") && strings.HasSuffix(val, "'") && len(val) >= 2 {
-			val = strings.Trim(val, "'")
+		if err := apply(dotenvPair{key: key, value: value, line: lineNo}); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		if err := os.Setenv(key, val); err != nil {
-			return fmt.Errorf("set env (%s) failed at line %d: %w", key, lineNo, err)
+func findClosingQuote(body string, quote byte) int {
+	for i := 0; i < len(body); i++ {
+		if quote == '"' && body[i] == '\\' {
+			i++
+			continue
+		}
+		if body[i] == quote {
+			return i
 		}
 	}
+	return -1
+}
 
-	if err := scanner.Err(); err != nil {
-		return err
+func unescapeDotenv(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case '"', '\\':
+			b.WriteByte(s[i])
+		case '$':
+			// Keep the escape visible to expandDotenvValue as a literal "$$".
+			b.WriteString("$$")
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		}
 	}
-	return nil
+	return b.String()
+}
+
+func expandDotenvValue(s string, lookup func(string) (string, bool)) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		next := s[i+1]
+		switch {
+		case next == '$':
+			b.WriteByte('$')
+			i++
+		case next == '{':
+			end := matchDotenvBrace(s[i+2:])
+			if end < 0 {
+				return "", fmt.Errorf("unterminated ${ in %q", s)
+			}
+			expr := s[i+2 : i+2+end]
+			value, err := expandDotenvExpr(expr, lookup)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i += 2 + end
+		case next == '_' || (next >= 'A' && next <= 'Z') || (next >= 'a' && next <= 'z'):
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || (s[j] >= 'A' && s[j] <= 'Z') || (s[j] >= 'a' && s[j] <= 'z') || (s[j] >= '0' && s[j] <= '9')) {
+				j++
+			}
+			value, _ := lookup(s[i+1 : j])
+			b.WriteString(value)
+			i = j - 1
+		default:
+			b.WriteByte('$')
+		}
+	}
+	return b.String(), nil
+}
+
+// matchDotenvBrace returns the index of the "}" closing a "${" whose body
+// starts at s, skipping nested ${...} in defaults, or -1.
+func matchDotenvBrace(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '$':
+			i++
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '{':
+			depth++
+			i++
+		case s[i] == '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	return -1
+}
+
+func expandDotenvExpr(expr string, lookup func(string) (string, bool)) (string, error) {
+	n := 0
+	for n < len(expr) && (expr[n] == '_' || expr[n] == '.' || (expr[n] >= 'A' && expr[n] <= 'Z') || (expr[n] >= 'a' && expr[n] <= 'z') || (expr[n] >= '0' && expr[n] <= '9')) {
+		n++
+	}
+	name, rest := expr[:n], expr[n:]
+	op, arg := "", ""
+	for _, candidate := range []string{":-", ":?", "-", "?"} {
+		if strings.HasPrefix(rest, candidate) {
+			op, arg = candidate, rest[len(candidate):]
+			break
+		}
+	}
+	if !dotenvKeyPattern.MatchString(name) || (op == "" && rest != "") {
+		return "", fmt.Errorf("invalid variable reference ${%s}", expr)
+	}
+	value, ok := lookup(name)
+	switch op {
+	case ":-":
+		if value == "" {
+			return expandDotenvValue(arg, lookup)
+		}
+	case "-":
+		if !ok {
+			return expandDotenvValue(arg, lookup)
+		}
+	case ":?", "?":
+		if !ok || (op == ":?" && value == "") {
+			msg, err := expandDotenvValue(arg, lookup)
+			if err != nil {
+				return "", err
+			}
+			if msg == "" {
+				msg = "is required"
+			}
+			return "", fmt.Errorf("%s %s", name, msg)
+		}
+	}
+	return value, nil
 }
 
 func environToMap(environ []string) map[string]string {
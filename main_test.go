@@ -0,0 +1,1215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/flock"
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@every",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q): expected error", expr)
+		}
+	}
+}
+
+func TestCronSpecNext(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		name string
+		expr string
+		from string
+		want string
+	}{
+		{"weekdays skip weekend", "0 9 * * 1-5", "2026-10-16 10:00", "2026-10-19 09:00"},
+		{"minute step", "*/15 * * * *", "2026-10-18 10:07", "2026-10-18 10:15"},
+		{"exact minute is exclusive", "*/15 * * * *", "2026-10-18 10:15", "2026-10-18 10:30"},
+		{"range with step", "10-30/10 * * * *", "2026-10-18 10:20", "2026-10-18 10:30"},
+		{"range with step wraps hour", "10-30/10 * * * *", "2026-10-18 10:30", "2026-10-18 11:10"},
+		{"value with step runs to max", "5/20 * * * *", "2026-10-18 10:26", "2026-10-18 10:45"},
+		{"list", "0 8,20 * * *", "2026-10-18 09:00", "2026-10-18 20:00"},
+		{"dom or dow matches weekday", "0 0 13 * 5", "2026-10-14 12:00", "2026-10-16 00:00"},
+		{"dom or dow matches date", "0 0 13 * 5", "2026-11-07 00:00", "2026-11-13 00:00"},
+		{"dom or dow matches non-friday date", "0 0 13 * 5", "2026-12-12 00:00", "2026-12-13 00:00"},
+		{"stepped dom is a wildcard", "0 0 */10 * 1", "2026-10-18 00:00", "2026-12-21 00:00"},
+		{"stepped dow is a wildcard", "0 0 15 * */2", "2026-10-18 00:00", "2026-11-15 00:00"},
+		{"sunday as 7", "0 12 * * 7", "2026-10-18 13:00", "2026-10-25 12:00"},
+		{"month restriction", "0 0 1 3 *", "2026-10-18 00:00", "2027-03-01 00:00"},
+		{"daily macro", "@daily", "2026-10-18 10:00", "2026-10-19 00:00"},
+		{"hourly macro", "@HOURLY", "2026-10-18 10:00", "2026-10-18 11:00"},
+		{"impossible date", "0 0 31 2 *", "2026-10-18 00:00", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("parseCron(%q): %v", tt.expr, err)
+			}
+			got := spec.next(at(tt.from))
+			if tt.want == "" {
+				if !got.IsZero() {
+					t.Fatalf("next(%s) = %s, want no match", tt.from, got)
+				}
+				return
+			}
+			if want := at(tt.want); !got.Equal(want) {
+				t.Fatalf("next(%s) = %s, want %s", tt.from, got.Format("2006-01-02 15:04 Mon"), want.Format("2006-01-02 15:04 Mon"))
+			}
+		})
+	}
+}
+
+// renderYAML prints a node tree compactly so tests can compare structure.
+func renderYAML(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		if n.ShortTag() == "!!null" {
+			return "~"
+		}
+		return strconv.Quote(n.Value)
+	case yaml.AliasNode:
+		return renderYAML(n.Alias)
+	case yaml.SequenceNode:
+		parts := make([]string, len(n.Content))
+		for i, item := range n.Content {
+			parts[i] = renderYAML(item)
+		}
+		return "[" + strings.Join(parts, " ") + "]"
+	default:
+		parts := make([]string, 0, len(n.Content)/2)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			parts = append(parts, n.Content[i].Value+":"+renderYAML(n.Content[i+1]))
+		}
+		return "{" + strings.Join(parts, " ") + "}"
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"empty", "", "~"},
+		{"comments only", "# a\n---\n  # b\n", "~"},
+		{"flat map", "a: 1\nb: two\n", `{a:"1" b:"two"}`},
+		{"nested map", "a:\n  b:\n    c: x\n  d: y\n", `{a:{b:{c:"x"} d:"y"}}`},
+		{"null value", "a:\nb: ~\nc: null\n", `{a:~ b:~ c:~}`},
+		{"block list", "a:\n  - x\n  - y\n", `{a:["x" "y"]}`},
+		{"block list at key indent", "a:\n- x\n- y\nb: z\n", `{a:["x" "y"] b:"z"}`},
+		{"list of maps", "a:\n  - name: n1\n    url: u1\n  - name: n2\n", `{a:[{name:"n1" url:"u1"} {name:"n2"}]}`},
+		{"flow list", "a: [x, \"y, z\", 'w']\n", `{a:["x" "y, z" "w"]}`},
+		{"flow map", "a: {b: 1, c: [x]}\n", `{a:{b:"1" c:["x"]}}`},
+		{"literal block scalar", "a: |\n  line 1\n  line 2\nb: x\n", `{a:"line 1\nline 2\n" b:"x"}`},
+		{"folded block scalar", "a: >-\n  one\n  two\n", `{a:"one two"}`},
+		{"anchor and alias", "a: &v x\nb: *v\n", `{a:"x" b:"x"}`},
+		{"single quoted", "a: 'it''s # here'\n", `{a:"it's # here"}`},
+		{"inline comment", "a: x # comment\nb: y#z\n", `{a:"x" b:"y#z"}`},
+		{"colon in value", "a: http://h:80/p\n", `{a:"http://h:80/p"}`},
+		{"crlf", "a: 1\r\nb: 2\r\n", `{a:"1" b:"2"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := parseYAML([]byte(tt.in))
+			if err != nil {
+				t.Fatalf("parseYAML: %v", err)
+			}
+			if got := renderYAML(root); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		line int
+	}{
+		{"tab indent", "a:\n\tb: 1\n", 2},
+		{"over-indented key", "a: 1\n  b: 2\n", 2},
+		{"missing colon", "a: 1\n\nplain\n", 3},
+		{"unterminated flow list", "a: [x, y\n", 1},
+		{"unterminated quote", "a: 1\nb: \"x\n", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseYAML([]byte(tt.in))
+			var yerr *yamlError
+			if !errors.As(err, &yerr) {
+				t.Fatalf("expected yamlError, got %v", err)
+			}
+			if yerr.line != tt.line || strings.HasPrefix(yerr.msg, "yaml:") {
+				t.Fatalf("got line %d %q, want line %d", yerr.line, yerr.msg, tt.line)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jgo.yaml")
+	data := strings.Join([]string{
+		"transport:",
+		"  mode: ftp",
+		"  reasoning_effort: extreme",
+		"ssh:",
+		"  port: ssh",
+		"limits:",
+		"  burst: -1",
+		"github:",
+		"  allowed_associations: [OWNER, owner, STRANGER]",
+		"unknown: 1",
+		"profiles:",
+		"  - name: p",
+		"    reasoning_effort: max",
+		"limits:",
+	}, "\n")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := loadConfigFile(path)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, want := range []string{
+		path + `:2: invalid transport "ftp"`,
+		path + `:3: invalid reasoning effort "extreme"`,
+		path + `:5: invalid port "ssh"`,
+		path + `:7: limits.burst must be >= 0`,
+		path + `:9: invalid author association "STRANGER"`,
+		path + `:10: unknown key "unknown"`,
+		path + `:13: profiles[0].reasoning_effort: invalid reasoning effort "max"`,
+		path + `:14: duplicate key "limits"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error missing %q:\n%v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), `"owner"`) {
+		t.Errorf("associations should match case-insensitively:\n%v", err)
+	}
+}
+
+func TestExpandDotenvValue(t *testing.T) {
+	env := map[string]string{"SET": "v", "EMPTY": "", "B": "bee"}
+	lookup := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+	tests := []struct {
+		in   string
+		want string
+		err  string
+	}{
+		{in: "$SET-${SET}", want: "v-v"},
+		{in: "$$SET $", want: "$SET $"},
+		{in: "${UNSET}", want: ""},
+		{in: "${UNSET:-d}", want: "d"},
+		{in: "${EMPTY:-d}", want: "d"},
+		{in: "${EMPTY-d}", want: ""},
+		{in: "${UNSET-d}", want: "d"},
+		{in: "${SET:-d}", want: "v"},
+		{in: "${UNSET:-${B}}", want: "bee"},
+		{in: "${UNSET:-x${B}y}/z", want: "xbeey/z"},
+		{in: "${UNSET:-${NOPE:-${B}}}", want: "bee"},
+		{in: "${UNSET:-$B}", want: "bee"},
+		{in: "${UNSET:-a-b:-c}", want: "a-b:-c"},
+		{in: "${UNSET:-$${B}}", want: "${B}"},
+		{in: "${SET:?}", want: "v"},
+		{in: "${EMPTY?}", want: ""},
+		{in: "${UNSET:?}", err: "UNSET is required"},
+		{in: "${EMPTY:?must be set}", err: "EMPTY must be set"},
+		{in: "${UNSET?need ${B}}", err: "UNSET need bee"},
+		{in: "${UNSET:-${B}", err: "unterminated"},
+		{in: "${1BAD}", err: "invalid variable reference"},
+		{in: "${SET!x}", err: "invalid variable reference"},
+	}
+	for _, tt := range tests {
+		got, err := expandDotenvValue(tt.in, lookup)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expand(%q) error = %v, want %q", tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("expand(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseDotenv(t *testing.T) {
+	data := strings.Join([]string{
+		"# comment",
+		"export A=1 # trailing",
+		"B='lit $A # kept'",
+		`C="x\ty $A"`,
+		`D="multi`,
+		`line"`,
+		"E=${MISSING:-${A}}",
+		"F",
+	}, "\n")
+	got := make(map[string]string)
+	lookup := func(key string) (string, bool) {
+		v, ok := got[key]
+		return v, ok
+	}
+	err := parseDotenv(".env", []byte(data), lookup, func(pair dotenvPair) error {
+		got[pair.key] = pair.value
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"A": "1", "B": "lit $A # kept", "C": "x\ty 1", "D": "multi\nline", "E": "1"}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+	if _, ok := got["F"]; ok {
+		t.Errorf("bare key should not be set")
+	}
+
+	err = parseDotenv(".env", []byte("A=1\n\nB=${A:?}\nC=${NOPE:?missing}\n"), lookup, func(dotenvPair) error { return nil })
+	if err == nil || !strings.HasPrefix(err.Error(), ".env:4: C: NOPE missing") {
+		t.Errorf("error = %v, want .env:4 NOPE missing", err)
+	}
+}
+
+func TestAuditLogChain(t *testing.T) {
+	dir := t.TempDir()
+	for _, key := range []string{"", "secret"} {
+		path := filepath.Join(dir, "audit-"+key+".jsonl")
+		for _, event := range []string{"run.started", "run.finished"} {
+			if err := writeAuditEntry(path, key, auditEntry{Event: event, RunID: "run-1"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n, _, err := verifyAuditLog(path, key); err != nil || n != 2 {
+			t.Fatalf("key %q: verify = %d, %v", key, n, err)
+		}
+		other := "other"
+		if key == "" {
+			other = "secret"
+		}
+		if _, _, err := verifyAuditLog(path, other); err == nil {
+			t.Fatalf("key %q: verify with key %q should fail", key, other)
+		}
+
+		data, _ := os.ReadFile(path)
+		tampered := strings.Replace(string(data), `"run.finished"`, `"run.rejected"`, 1)
+		if err := os.WriteFile(path, []byte(tampered), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := verifyAuditLog(path, key); err == nil || !strings.Contains(err.Error(), ":2: hash mismatch") {
+			t.Fatalf("key %q: tampered log error = %v", key, err)
+		}
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counter")
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				unlock, err := lockFile(path)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				data, _ := os.ReadFile(path)
+				n, _ := strconv.Atoi(string(data))
+				os.WriteFile(path, []byte(strconv.Itoa(n+1)), 0o600)
+				unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if data, _ := os.ReadFile(path); string(data) != "160" {
+		t.Fatalf("counter = %s, want 160", data)
+	}
+
+	// The lock file stays behind after unlock and must not block the next
+	// writer; only a held OS lock does.
+	if _, err := os.Stat(path + ".lock"); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := lockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	held := flock.New(path + ".lock")
+	if ok, err := held.TryLock(); ok || err != nil {
+		t.Fatalf("second lock while held: ok=%t err=%v", ok, err)
+	}
+	unlock()
+	if ok, err := held.TryLock(); !ok || err != nil {
+		t.Fatalf("lock after unlock: ok=%t err=%v", ok, err)
+	}
+	held.Unlock()
+}
+
+func TestRequestParamsMetadata(t *testing.T) {
+	p := openAIRequestParams{Metadata: []byte(`{"team":"core","attempt":2,"tags":["a"],"ok":true}`)}
+	values, dropped, err := p.metadata(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || values["team"] != "core" {
+		t.Fatalf("values = %v, want only team", values)
+	}
+	if strings.Join(dropped, ",") != "attempt,ok,tags" {
+		t.Fatalf("dropped = %v", dropped)
+	}
+	if _, _, err := p.metadata(true); err == nil {
+		t.Fatal("strict mode accepted a non-string metadata value")
+	}
+
+	for _, raw := range []string{``, `null`} {
+		values, dropped, err := openAIRequestParams{Metadata: []byte(raw)}.metadata(true)
+		if err != nil || values != nil || dropped != nil {
+			t.Fatalf("metadata %q = %v, %v, %v", raw, values, dropped, err)
+		}
+	}
+	if _, dropped, err := (openAIRequestParams{Metadata: []byte(`"x"`)}).metadata(false); err != nil || len(dropped) != 1 {
+		t.Fatalf("non-object metadata = %v, %v", dropped, err)
+	}
+	if _, _, err := (openAIRequestParams{Metadata: []byte(`"x"`)}).metadata(true); err == nil {
+		t.Fatal("strict mode accepted non-object metadata")
+	}
+	long := openAIRequestParams{Metadata: []byte(`{"k":"` + strings.Repeat("v", 513) + `"}`)}
+	if _, _, err := long.metadata(false); err == nil {
+		t.Fatal("oversized metadata value was accepted")
+	}
+}
+
+func TestAttachmentRefs(t *testing.T) {
+	ctx := context.WithValue(context.Background(), runIDContextKey{}, "run-1")
+	cfg := Config{ExecTransport: transportSSH}
+	refs, images := attachmentRefs(ctx, cfg, []runAttachment{
+		{Name: "1-image.png", Data: []byte("png"), Image: true},
+		{Name: "2-notes.txt", Data: []byte("notes")},
+		{URL: "https://example.com/a.png"},
+	})
+	dir := filepath.Join(cacheRootDir, "attachments", "run-1")
+	if strings.Join(images, ",") != filepath.Join(dir, "1-image.png") {
+		t.Fatalf("images = %v", images)
+	}
+	if strings.Join(refs, ",") != filepath.Join(dir, "2-notes.txt")+",https://example.com/a.png" {
+		t.Fatalf("refs = %v", refs)
+	}
+	if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("attachmentRefs wrote %s", dir)
+	}
+}
+
+// TestRunHistorySharedFile runs a server store in the test process and a
+// shared (jgo mcp) store in a child process against one history file.
+func TestRunHistorySharedFile(t *testing.T) {
+	if path := os.Getenv("JGO_TEST_HISTORY_CHILD"); path != "" {
+		if err := loadRunHistory(path, true); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 40; i++ {
+			appendRunHistory(runHistoryRecord{RunID: fmt.Sprintf("mcp-%d", i), Status: "completed", Response: "ok"}, 0)
+		}
+		return
+	}
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	if err := loadRunHistory(path, false); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { loadRunHistory("", false) })
+	appendRunHistory(runHistoryRecord{RunID: "serve-running", Status: "running"}, 0)
+
+	child := exec.Command(os.Args[0], "-test.run=^TestRunHistorySharedFile$")
+	child.Env = append(os.Environ(), "JGO_TEST_HISTORY_CHILD="+path)
+	done := make(chan error, 1)
+	var out bytes.Buffer
+	child.Stdout, child.Stderr = &out, &out
+	if err := child.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { done <- child.Wait() }()
+	for i := 0; i < 40; i++ {
+		appendRunHistory(runHistoryRecord{RunID: fmt.Sprintf("serve-%d", i), Status: "completed", Response: "ok"}, 0)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("child: %v\n%s", err, out.String())
+	}
+
+	runHistoryMu.Lock()
+	err := compactRunHistoryLocked()
+	runHistoryMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"serve-running", "serve-0", "serve-39", "mcp-0", "mcp-39"} {
+		if _, ok := lookupRunHistory(id); !ok {
+			t.Errorf("run %s lost after compaction", id)
+		}
+	}
+	if entry, _ := lookupRunHistory("serve-running"); entry.Status != "running" {
+		t.Errorf("shared store changed the server's running run to %q", entry.Status)
+	}
+	if n := len(snapshotRunHistory(maxRunHistorySize)); n != 81 {
+		t.Errorf("history has %d runs, want 81", n)
+	}
+	lock := flock.New(path + ".lock")
+	if ok, err := lock.TryLock(); !ok || err != nil {
+		t.Errorf("history lock still held: ok=%t err=%v", ok, err)
+	}
+	lock.Unlock()
+}
+
+func TestRunStreamReplayFromTranscript(t *testing.T) {
+	if err := loadRunHistory(filepath.Join(t.TempDir(), "history.jsonl"), false); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { loadRunHistory("", false) })
+	runID := "run-replay"
+	appendRunHistory(runHistoryRecord{RunID: runID, Status: "running"}, 0)
+	beginRunStream(runID).append("stdout", "deploying\n")
+	appendRunHistory(runHistoryRecord{RunID: runID, Status: "completed", Response: "done"}, 0)
+	runStreamsMu.Lock()
+	delete(runStreams, runID)
+	runStreamsMu.Unlock()
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/runs/"+runID+"/stream", nil)
+		req.SetPathValue("id", runID)
+		rec := httptest.NewRecorder()
+		handleRunStream()(rec, req)
+		return rec
+	}
+	rec := get()
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"text":"deploying\n"`) || !strings.Contains(rec.Body.String(), `"status":"completed"`) {
+		t.Fatalf("replay = %d %s", rec.Code, rec.Body.String())
+	}
+	if err := os.Remove(runTranscriptPath(runID)); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(); rec.Code != http.StatusGone {
+		t.Fatalf("evicted transcript = %d, want 410", rec.Code)
+	}
+}
+
+func TestEditPlanPrompt(t *testing.T) {
+	policy := PolicyConfig{
+		ProdNamespaces: []string{"prod"},
+		Rules:          []PolicyRule{{Name: "drop", Keywords: []string{"drop"}}},
+	}
+	base := runPlan{
+		Instruction:       "check pods",
+		OptimizedPrompt:   "kubectl get pods -n dev",
+		AvailableCLIs:     []string{"git", "kubectl"},
+		OptimizerProvider: "p",
+		RiskLevel:         riskReadOnly,
+		Summary:           "read pods",
+		RequiredCLIs:      []string{"kubectl"},
+	}
+	tests := []struct {
+		name        string
+		plan        runPlan
+		prompt      string
+		wantErr     error
+		wantPolicy  []string
+		wantConfirm bool
+	}{
+		{
+			name:        "optimized plan becomes unclassified",
+			plan:        base,
+			prompt:      "kubectl get pods -n staging",
+			wantConfirm: true,
+		},
+		{
+			name:        "policy is evaluated again",
+			plan:        base,
+			prompt:      "kubectl delete pod api -n prod and drop the cache",
+			wantPolicy:  []string{`prod-kubectl: kubectl change in namespace "prod"`, `drop: keyword "drop"`},
+			wantConfirm: true,
+		},
+		{
+			name:    "newly named CLI must be available",
+			plan:    base,
+			prompt:  "aws s3 ls",
+			wantErr: errRequiredCLIMissing,
+		},
+		{
+			name:   "unoptimized plan needs no confirmation",
+			plan:   runPlan{Instruction: "x", OptimizedPrompt: "x", AvailableCLIs: []string{"git"}},
+			prompt: "git status",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := editPlanPrompt(policy, tt.plan, tt.prompt)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.OptimizedPrompt != tt.prompt || !strings.Contains(got.WorkspacePrompt, tt.prompt) {
+				t.Fatalf("prompt not applied: %q", got.WorkspacePrompt)
+			}
+			if strings.Join(got.Policy, "|") != strings.Join(tt.wantPolicy, "|") {
+				t.Fatalf("policy = %q, want %q", got.Policy, tt.wantPolicy)
+			}
+			if confirm := got.unconfirmedRisk() != nil; confirm != tt.wantConfirm {
+				t.Fatalf("needs confirmation = %t, want %t", confirm, tt.wantConfirm)
+			}
+		})
+	}
+}
+
+func TestSignWebhookPayload(t *testing.T) {
+	tests := []struct {
+		secret  string
+		payload string
+		want    string
+	}{
+		// RFC 4231 test case 2.
+		{"Jefe", "what do ya want for nothing?", "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+		{"", "", "sha256=b613679a0814d9ec772f95d778c35fc5ff1697c493715653c6c712144292c5ad"},
+	}
+	for _, tt := range tests {
+		if got := signWebhookPayload(tt.secret, []byte(tt.payload)); got != tt.want {
+			t.Errorf("signWebhookPayload(%q, %q) = %s, want %s", tt.secret, tt.payload, got, tt.want)
+		}
+	}
+	if !verifyGitHubSignature("s", []byte("body"), signWebhookPayload("s", []byte("body"))) {
+		t.Error("signature does not verify with the same secret")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	for attempt := 1; attempt < webhookAttempts; attempt++ {
+		base := time.Second << (attempt - 1)
+		seen := make(map[time.Duration]bool)
+		for range 50 {
+			d := webhookBackoff(attempt)
+			if d < base/2 || d > base {
+				t.Fatalf("attempt %d: backoff %s outside [%s, %s]", attempt, d, base/2, base)
+			}
+			seen[d] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("attempt %d: backoff has no jitter", attempt)
+		}
+	}
+}
+
+func TestPostWebhookRetry(t *testing.T) {
+	tests := []struct {
+		status    int
+		wantErr   bool
+		wantRetry bool
+	}{
+		{http.StatusOK, false, false},
+		{http.StatusNoContent, false, false},
+		{http.StatusBadRequest, true, false},
+		{http.StatusNotFound, true, false},
+		{http.StatusTooManyRequests, true, true},
+		{http.StatusInternalServerError, true, true},
+		{http.StatusBadGateway, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.status), func(t *testing.T) {
+			var gotSig, gotEvent string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotSig, gotEvent = r.Header.Get("X-JGO-Signature-256"), r.Header.Get("X-JGO-Event")
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			payload := []byte(`{"event":"run.completed"}`)
+			hook := WebhookConfig{URL: srv.URL, Secret: "s"}
+			retry, err := postWebhook(context.Background(), srv.Client(), hook, "completed", payload)
+			if (err != nil) != tt.wantErr || retry != tt.wantRetry {
+				t.Fatalf("retry=%t err=%v, want retry=%t err=%t", retry, err, tt.wantRetry, tt.wantErr)
+			}
+			if gotSig != signWebhookPayload("s", payload) || gotEvent != "run.completed" {
+				t.Fatalf("headers: signature=%q event=%q", gotSig, gotEvent)
+			}
+		})
+	}
+
+	retry, err := postWebhook(context.Background(), http.DefaultClient, WebhookConfig{URL: "http://127.0.0.1:1"}, "failed", nil)
+	if err == nil || !retry {
+		t.Fatalf("network error: retry=%t err=%v, want a retried error", retry, err)
+	}
+}
+
+func TestVerifyGitHubSignature(t *testing.T) {
+	body := []byte(`{"action":"created"}`)
+	good := signWebhookPayload("secret", body)
+	tests := []struct {
+		name   string
+		secret string
+		header string
+		want   bool
+	}{
+		{"good", "secret", good, true},
+		{"surrounding space", "secret", " " + good + " ", true},
+		{"wrong secret", "other", good, false},
+		{"tampered digest", "secret", good[:len(good)-1] + "0", false},
+		{"missing", "secret", "", false},
+		{"no prefix", "secret", strings.TrimPrefix(good, "sha256="), false},
+		{"sha1 prefix", "secret", "sha1=" + strings.TrimPrefix(good, "sha256="), false},
+		{"not hex", "secret", "sha256=zz", false},
+		{"truncated", "secret", good[:20], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyGitHubSignature(tt.secret, body, tt.header); got != tt.want {
+				t.Fatalf("verifyGitHubSignature = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseGitHubRunRequest(t *testing.T) {
+	cfg := GitHubConfig{Trigger: "/jgo", AllowedAssociation: []string{"OWNER", "MEMBER"}}
+	comment := func(body, association string) githubWebhookEvent {
+		return githubWebhookEvent{
+			Action:     "created",
+			Comment:    &githubComment{Body: body, AuthorAssociation: association, User: githubUser{Login: "u"}},
+			Issue:      &githubIssue{Number: 7},
+			Repository: githubRepository{FullName: "o/r"},
+			Sender:     githubUser{Login: "u", Type: "User"},
+		}
+	}
+	edited := comment("/jgo go", "OWNER")
+	edited.Action = "edited"
+	onPR := comment("/jgo go", "OWNER")
+	onPR.Issue.PullRequest = json.RawMessage(`{"url":"x"}`)
+	bot := comment("/jgo go", "OWNER")
+	bot.Sender.Type = "Bot"
+
+	tests := []struct {
+		name        string
+		event       string
+		payload     githubWebhookEvent
+		wantReason  string
+		wantCommand string
+		wantKind    string
+	}{
+		{"issue comment", "issue_comment", comment("please\n/jgo restart api\nthanks", "member"), "", "restart api\nthanks", "issue"},
+		{"pr comment", "issue_comment", onPR, "", "go", "pull_request"},
+		{"edited comment", "issue_comment", edited, "unsupported issue_comment action", "", ""},
+		{"pull_request event", "pull_request", comment("/jgo go", "OWNER"), `unsupported event "pull_request"`, "", ""},
+		{"no trigger", "issue_comment", comment("/jgox go", "OWNER"), "trigger not found", "", ""},
+		{"association", "issue_comment", comment("/jgo go", "NONE"), `author association "NONE" is not allowed`, "", ""},
+		{"bot", "issue_comment", bot, "comment posted by jgo or a bot", "", ""},
+		{"reply marker", "issue_comment", comment(githubReplyMarker+" run -->\n/jgo go", "OWNER"), "comment posted by jgo or a bot", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, reason := parseGitHubRunRequest(cfg, tt.event, tt.payload)
+			if reason != tt.wantReason {
+				t.Fatalf("reason = %q, want %q", reason, tt.wantReason)
+			}
+			if reason == "" && (req.Command != tt.wantCommand || req.Kind != tt.wantKind || req.Number != 7) {
+				t.Fatalf("got %+v", req)
+			}
+		})
+	}
+}
+
+func TestClaimGitHubDelivery(t *testing.T) {
+	if !claimGitHubDelivery("") || !claimGitHubDelivery("") {
+		t.Fatal("deliveries without an ID must not be deduplicated")
+	}
+	if !claimGitHubDelivery("test-first") {
+		t.Fatal("first delivery rejected")
+	}
+	if claimGitHubDelivery("test-first") {
+		t.Fatal("repeated delivery accepted")
+	}
+	for i := range maxGitHubDeliveries {
+		claimGitHubDelivery(fmt.Sprintf("test-fill-%d", i))
+	}
+	if !claimGitHubDelivery("test-first") {
+		t.Fatal("evicted delivery ID still remembered")
+	}
+}
+
+func TestProdKubectlChange(t *testing.T) {
+	prod := []string{"prod", "payments-prod"}
+	tests := []struct {
+		name string
+		plan runPlan
+		text string
+		want string
+	}{
+		{"unclassified change", runPlan{}, "kubectl -n prod rollout restart deploy/api", "prod"},
+		{"unclassified read", runPlan{}, "kubectl -n prod get pods", ""},
+		{"classified read-only", runPlan{RiskLevel: riskReadOnly}, "kubectl -n prod delete pod api", ""},
+		{"classified mutating", runPlan{RiskLevel: riskMutating}, "restart the api with kubectl in prod", "prod"},
+		{"required cli", runPlan{RiskLevel: riskMutating, RequiredCLIs: []string{"kubectl"}}, "restart api in payments-prod", "payments-prod"},
+		{"k8s target", runPlan{RiskLevel: riskDestructive, TargetSystems: []string{"k8s"}}, "delete the prod deployment", "prod"},
+		{"namespace is a whole word", runPlan{}, "kubectl -n production delete pod api", ""},
+		{"no kubectl", runPlan{RiskLevel: riskDestructive}, "drop the prod database", ""},
+		{"other namespace", runPlan{}, "kubectl -n staging delete pod api", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := prodKubectlChange(prod, tt.plan, strings.ToLower(tt.text)); got != tt.want {
+				t.Fatalf("prodKubectlChange = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluatePolicy(t *testing.T) {
+	rules := []PolicyRule{
+		{Name: "drop", Keywords: []string{"DROP TABLE"}},
+		{Name: "secrets", Pattern: `(?i)secret/[a-z]+`},
+		{Name: "risky-aws", RiskLevels: []string{"Destructive", "unknown"}, CLIs: []string{"aws"}},
+		{Name: "infra-repo", Repos: []string{"acme/infra-*"}},
+		{Name: "ns", Namespaces: []string{"billing"}},
+	}
+	for i := range rules {
+		if field, err := validatePolicyRule(&rules[i], i); err != nil {
+			t.Fatalf("rule %d %s: %v", i, field, err)
+		}
+	}
+	policy := PolicyConfig{Rules: rules, ProdNamespaces: []string{"prod"}}
+	tests := []struct {
+		name string
+		plan runPlan
+		want []string
+	}{
+		{"nothing", runPlan{Instruction: "list pods", RiskLevel: riskReadOnly}, nil},
+		{"keyword in optimized prompt", runPlan{Instruction: "clean up", OptimizedPrompt: "psql -c 'drop table users'"}, []string{`drop: keyword "drop table"`}},
+		{"pattern", runPlan{Instruction: "rotate Secret/Payments"}, []string{`secrets: pattern "(?i)secret/[a-z]+"`}},
+		{"all conditions must match", runPlan{Instruction: "aws s3 ls", RiskLevel: riskReadOnly}, nil},
+		{"risk and cli", runPlan{Instruction: "remove bucket", RiskLevel: riskDestructive, RequiredCLIs: []string{"aws"}}, []string{`risky-aws: risk destructive, cli "aws"`}},
+		{"unclassified risk", runPlan{Instruction: "aws s3 rb s3://b"}, []string{`risky-aws: risk unknown, cli "aws"`}},
+		{"repo glob", runPlan{Instruction: "bump acme/infra-live", RiskLevel: riskMutating}, []string{`infra-repo: repo "acme/infra-live"`}},
+		{"repo mismatch", runPlan{Instruction: "bump acme/app", RiskLevel: riskMutating}, nil},
+		{"namespace word", runPlan{Instruction: "scale billing workers", RiskLevel: riskMutating}, []string{`ns: namespace "billing"`}},
+		{
+			"prod kubectl plus rule",
+			runPlan{Instruction: "kubectl -n prod delete pod x in billing"},
+			[]string{`prod-kubectl: kubectl change in namespace "prod"`, `ns: namespace "billing"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := evaluatePolicy(policy, tt.plan)
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Fatalf("evaluatePolicy = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	unvalidated := PolicyConfig{Rules: []PolicyRule{{Name: "raw", Pattern: "never-matches"}}}
+	if got := evaluatePolicy(unvalidated, runPlan{Instruction: "anything"}); len(got) != 1 {
+		t.Fatalf("rule without a compiled pattern must hold the run, got %q", got)
+	}
+	bad := PolicyRule{Name: "bad", Pattern: "("}
+	if field, err := validatePolicyRule(&bad, 0); field != "pattern" || err == nil {
+		t.Fatalf("invalid pattern: field=%q err=%v", field, err)
+	}
+}
+
+func TestRequiredScope(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{http.MethodGet, "/api/runs", ""},
+		{http.MethodHead, "/api/runs/r1", ""},
+		{http.MethodGet, "/api/audit", scopeAudit},
+		{http.MethodPost, "/api/runs/r1/approve", scopeApprove},
+		{http.MethodPost, "/api/runs/r1/reject", scopeApprove},
+		{http.MethodPost, "/api/runs/r1/cancel", scopeRun},
+		{http.MethodPost, "/v1/chat/completions", scopeRun},
+		{http.MethodPut, "/api/schedules/s", scopeRun},
+		{http.MethodDelete, "/api/templates/t", scopeRun},
+		{http.MethodPost, "/mcp", scopeRun},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if got := requiredScope(r); got != tt.want {
+				t.Fatalf("requiredScope = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterTake(t *testing.T) {
+	l := &rateLimiter{buckets: make(map[string]*tokenBucket), runs: make(map[string]int)}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	ip := rateLimitWindow{id: "ip:1.2.3.4", perMinute: 60, burst: 3}
+	key := rateLimitWindow{id: "key:ci", perMinute: 60, burst: 2, daily: 5}
+
+	steps := []struct {
+		after         time.Duration
+		wantDenied    string
+		wantRemaining string
+	}{
+		{0, "", "1"},
+		{0, "", "0"},
+		{0, "key:ci", "0"},
+		// One token per second comes back.
+		{time.Second, "", "0"},
+		{0, "key:ci", "0"},
+		{10 * time.Second, "", "1"},
+	}
+	for i, step := range steps {
+		now = now.Add(step.after)
+		denied, retry, headers := l.take(now, ip, key)
+		got := ""
+		if denied != nil {
+			got = denied.id
+			if retry <= 0 || retry > time.Second {
+				t.Fatalf("step %d: retry %s", i, retry)
+			}
+		}
+		if got != step.wantDenied || headers["x-ratelimit-remaining-requests"] != step.wantRemaining {
+			t.Fatalf("step %d: denied=%q remaining=%s, want denied=%q remaining=%s", i, got, headers["x-ratelimit-remaining-requests"], step.wantDenied, step.wantRemaining)
+		}
+		if denied == nil && headers["x-ratelimit-limit-runs"] != "5" {
+			t.Fatalf("step %d: daily headers %v", i, headers)
+		}
+	}
+	// Denied requests must not drain the IP bucket: 3 accepted so far.
+	if tokens := l.buckets[ip.id].tokens; tokens < 0 || tokens > 3 {
+		t.Fatalf("ip bucket tokens = %v", tokens)
+	}
+	if u := l.usage(now, ip); u.Remaining == nil || *u.Remaining > 3 {
+		t.Fatalf("usage = %+v", u)
+	}
+}
+
+func TestRateLimiterDailyQuota(t *testing.T) {
+	l := &rateLimiter{buckets: make(map[string]*tokenBucket), runs: make(map[string]int)}
+	day := time.Date(2026, 10, 18, 23, 0, 0, 0, time.UTC)
+	window := rateLimitWindow{id: "key:ci", daily: 2}
+	for i := range 2 {
+		if err := l.chargeRun(day, window); err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+	}
+	if err := l.chargeRun(day, window); !errors.Is(err, errDailyQuota) {
+		t.Fatalf("third run: %v, want errDailyQuota", err)
+	}
+	if u := l.usage(day, window); u.RunsToday != 2 || u.RemainingRuns == nil || *u.RemainingRuns != 0 {
+		t.Fatalf("usage = %+v", u)
+	}
+	if err := l.chargeRun(day.Add(2*time.Hour), window); err != nil {
+		t.Fatalf("quota did not reset at UTC midnight: %v", err)
+	}
+	if err := l.chargeRun(day, rateLimitWindow{id: "key:free"}); err != nil {
+		t.Fatalf("unlimited window: %v", err)
+	}
+}
+
+func TestRateLimitResponse(t *testing.T) {
+	live := &liveConfig{}
+	live.Store(Config{RateLimits: RateLimitConfig{PerIP: 1}})
+	handler := rateLimit(live, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"/v1/chat/completions", http.StatusNoContent, ""},
+		{"/v1/chat/completions", http.StatusTooManyRequests, `"code":"rate_limit_exceeded"`},
+		{"/v1/messages", http.StatusTooManyRequests, `"type":"rate_limit_error"`},
+		{"/api/templates/t/run", http.StatusTooManyRequests, `"error":"rate limit reached for ip:203.0.113.41`},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+		req.RemoteAddr = "203.0.113.41:5000"
+		req = req.WithContext(context.WithValue(req.Context(), callerContextKey{}, callerIdentity{Name: "anonymous", Remote: req.RemoteAddr}))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.wantStatus || !strings.Contains(rec.Body.String(), tt.wantBody) {
+			t.Fatalf("%s: status %d body %s", tt.path, rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("x-ratelimit-limit-requests") != "1" || rec.Header().Get("x-ratelimit-remaining-requests") != "0" {
+			t.Fatalf("%s: headers %v", tt.path, rec.Header())
+		}
+		if tt.wantStatus == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Fatalf("%s: missing Retry-After", tt.path)
+		}
+	}
+
+	get := httptest.NewRequest(http.MethodGet, "/api/runs", nil)
+	get.RemoteAddr = "203.0.113.41:5000"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, get)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("reads must not be rate limited: %d", rec.Code)
+	}
+}
+
+func TestParseToolCalls(t *testing.T) {
+	tools := []chatTool{
+		{Type: "function", Function: chatToolFunction{Name: "get_weather"}},
+		{Type: "function", Function: chatToolFunction{Name: "page_oncall"}},
+	}
+	session := &toolSession{Tools: tools}
+	tests := []struct {
+		name        string
+		session     *toolSession
+		content     string
+		wantContent string
+		wantCalls   []string
+		wantErr     string
+	}{
+		{"no session", nil, "answer <tool_calls>[]</tool_calls>", "answer <tool_calls>[]</tool_calls>", nil, ""},
+		{"no block", session, "plain answer", "plain answer", nil, ""},
+		{
+			"object and string arguments", session,
+			"Checking.\n<tool_calls>\n[{\"name\":\"get_weather\",\"arguments\":{\"city\": \"Seoul\"}},{\"name\":\"page_oncall\",\"arguments\":\"{\\\"team\\\":\\\"db\\\"}\"}]\n</tool_calls>\n",
+			"Checking.", []string{`get_weather {"city":"Seoul"}`, `page_oncall {"team":"db"}`}, "",
+		},
+		{"missing arguments", session, "<tool_calls>[{\"name\":\"get_weather\"}]</tool_calls>", "", []string{"get_weather {}"}, ""},
+		{
+			"single call", &toolSession{Tools: tools, Single: true},
+			"<tool_calls>[{\"name\":\"get_weather\"},{\"name\":\"page_oncall\"}]</tool_calls>", "", []string{"get_weather {}"}, "",
+		},
+		{
+			"last block wins", session,
+			"example <tool_calls>[{\"name\":\"nope\"}]</tool_calls> then <tool_calls>[{\"name\":\"page_oncall\",\"arguments\":{}}]</tool_calls>",
+			"example <tool_calls>[{\"name\":\"nope\"}]</tool_calls> then", []string{"page_oncall {}"}, "",
+		},
+		{"unknown tool", session, "<tool_calls>[{\"name\":\"rm_rf\"}]</tool_calls>", "", nil, `unknown tool "rm_rf"`},
+		{"unterminated", session, "x <tool_calls>[{\"name\":\"get_weather\"}]", "", nil, "unterminated"},
+		{"bad json", session, "<tool_calls>{oops}</tool_calls>", "", nil, "decode tool calls"},
+		{"empty list", session, "<tool_calls>[]</tool_calls>", "", nil, "empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, calls, err := parseToolCalls(tt.content, tt.session, "run-1")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) || content != tt.content || calls != nil {
+					t.Fatalf("got %q %v %v, want error %q with content unchanged", content, calls, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if content != tt.wantContent {
+				t.Fatalf("content = %q, want %q", content, tt.wantContent)
+			}
+			var got []string
+			for i, call := range calls {
+				if call.ID != toolCallID("run-1", i+1) || call.Type != "function" {
+					t.Fatalf("call %d = %+v", i, call)
+				}
+				got = append(got, call.Function.Name+" "+call.Function.Arguments)
+			}
+			if strings.Join(got, "|") != strings.Join(tt.wantCalls, "|") {
+				t.Fatalf("calls = %q, want %q", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestTakeResultsOwnership(t *testing.T) {
+	if err := loadRunHistory(filepath.Join(t.TempDir(), "history.jsonl"), false); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { loadRunHistory("", false) })
+	appendRunHistory(runHistoryRecord{RunID: "run-a", Status: "completed", Caller: "alice", CodexThread: "thread-a"}, 0)
+	appendRunHistory(runHistoryRecord{RunID: "run-nothread", Status: "completed", Caller: "alice"}, 0)
+
+	messages := func(runID string) []chatRequestMessage {
+		call := chatToolCall{ID: toolCallID(runID, 1), Type: "function", Function: chatFunctionCall{Name: "get_weather", Arguments: `{"city":"Seoul"}`}}
+		return []chatRequestMessage{
+			{Role: "user", Content: chatContent{Text: "weather?"}},
+			{Role: "assistant", ToolCalls: []chatToolCall{call}},
+			{Role: "tool", ToolCallID: call.ID, Content: chatContent{Text: "sunny"}},
+		}
+	}
+	tests := []struct {
+		name     string
+		caller   string
+		messages []chatRequestMessage
+		wantErr  string
+	}{
+		{"owner resumes", "alice", messages("run-a"), ""},
+		{"other caller", "bob", messages("run-a"), `run "run-a" cannot be resumed`},
+		{"unknown run", "alice", messages("run-gone"), `run "run-gone" cannot be resumed`},
+		{"no codex thread", "alice", messages("run-nothread"), `run "run-nothread" cannot be resumed`},
+		{"no tool messages", "alice", messages("run-a")[:2], ""},
+		{"orphan tool message", "alice", []chatRequestMessage{{Role: "tool", ToolCallID: "call_run-a_1"}}, "must follow an assistant message"},
+		{
+			"mismatched call id", "alice",
+			append(messages("run-a")[:2], chatRequestMessage{Role: "tool", ToolCallID: "call_run-a_9"}),
+			"does not match a tool call",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), callerContextKey{}, callerIdentity{Name: tt.caller})
+			session := &toolSession{}
+			instruction, err := session.takeResults(ctx, tt.messages)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) || session.Results || session.Thread != "" {
+					t.Fatalf("got %v session=%+v, want error %q", err, session, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.messages) == 2 {
+				if instruction != "" || session.Results {
+					t.Fatalf("no results expected, got %q", instruction)
+				}
+				return
+			}
+			if !session.Results || session.Thread != "thread-a" || !strings.Contains(instruction, `get_weather({"city":"Seoul"}):`+"\nsunny") {
+				t.Fatalf("session=%+v instruction=%q", session, instruction)
+			}
+		})
+	}
+}
+
+func TestMCPCallTool(t *testing.T) {
+	if err := loadRunHistory(filepath.Join(t.TempDir(), "history.jsonl"), false); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { loadRunHistory("", false) })
+
+	keys := []APIKeyConfig{
+		{Name: "alice", Key: "ka", Scopes: []string{scopeRun}},
+		{Name: "bob", Key: "kb", Scopes: []string{scopeRun, scopeApprove}},
+		{Name: "root", Key: "kr", Scopes: []string{"*"}},
+	}
+	live := &liveConfig{}
+	live.Store(Config{APIKeys: keys, Policy: PolicyConfig{ApprovalTimeout: time.Hour}})
+	server := &mcpServer{live: live}
+	caller := func(name string) context.Context {
+		for _, key := range keys {
+			if key.Name == name {
+				return context.WithValue(context.Background(), callerContextKey{}, callerIdentity{Name: name, Scopes: key.Scopes})
+			}
+		}
+		t.Fatalf("unknown caller %s", name)
+		return nil
+	}
+	hold := func(runID, owner string) {
+		pending := &pendingRun{
+			cfg:       live.Load(),
+			plan:      runPlan{Instruction: "drop table", Policy: []string{"drop"}},
+			caller:    callerIdentity{Name: owner},
+			status:    "awaiting_approval",
+			createdAt: time.Now(),
+			expiresAt: time.Now().Add(time.Hour),
+		}
+		pendingRunsMu.Lock()
+		pendingRuns[runID] = pending
+		pendingRunsMu.Unlock()
+		appendRunHistory(pendingRunRecord(runID, pending), 0)
+	}
+	start := func(runID, owner string) context.Context {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		serverRuns.mu.Lock()
+		serverRuns.cancels[runID] = cancel
+		serverRuns.mu.Unlock()
+		t.Cleanup(func() {
+			serverRuns.mu.Lock()
+			delete(serverRuns.cancels, runID)
+			serverRuns.mu.Unlock()
+		})
+		appendRunHistory(runHistoryRecord{RunID: runID, Status: "running", Caller: owner}, 0)
+		return ctx
+	}
+	appendRunHistory(runHistoryRecord{RunID: "mcp-done", Status: "completed", Caller: "alice", Instruction: "list pods"}, 0)
+	hold("mcp-held-alice", "alice")
+	hold("mcp-held-bob", "bob")
+	aliceRun := start("mcp-running-alice", "alice")
+	start("mcp-running-bob", "bob")
+
+	tests := []struct {
+		name    string
+		caller  string
+		tool    string
+		args    string
+		wantErr bool
+		want    string
+	}{
+		{"bad arguments", "alice", "get_run", `[]`, true, "invalid arguments"},
+		{"missing run_id", "alice", "get_run", `{}`, true, "run_id is required"},
+		{"get run", "alice", "get_run", `{"run_id":"mcp-done"}`, false, `"instruction": "list pods"`},
+		{"get unknown run", "alice", "get_run", `{"run_id":"nope"}`, true, `run "nope" not found`},
+		{"list by status", "alice", "list_runs", `{"status":"awaiting_approval","limit":1}`, false, `"total": 1`},
+		{"run needs instruction", "alice", "run_instruction", `{"instruction":" "}`, true, "instruction is required"},
+		{"cancel another caller's run", "alice", "cancel_run", `{"run_id":"mcp-running-bob"}`, true, "started by another caller"},
+		{"reject own held run without approve scope", "alice", "cancel_run", `{"run_id":"mcp-held-alice"}`, true, `needs the "approve" scope`},
+		{"reject own held run with approve scope", "bob", "cancel_run", `{"run_id":"mcp-held-bob"}`, false, `"status": "rejected"`},
+		{"reject again", "bob", "cancel_run", `{"run_id":"mcp-held-bob"}`, true, "is not running or pending"},
+		{"cancel own run", "alice", "cancel_run", `{"run_id":"mcp-running-alice"}`, false, `"status": "cancelling"`},
+		{"admin rejects anyone's held run", "root", "cancel_run", `{"run_id":"mcp-held-alice"}`, false, `"approver": "root"`},
+		{"admin cancels anyone's run", "root", "cancel_run", `{"run_id":"mcp-running-bob"}`, false, `"status": "cancelling"`},
+		{"finished run", "alice", "cancel_run", `{"run_id":"mcp-done"}`, true, "is not running or pending"},
+		{"unknown run", "root", "cancel_run", `{"run_id":"nope"}`, true, `run "nope" not found`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := server.callTool(caller(tt.caller), tt.tool, json.RawMessage(tt.args))
+			if got.IsError != tt.wantErr || len(got.Content) != 1 || !strings.Contains(got.Content[0].Text, tt.want) {
+				t.Fatalf("callTool = error:%t %+v, want error:%t containing %q", got.IsError, got.Content, tt.wantErr, tt.want)
+			}
+		})
+	}
+	if !errors.Is(context.Cause(aliceRun), errRunCancelled) {
+		t.Fatalf("own run cause = %v, want errRunCancelled", context.Cause(aliceRun))
+	}
+	if entry, _ := lookupRunHistory("mcp-held-bob"); entry.Status != "rejected" || entry.Approver != "bob" {
+		t.Fatalf("held run record = %+v", entry)
+	}
+}
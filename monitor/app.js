@@ -2,6 +2,8 @@ const STORAGE_KEY = "autonomous-dev-monitor:v1";
 const DEFAULT_ENDPOINT = new URL("/v1/chat/completions", window.location.origin).toString();
 
 const state = loadState();
+let liveAbort = null;
+let stepsTimer = null;
 const els = {
   messages: document.getElementById("messages"),
   summary: document.getElementById("summary"),
@@ -10,6 +12,9 @@ const els = {
   statusLine: document.getElementById("status-line"),
   process: document.getElementById("process"),
   runLog: document.getElementById("run-log"),
+  liveOutput: document.getElementById("live-output"),
+  liveRunId: document.getElementById("live-run-id"),
+  runSteps: document.getElementById("run-steps"),
   sessionSelect: document.getElementById("session-select"),
   input: document.getElementById("input"),
   form: document.getElementById("composer"),
@@ -150,13 +155,16 @@ function deleteSession() {
 
 function updateSummary(text) {
   els.summary.textContent = text;
-  const riskLine = (text.match(/위험도[:\s]*(낮음|보통|높음)/) || [])[1] || "unknown";
   const scoreLine = (text.match(/(안정도|stability).{0,30}([0-9]+(?:\.[0-9])?)/i) || [])[2] || "-";
-  els.risk.textContent = riskLine;
-  els.risk.dataset.level = riskLine;
   els.stability.textContent = scoreLine;
 }
 
+function updateRisk(run) {
+  const level = run?.risk_level || "unknown";
+  els.risk.textContent = run?.summary ? `${level} · ${run.summary}` : level;
+  els.risk.dataset.level = level;
+}
+
 async function sendMessage(event) {
   event.preventDefault();
   const content = els.input.value.trim();
@@ -236,7 +244,8 @@ async function requestCommand() {
 
 async function loadRunHistory(initial = false) {
   try {
-    const res = await fetch("/api/runs?limit=20", { method: "GET" });
+    const headers = state.config.apiKey ? { Authorization: `Bearer ${state.config.apiKey}` } : {};
+    const res = await fetch("/api/runs?limit=20", { method: "GET", headers });
     if (!res.ok) {
       if (initial) {
         appendProcessStatus("실행 이력을 불러오지 못했습니다.");
@@ -245,6 +254,7 @@ async function loadRunHistory(initial = false) {
     }
     const body = await res.json();
     renderRunHistory(body?.items || []);
+    updateRisk(body?.items?.[0]);
     if (body?.items?.length > 0 && !initial) {
       const lastCompleted = body.items.find((run) => run.status === "completed");
       if (lastCompleted) {
@@ -277,6 +287,10 @@ function renderRunHistory(items) {
     const meta = document.createElement("div");
     meta.className = "run-meta";
     meta.textContent = `${item.duration_ms ?? item.durationMs ?? 0}ms`;
+    if (item.optimizer_provider) meta.textContent += ` · optimizer=${item.optimizer_provider}`;
+    if (item.risk_level) meta.textContent += ` · risk=${item.risk_level}`;
+    if (item.approver) meta.textContent += ` · approver=${item.approver}`;
+    if (item.status === "awaiting_approval" && item.expires_at) meta.textContent += ` · expires=${item.expires_at}`;
 
     const prompt = document.createElement("div");
     prompt.className = "run-instruction";
@@ -285,6 +299,12 @@ function renderRunHistory(items) {
     const result = document.createElement("div");
     result.className = "run-result";
     result.textContent = item.error ? `ERROR: ${truncate(item.error, 120)}` : truncate(item.response || "", 120);
+    if (item.policy?.length) result.textContent = `POLICY: ${truncate(item.policy.join("; "), 160)}`;
+
+    const runId = item.run_id || item.runID || "";
+    if (runId) {
+      row.addEventListener("click", () => watchRun(runId));
+    }
 
     row.appendChild(left);
     row.appendChild(meta);
@@ -299,6 +319,123 @@ function renderRunHistory(items) {
   });
 }
 
+function watchRun(runId) {
+  if (liveAbort) liveAbort.abort();
+  els.liveRunId.textContent = runId;
+  els.liveOutput.textContent = "";
+  els.runSteps.innerHTML = "";
+  void loadRunSteps(runId);
+
+  // fetch instead of EventSource so the API key travels in a header, not the URL.
+  const abort = new AbortController();
+  liveAbort = abort;
+  void streamRun(runId, abort.signal).catch(() => {
+    if (abort.signal.aborted) return;
+    if (!els.liveOutput.textContent) {
+      els.liveOutput.textContent = "실시간 출력을 불러오지 못했습니다.";
+    }
+  }).finally(() => {
+    if (liveAbort === abort) liveAbort = null;
+  });
+}
+
+async function streamRun(runId, signal) {
+  const headers = state.config.apiKey ? { Authorization: `Bearer ${state.config.apiKey}` } : {};
+  const res = await fetch(`/api/runs/${encodeURIComponent(runId)}/stream`, { headers, signal });
+  if (!res.ok || !res.body) {
+    const body = await res.json().catch(() => ({}));
+    els.liveOutput.textContent = body.error || "실시간 출력을 불러오지 못했습니다.";
+    return;
+  }
+  const reader = res.body.pipeThrough(new TextDecoderStream()).getReader();
+  let buffer = "";
+  for (;;) {
+    const { value, done } = await reader.read();
+    if (done) return;
+    buffer += value;
+    let end;
+    while ((end = buffer.indexOf("\n\n")) >= 0) {
+      const block = buffer.slice(0, end);
+      buffer = buffer.slice(end + 2);
+      const event = /^event: (.*)$/m.exec(block)?.[1];
+      const data = block.split("\n").filter((line) => line.startsWith("data: ")).map((line) => line.slice(6)).join("\n");
+      if (!data) continue;
+      if (event === "output") {
+        els.liveOutput.textContent += JSON.parse(data).text;
+        els.liveOutput.scrollTop = els.liveOutput.scrollHeight;
+        scheduleRunSteps(runId);
+      } else if (event === "done") {
+        els.liveOutput.textContent += `\n[${JSON.parse(data).status}]`;
+        void loadRunSteps(runId);
+        return;
+      }
+    }
+  }
+}
+
+function scheduleRunSteps(runId) {
+  if (stepsTimer) return;
+  stepsTimer = setTimeout(() => {
+    stepsTimer = null;
+    void loadRunSteps(runId);
+  }, 1000);
+}
+
+async function loadRunSteps(runId) {
+  try {
+    const headers = state.config.apiKey ? { Authorization: `Bearer ${state.config.apiKey}` } : {};
+    const res = await fetch(`/api/runs/${encodeURIComponent(runId)}/steps`, { method: "GET", headers });
+    if (els.liveRunId.textContent !== runId) return;
+    if (!res.ok) {
+      els.runSteps.textContent = "실행 단계를 불러오지 못했습니다.";
+      return;
+    }
+    const body = await res.json();
+    renderRunSteps(body?.steps || []);
+  } catch {
+    els.runSteps.textContent = "실행 단계 API를 사용 불가";
+  }
+}
+
+function renderRunSteps(steps) {
+  els.runSteps.innerHTML = "";
+  if (steps.length === 0) {
+    els.runSteps.textContent = "구조화된 단계가 없습니다.";
+    return;
+  }
+  steps.forEach((step) => {
+    const row = document.createElement("div");
+    row.className = `step ${step.type} ${step.status}${step.final ? " final" : ""}`;
+
+    const head = document.createElement("div");
+    head.className = "step-head";
+    head.textContent = `#${step.index + 1} ${step.type}`;
+    if (step.exit_code !== undefined) head.textContent += ` · exit=${step.exit_code}`;
+    if (step.duration_ms) head.textContent += ` · ${step.duration_ms}ms`;
+    if (step.final) head.textContent += " · final";
+    row.appendChild(head);
+
+    const body = document.createElement("div");
+    body.className = "step-body";
+    if (step.type === "command") body.textContent = `$ ${step.command || ""}`;
+    else if (step.type === "file_change") body.textContent = (step.files || []).map((f) => `${f.kind} ${f.path}`).join("\n");
+    else body.textContent = truncate(step.text || "", 600);
+    row.appendChild(body);
+
+    if (step.output) {
+      const details = document.createElement("details");
+      const summary = document.createElement("summary");
+      summary.textContent = "output";
+      const pre = document.createElement("pre");
+      pre.textContent = step.output;
+      details.appendChild(summary);
+      details.appendChild(pre);
+      row.appendChild(details);
+    }
+    els.runSteps.appendChild(row);
+  });
+}
+
 function truncate(text, max) {
   const raw = String(text || "");
   return raw.length <= max ? raw : `${raw.slice(0, max)}...`;